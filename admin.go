@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-graphite/carbonzipper/pathcache"
+	queryCache "github.com/go-graphite/carbonzipper/zipper/cache"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+)
+
+// routingKind is the cache kind of the admin API, that selects path caches (routing index) of the groups
+const routingKind = "routing"
+
+// adminHandler returns handler of the admin API, that allows to inspect and drop caches and reload backends at runtime.
+// It should be served only on the private admin listener
+func adminHandler(configFile, envPrefix string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/cache/", adminCacheStatsHandler)
+	mux.HandleFunc("/admin/cache/purge", adminCachePurgeHandler)
+	mux.HandleFunc("/admin/cache/flush", adminCacheFlushHandler)
+	mux.HandleFunc("/admin/probe", adminProbeHandler)
+	mux.HandleFunc("/admin/reload", func(w http.ResponseWriter, req *http.Request) {
+		adminReloadHandler(w, req, configFile, envPrefix)
+	})
+	return mux
+}
+
+func writeAdminResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	jEnc := json.NewEncoder(w)
+	jEnc.SetIndent("", "  ")
+	jEnc.Encode(v)
+}
+
+// adminCacheStatsHandler lists counters of the query caches and sizes of the path caches by group
+func adminCacheStatsHandler(w http.ResponseWriter, req *http.Request) {
+	writeAdminResponse(w, map[string]interface{}{
+		"query":   queryCache.AllStats(),
+		"routing": pathcache.AllStats(),
+	})
+}
+
+// purgeResult merges amounts of removed query cache items, shared cache and chunk cache items of the root group and
+// path cache entries by group name and cache kind
+func purgeResult(query, root map[string]map[string]int, routing map[string]int) map[string]map[string]int {
+	if query == nil {
+		query = make(map[string]map[string]int)
+	}
+	for group, m := range root {
+		if query[group] == nil {
+			query[group] = make(map[string]int)
+		}
+		for kind, removed := range m {
+			query[group][kind] = removed
+		}
+	}
+	for group, removed := range routing {
+		if query[group] == nil {
+			query[group] = make(map[string]int)
+		}
+		query[group][routingKind] = removed
+	}
+	return query
+}
+
+// adminCachePurgeHandler removes items requested for metrics that have the prefix or overlap the glob (e.g. glob a.b.c
+// purges items requested for a.*.c). Optional group and kind (info, find, fetch, probe, shared, chunks or routing) limit
+// the caches that are purged
+func adminCachePurgeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	group := req.FormValue("group")
+	kind := req.FormValue("kind")
+	prefix := req.FormValue("prefix")
+	glob := req.FormValue("glob")
+
+	var match func(metric string) bool
+	switch {
+	case prefix != "" && glob != "":
+		http.Error(w, "either prefix or glob should be specified, not both", http.StatusBadRequest)
+		return
+	case prefix != "":
+		match = func(metric string) bool { return strings.HasPrefix(metric, prefix) }
+	case glob != "":
+		match = func(metric string) bool { return pathcache.Overlap(glob, metric) }
+	default:
+		http.Error(w, "prefix or glob should be specified", http.StatusBadRequest)
+		return
+	}
+
+	var query, root map[string]map[string]int
+	if kind != routingKind {
+		query = queryCache.Purge(group, kind, match)
+		root = purgeRootCaches(group, kind, match)
+	}
+	var routing map[string]int
+	if kind == "" || kind == routingKind {
+		routing = pathcache.Purge(group, match)
+	}
+	res := purgeResult(query, root, routing)
+
+	zapwriter.Logger("admin").Info("caches purged",
+		zap.String("group", group),
+		zap.String("kind", kind),
+		zap.String("prefix", prefix),
+		zap.String("glob", glob),
+		zap.Any("removed", res),
+	)
+	writeAdminResponse(w, res)
+}
+
+// purgeRootCaches purges shared and chunk caches, if the group is empty or the root one
+func purgeRootCaches(group, kind string, match func(metric string) bool) map[string]map[string]int {
+	res := config.zipper.PurgeRootCaches(kind, match)
+	if group == "" {
+		return res
+	}
+	if _, ok := res[group]; !ok {
+		return nil
+	}
+	return res
+}
+
+// adminCacheFlushHandler removes all items from the caches of the group. Optional kind limits the caches that are
+// flushed
+func adminCacheFlushHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	group := req.FormValue("group")
+	kind := req.FormValue("kind")
+	if group == "" {
+		http.Error(w, "group should be specified", http.StatusBadRequest)
+		return
+	}
+
+	var query, root map[string]map[string]int
+	if kind != routingKind {
+		query = queryCache.Flush(group, kind)
+		root = purgeRootCaches(group, kind, nil)
+	}
+	var routing map[string]int
+	if kind == "" || kind == routingKind {
+		routing = pathcache.Purge(group, func(string) bool { return true })
+	}
+	res := purgeResult(query, root, routing)
+	if len(res) == 0 {
+		http.Error(w, "unknown group", http.StatusNotFound)
+		return
+	}
+
+	zapwriter.Logger("admin").Info("caches flushed",
+		zap.String("group", group),
+		zap.String("kind", kind),
+		zap.Any("removed", res),
+	)
+	writeAdminResponse(w, res)
+}
+
+// adminProbeHandler makes zipper probe the backends for top-level names right away
+func adminProbeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	started := config.zipper.ForceProbe()
+
+	zapwriter.Logger("admin").Info("probe forced",
+		zap.Bool("started", started),
+	)
+	writeAdminResponse(w, map[string]bool{"started": started})
+}
+
+// adminReloadHandler reads config file again and replaces backend groups, the same way as SIGHUP does
+func adminReloadHandler(w http.ResponseWriter, req *http.Request, configFile, envPrefix string) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logger := zapwriter.Logger("reload")
+	logger.Info("reloading config",
+		zap.String("config_file", configFile),
+		zap.String("source", "admin"),
+	)
+	err := reloadConfig(configFile, envPrefix)
+	if err != nil {
+		logger.Error("failed to reload config",
+			zap.String("config_file", configFile),
+			zap.Error(err),
+		)
+		http.Error(w, "failed to reload config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Info("config reloaded")
+	writeAdminResponse(w, map[string]bool{"reloaded": true})
+}
@@ -0,0 +1,266 @@
+package admission
+
+import (
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Identities that can be used to tell clients apart
+const (
+	IdentityIP     = "ip"
+	IdentityHeader = "header"
+	IdentityAPIKey = "apikey"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	apiKeyParam  = "apiKey"
+
+	// state of the clients, that didn't send anything for that long, is forgotten
+	defaultIdleTime = 10 * time.Minute
+)
+
+// Limits for one client. Zero value means no limit
+type Limits struct {
+	// Rate of requests per second and amount of requests that can be done at once above the rate. Burst defaults to rate
+	RequestsPerSecond float64 `mapstructure:"requestsPerSecond"`
+	Burst             int     `mapstructure:"burst"`
+	// Maximum amount of concurrent requests
+	MaxConcurrent int `mapstructure:"maxConcurrent"`
+}
+
+func (l Limits) enabled() bool {
+	return l.RequestsPerSecond > 0 || l.MaxConcurrent > 0
+}
+
+func (l Limits) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, l.RequestsPerSecond)
+}
+
+// Config contains configuration of frontend admission control
+type Config struct {
+	// How clients are identified: ip (default), header (value of Header) or apikey (X-API-Key header or apiKey parameter)
+	Identity string `mapstructure:"identity"`
+	Header   string `mapstructure:"header"`
+	// Limits for every client
+	Limits `mapstructure:",squash"`
+	// Limits for specific clients, that override default ones
+	Overrides []Override `mapstructure:"overrides"`
+}
+
+// Override contains limits for one client. It's a list entry rather than a map key, as config keys are split on dots
+// and lowercased, which breaks IP addresses and case-sensitive API keys and headers
+type Override struct {
+	// IP address, header value or API key of the client, depending on identity
+	Client string `mapstructure:"client"`
+	Limits `mapstructure:",squash"`
+}
+
+// Totals of accepted and rejected requests for all clients, they should be published by the caller
+var (
+	Accepted expvar.Int
+	Rejected expvar.Int
+)
+
+type client struct {
+	sync.Mutex
+	limits Limits
+
+	tokens   float64
+	updated  time.Time
+	inFlight int
+
+	accepted int64
+	rejected int64
+}
+
+// admit returns 0 if request can be served, otherwise amount of seconds after which client should retry
+func (c *client) admit(now time.Time) int {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.limits.RequestsPerSecond > 0 {
+		c.tokens = math.Min(c.limits.burst(), c.tokens+now.Sub(c.updated).Seconds()*c.limits.RequestsPerSecond)
+		if c.tokens < 1 {
+			c.updated = now
+			c.rejected++
+			return int(math.Ceil((1 - c.tokens) / c.limits.RequestsPerSecond))
+		}
+	}
+	c.updated = now
+	if c.limits.MaxConcurrent > 0 && c.inFlight >= c.limits.MaxConcurrent {
+		c.rejected++
+		return 1
+	}
+
+	if c.limits.RequestsPerSecond > 0 {
+		c.tokens--
+	}
+	c.inFlight++
+	c.accepted++
+	return 0
+}
+
+func (c *client) done() {
+	c.Lock()
+	c.inFlight--
+	c.Unlock()
+}
+
+// Admission limits rate and concurrency of requests per client
+type Admission struct {
+	sync.Mutex
+	config    Config
+	logger    *zap.Logger
+	clients   map[string]*client
+	overrides map[string]Limits
+}
+
+// New creates admission control. It passes all requests, if there are no limits in config
+func New(logger *zap.Logger, config Config) *Admission {
+	a := &Admission{
+		config:    config,
+		logger:    logger,
+		clients:   make(map[string]*client),
+		overrides: make(map[string]Limits, len(config.Overrides)),
+	}
+	for _, o := range config.Overrides {
+		a.overrides[o.Client] = o.Limits
+	}
+	if a.config.Identity == "" {
+		a.config.Identity = IdentityIP
+	}
+	if a.enabled() {
+		go a.cleanup(defaultIdleTime)
+	}
+
+	return a
+}
+
+func (a *Admission) identity(req *http.Request) string {
+	switch strings.ToLower(a.config.Identity) {
+	case IdentityHeader:
+		return req.Header.Get(a.config.Header)
+	case IdentityAPIKey:
+		if key := req.Header.Get(apiKeyHeader); key != "" {
+			return key
+		}
+		return req.URL.Query().Get(apiKeyParam)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (a *Admission) client(id string, now time.Time) *client {
+	a.Lock()
+	defer a.Unlock()
+
+	c, ok := a.clients[id]
+	if !ok {
+		limits, ok := a.overrides[id]
+		if !ok {
+			limits = a.config.Limits
+		}
+		c = &client{
+			limits:  limits,
+			tokens:  limits.burst(),
+			updated: now,
+		}
+		a.clients[id] = c
+	}
+	return c
+}
+
+// cleanup forgets clients that don't have requests in flight and were idle for a while
+func (a *Admission) cleanup(idleTime time.Duration) {
+	for range time.Tick(idleTime) {
+		now := time.Now()
+		a.Lock()
+		for id, c := range a.clients {
+			c.Lock()
+			if c.inFlight == 0 && now.Sub(c.updated) > idleTime {
+				delete(a.clients, id)
+			}
+			c.Unlock()
+		}
+		a.Unlock()
+	}
+}
+
+func (a *Admission) enabled() bool {
+	if a.config.Limits.enabled() {
+		return true
+	}
+	for _, l := range a.overrides {
+		if l.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler wraps h, so requests above client's limits are rejected with 429 Too Many Requests
+func (a *Admission) Handler(h http.HandlerFunc) http.HandlerFunc {
+	if !a.enabled() {
+		return h
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := a.identity(req)
+		c := a.client(id, time.Now())
+		if retryAfter := c.admit(time.Now()); retryAfter > 0 {
+			Rejected.Add(1)
+			a.logger.Debug("request rejected",
+				zap.String("identity", id),
+				zap.String("uri", req.URL.RequestURI()),
+				zap.Int("retry_after", retryAfter),
+			)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		Accepted.Add(1)
+		defer c.done()
+
+		h(w, req)
+	}
+}
+
+// ClientStats contains amount of accepted and rejected requests of one client
+type ClientStats struct {
+	Accepted int64 `json:"accepted"`
+	Rejected int64 `json:"rejected"`
+	InFlight int   `json:"inFlight"`
+}
+
+// Stats returns per-client counters for recently seen clients, suitable for expvar.Func
+func (a *Admission) Stats() interface{} {
+	a.Lock()
+	defer a.Unlock()
+
+	res := make(map[string]ClientStats, len(a.clients))
+	for id, c := range a.clients {
+		c.Lock()
+		res[id] = ClientStats{
+			Accepted: c.accepted,
+			Rejected: c.rejected,
+			InFlight: c.inFlight,
+		}
+		c.Unlock()
+	}
+	return res
+}
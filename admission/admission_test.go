@@ -0,0 +1,85 @@
+package admission
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func doRequest(h http.HandlerFunc, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/render/?target=foo", nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+func TestRateLimit(t *testing.T) {
+	a := New(zap.NewNop(), Config{
+		Limits: Limits{RequestsPerSecond: 0.5, Burst: 2},
+		Overrides: []Override{
+			{Client: "10.0.0.2", Limits: Limits{RequestsPerSecond: 100}},
+		},
+	})
+	h := a.Handler(func(w http.ResponseWriter, req *http.Request) {})
+
+	for i := 0; i < 2; i++ {
+		if w := doRequest(h, "10.0.0.1:1234", nil); w.Code != http.StatusOK {
+			t.Fatalf("request %v: got %v, expected %v", i, w.Code, http.StatusOK)
+		}
+	}
+	w := doRequest(h, "10.0.0.1:4321", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %v, expected %v", w.Code, http.StatusTooManyRequests)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "2" {
+		t.Errorf("got Retry-After %v, expected 2", ra)
+	}
+
+	// Other clients have their own limits
+	for i := 0; i < 3; i++ {
+		if w := doRequest(h, "10.0.0.2:1234", nil); w.Code != http.StatusOK {
+			t.Fatalf("request %v: got %v, expected %v", i, w.Code, http.StatusOK)
+		}
+	}
+
+	stats := a.Stats().(map[string]ClientStats)
+	if s := stats["10.0.0.1"]; s.Accepted != 2 || s.Rejected != 1 {
+		t.Errorf("unexpected stats for 10.0.0.1: %+v", s)
+	}
+	if s := stats["10.0.0.2"]; s.Accepted != 3 || s.Rejected != 0 {
+		t.Errorf("unexpected stats for 10.0.0.2: %+v", s)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	a := New(zap.NewNop(), Config{
+		Identity: IdentityHeader,
+		Header:   "X-Client",
+		Limits:   Limits{MaxConcurrent: 1},
+	})
+
+	var inner *httptest.ResponseRecorder
+	var h http.HandlerFunc
+	h = a.Handler(func(w http.ResponseWriter, req *http.Request) {
+		if inner == nil {
+			// Same client can't do second request, while the first one is in flight
+			inner = doRequest(h, "10.0.0.2:1234", http.Header{"X-Client": []string{"foo"}})
+		}
+	})
+
+	if w := doRequest(h, "10.0.0.1:1234", http.Header{"X-Client": []string{"foo"}}); w.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", w.Code, http.StatusOK)
+	}
+	if inner.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %v, expected %v", inner.Code, http.StatusTooManyRequests)
+	}
+	if w := doRequest(h, "10.0.0.1:1234", http.Header{"X-Client": []string{"foo"}}); w.Code != http.StatusOK {
+		t.Fatalf("request after first one is done: got %v, expected %v", w.Code, http.StatusOK)
+	}
+}
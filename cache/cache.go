@@ -20,12 +20,14 @@ var (
 type BytesCache interface {
 	Get(k string) ([]byte, error)
 	Set(k string, v []byte, expire int32)
+	Delete(k string)
 }
 
 type NullCache struct{}
 
 func (NullCache) Get(string) ([]byte, error) { return nil, ErrNotFound }
 func (NullCache) Set(string, []byte, int32)  {}
+func (NullCache) Delete(string)              {}
 
 func NewExpireCache(maxsize uint64) BytesCache {
 	ec := expirecache.New(maxsize)
@@ -51,17 +53,30 @@ func (ec ExpireCache) Set(k string, v []byte, expire int32) {
 	ec.ec.Set(k, v, uint64(len(v)), expire)
 }
 
+// Delete replaces the item with expired one, as expirecache can't remove items. It's dropped by the cleaner later
+func (ec ExpireCache) Delete(k string) {
+	ec.ec.Set(k, []byte(nil), 0, 0)
+}
+
 func (ec ExpireCache) Items() int { return ec.ec.Items() }
 
 func (ec ExpireCache) Size() uint64 { return ec.ec.Size() }
 
 func NewMemcached(prefix string, servers ...string) BytesCache {
-	return &MemcachedCache{prefix: prefix, client: memcache.New(servers...)}
+	return NewMemcachedWithTimeout(prefix, 50*time.Millisecond, servers...)
+}
+
+// NewMemcachedWithTimeout creates memcached cache, that gives up on Get after timeout
+func NewMemcachedWithTimeout(prefix string, timeout time.Duration, servers ...string) BytesCache {
+	client := memcache.New(servers...)
+	client.Timeout = timeout
+	return &MemcachedCache{prefix: prefix, client: client, timeout: timeout}
 }
 
 type MemcachedCache struct {
 	prefix   string
 	client   *memcache.Client
+	timeout  time.Duration
 	timeouts uint64
 }
 
@@ -78,7 +93,7 @@ func (m *MemcachedCache) Get(k string) ([]byte, error) {
 		done <- true
 	}()
 
-	timeout := time.After(50 * time.Millisecond)
+	timeout := time.After(m.timeout)
 
 	select {
 	case <-timeout:
@@ -104,6 +119,12 @@ func (m *MemcachedCache) Set(k string, v []byte, expire int32) {
 	go m.client.Set(&memcache.Item{Key: m.prefix + hk, Value: v, Expiration: expire})
 }
 
+func (m *MemcachedCache) Delete(k string) {
+	key := sha1.Sum([]byte(k))
+	hk := hex.EncodeToString(key[:])
+	go m.client.Delete(m.prefix + hk)
+}
+
 func (m *MemcachedCache) Timeouts() uint64 {
 	return atomic.LoadUint64(&m.timeouts)
 }
@@ -0,0 +1,131 @@
+// Package memcachetest provides in-memory memcached server, that understands enough of the text protocol for tests
+package memcachetest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake memcached server. It supports get, gets and set commands and ignores expiration
+type Server struct {
+	sync.Mutex
+	listener net.Listener
+	items    map[string][]byte
+
+	gets int
+	sets int
+}
+
+// NewServer starts fake memcached server on a random local port
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: l,
+		items:    make(map[string][]byte),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns address of the server
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Items returns amount of stored items
+func (s *Server) Items() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.items)
+}
+
+// Gets returns amount of get commands received
+func (s *Server) Gets() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.gets
+}
+
+// Sets returns amount of set commands received
+func (s *Server) Sets() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.sets
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "get", "gets":
+			s.Lock()
+			s.gets++
+			for _, k := range fields[1:] {
+				if v, ok := s.items[k]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d 0\r\n", k, len(v))
+					rw.Write(v)
+					rw.WriteString("\r\n")
+				}
+			}
+			s.Unlock()
+			rw.WriteString("END\r\n")
+		case "set":
+			if len(fields) < 5 {
+				rw.WriteString("ERROR\r\n")
+				break
+			}
+			size, err := strconv.Atoi(fields[4])
+			if err != nil {
+				rw.WriteString("CLIENT_ERROR bad data chunk\r\n")
+				break
+			}
+			v := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, v); err != nil {
+				return
+			}
+			s.Lock()
+			s.sets++
+			s.items[fields[1]] = v[:size]
+			s.Unlock()
+			rw.WriteString("STORED\r\n")
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
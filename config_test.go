@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/go-graphite/carbonzipper/admission"
+	"github.com/spf13/viper"
+)
+
+func TestDecodeAdmissionOverrides(t *testing.T) {
+	cfg := []byte(`
+admission:
+    identity: "apikey"
+    requestsPerSecond: 10
+    overrides:
+        - client: "10.0.0.2"
+          requestsPerSecond: 100
+          maxConcurrent: 50
+        - client: "MixedCase.Key"
+          burst: 5
+`)
+	v := viper.New()
+	v.SetConfigType("YAML")
+	if err := v.ReadConfig(bytes.NewBuffer(cfg)); err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+
+	var decoded struct {
+		Admission admission.Config `mapstructure:"admission"`
+	}
+	if err := decodeConfig(v.AllSettings(), &decoded); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+
+	expected := []admission.Override{
+		{Client: "10.0.0.2", Limits: admission.Limits{RequestsPerSecond: 100, MaxConcurrent: 50}},
+		{Client: "MixedCase.Key", Limits: admission.Limits{Burst: 5}},
+	}
+	if !reflect.DeepEqual(decoded.Admission.Overrides, expected) {
+		t.Errorf("got overrides %+v, expected %+v", decoded.Admission.Overrides, expected)
+	}
+	if decoded.Admission.RequestsPerSecond != 10 {
+		t.Errorf("got default rate %v, expected 10", decoded.Admission.RequestsPerSecond)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	protov3grpc "github.com/go-graphite/protocol/carbonapi_v3_grpc"
@@ -125,16 +126,195 @@ func (srv GRPCServer) FindMetrics(ctx context.Context, in *pb.MultiGlobRequest)
 	return response, nil
 }
 
+// mergeInfoResponses flattens per-server info into a single response. If the same metric is returned by several
+// servers, aggregation settings are taken from the first one (in the order of server names), while retentions of all
+// of them are merged: for each precision the longest one is kept, sorted from the most precise.
+func mergeInfoResponses(r *pb.ZipperInfoResponse) *pb.MultiMetricsInfoResponse {
+	res := &pb.MultiMetricsInfoResponse{}
+	if r == nil {
+		return res
+	}
+
+	servers := make([]string, 0, len(r.Info))
+	for server := range r.Info {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	idx := make(map[string]int)
+	for _, server := range servers {
+		for _, m := range r.Info[server].Metrics {
+			i, ok := idx[m.Name]
+			if !ok {
+				idx[m.Name] = len(res.Metrics)
+				m.Retentions = append([]pb.Retention(nil), m.Retentions...)
+				res.Metrics = append(res.Metrics, m)
+				continue
+			}
+			res.Metrics[i].Retentions = mergeRetentions(res.Metrics[i].Retentions, m.Retentions)
+			if m.MaxRetention > res.Metrics[i].MaxRetention {
+				res.Metrics[i].MaxRetention = m.MaxRetention
+			}
+		}
+	}
+
+	for i := range res.Metrics {
+		sort.Slice(res.Metrics[i].Retentions, func(a, b int) bool {
+			return res.Metrics[i].Retentions[a].SecondsPerPoint < res.Metrics[i].Retentions[b].SecondsPerPoint
+		})
+	}
+
+	return res
+}
+
+// mergeRetentions adds retentions to dst. If dst already has a retention with the same precision, the longer one is kept
+func mergeRetentions(dst, retentions []pb.Retention) []pb.Retention {
+	for _, r := range retentions {
+		found := false
+		for i := range dst {
+			if dst[i].SecondsPerPoint == r.SecondsPerPoint {
+				if r.NumberOfPoints > dst[i].NumberOfPoints {
+					dst[i].NumberOfPoints = r.NumberOfPoints
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, r)
+		}
+	}
+	return dst
+}
+
 func (srv GRPCServer) MetricsInfo(ctx context.Context, in *pb.MultiMetricsInfoRequest) (*pb.MultiMetricsInfoResponse, error) {
-	return nil, errNotImplementedYet
+	t0 := time.Now()
+	logger := zapwriter.Logger("grpc_info").With(
+		zap.String("handler", "info"),
+	)
+	logger.Debug("got info request",
+		zap.String("request", "grpc"),
+	)
+
+	Metrics.InfoRequests.Add(1)
+
+	grpcLogger := zapwriter.Logger("grpc_access").With(
+		zap.String("handler", "info"),
+		zap.String("format", "grpc"),
+	)
+
+	if len(in.Names) == 0 {
+		grpcLogger.Error("info error",
+			zap.String("reason", errEmptyRequest.Error()),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+		)
+		return nil, errEmptyRequest
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Timeouts.Find)
+	defer cancel()
+
+	response, stats, err := config.zipper.InfoProtoV3(ctx, &pb.MultiGlobRequest{Metrics: in.Names})
+	sendStats(stats)
+	if err != nil {
+		Metrics.InfoErrors.Add(1)
+		grpcLogger.Error("info error",
+			zap.Strings("query", in.Names),
+			zap.String("reason", err.Error()),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+		)
+		return nil, err
+	}
+
+	result := mergeInfoResponses(response)
+	if len(result.Metrics) == 0 {
+		return nil, errNoDataInResponse
+	}
+	grpcLogger.Info("request served",
+		zap.Duration("runtime_seconds", time.Since(t0)),
+	)
+
+	return result, nil
 }
 
 func (srv GRPCServer) ListMetrics(ctx context.Context, in *gpb.Empty) (*pb.ListMetricsResponse, error) {
-	return nil, errNotImplementedYet
+	t0 := time.Now()
+	logger := zapwriter.Logger("grpc_list").With(
+		zap.String("handler", "list"),
+	)
+	logger.Debug("got list request",
+		zap.String("request", "grpc"),
+	)
+
+	Metrics.ListRequests.Add(1)
+
+	grpcLogger := zapwriter.Logger("grpc_access").With(
+		zap.String("handler", "list"),
+		zap.String("format", "grpc"),
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, config.Timeouts.Render)
+	defer cancel()
+
+	response, stats, err := config.zipper.ListProtoV3(ctx)
+	sendStats(stats)
+	if err != nil {
+		Metrics.ListErrors.Add(1)
+		grpcLogger.Error("list error",
+			zap.String("reason", err.Error()),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+		)
+		return nil, err
+	}
+
+	if len(response.GetMetrics()) == 0 {
+		return nil, errNoDataInResponse
+	}
+	grpcLogger.Info("request served",
+		zap.Duration("runtime_seconds", time.Since(t0)),
+	)
+
+	return response, nil
 }
 
 func (srv GRPCServer) Stats(ctx context.Context, in *gpb.Empty) (*pb.MetricDetailsResponse, error) {
-	return nil, errNotImplementedYet
+	t0 := time.Now()
+	logger := zapwriter.Logger("grpc_stats").With(
+		zap.String("handler", "stats"),
+	)
+	logger.Debug("got stats request",
+		zap.String("request", "grpc"),
+	)
+
+	Metrics.StatsRequests.Add(1)
+
+	grpcLogger := zapwriter.Logger("grpc_access").With(
+		zap.String("handler", "stats"),
+		zap.String("format", "grpc"),
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, config.Timeouts.Render)
+	defer cancel()
+
+	response, stats, err := config.zipper.StatsProtoV3(ctx)
+	sendStats(stats)
+	if err != nil {
+		Metrics.StatsErrors.Add(1)
+		grpcLogger.Error("stats error",
+			zap.String("reason", err.Error()),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+		)
+		return nil, err
+	}
+
+	if len(response.GetMetrics()) == 0 {
+		return nil, errNoDataInResponse
+	}
+	grpcLogger.Info("request served",
+		zap.Duration("runtime_seconds", time.Since(t0)),
+	)
+
+	return response, nil
 }
 
 func NewGRPCServer(address string) (*GRPCServer, error) {
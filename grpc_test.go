@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+func TestMergeInfoResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     *pb.ZipperInfoResponse
+		expected []pb.MetricsInfoResponse
+	}{
+		{
+			name:     "nil",
+			expected: nil,
+		},
+		{
+			name: "different metrics",
+			info: &pb.ZipperInfoResponse{Info: map[string]pb.MultiMetricsInfoResponse{
+				"server2": {Metrics: []pb.MetricsInfoResponse{
+					{Name: "foo.baz", MaxRetention: 86400, Retentions: []pb.Retention{{SecondsPerPoint: 60, NumberOfPoints: 1440}}},
+				}},
+				"server1": {Metrics: []pb.MetricsInfoResponse{
+					{Name: "foo.bar", MaxRetention: 86400, Retentions: []pb.Retention{{SecondsPerPoint: 60, NumberOfPoints: 1440}}},
+				}},
+			}},
+			expected: []pb.MetricsInfoResponse{
+				{Name: "foo.bar", MaxRetention: 86400, Retentions: []pb.Retention{{SecondsPerPoint: 60, NumberOfPoints: 1440}}},
+				{Name: "foo.baz", MaxRetention: 86400, Retentions: []pb.Retention{{SecondsPerPoint: 60, NumberOfPoints: 1440}}},
+			},
+		},
+		{
+			name: "same metric with different retentions",
+			info: &pb.ZipperInfoResponse{Info: map[string]pb.MultiMetricsInfoResponse{
+				"server2": {Metrics: []pb.MetricsInfoResponse{
+					{Name: "foo.bar", ConsolidationFunc: "max", MaxRetention: 31536000, Retentions: []pb.Retention{
+						{SecondsPerPoint: 60, NumberOfPoints: 10080},
+						{SecondsPerPoint: 3600, NumberOfPoints: 8760},
+					}},
+				}},
+				"server1": {Metrics: []pb.MetricsInfoResponse{
+					{Name: "foo.bar", ConsolidationFunc: "average", MaxRetention: 86400, Retentions: []pb.Retention{
+						{SecondsPerPoint: 60, NumberOfPoints: 1440},
+						{SecondsPerPoint: 10, NumberOfPoints: 360},
+					}},
+				}},
+			}},
+			expected: []pb.MetricsInfoResponse{
+				{Name: "foo.bar", ConsolidationFunc: "average", MaxRetention: 31536000, Retentions: []pb.Retention{
+					{SecondsPerPoint: 10, NumberOfPoints: 360},
+					{SecondsPerPoint: 60, NumberOfPoints: 10080},
+					{SecondsPerPoint: 3600, NumberOfPoints: 8760},
+				}},
+			},
+		},
+		{
+			name: "same metric with same retentions",
+			info: &pb.ZipperInfoResponse{Info: map[string]pb.MultiMetricsInfoResponse{
+				"server1": {Metrics: []pb.MetricsInfoResponse{
+					{Name: "foo.bar", MaxRetention: 86400, Retentions: []pb.Retention{{SecondsPerPoint: 60, NumberOfPoints: 1440}}},
+				}},
+				"server2": {Metrics: []pb.MetricsInfoResponse{
+					{Name: "foo.bar", MaxRetention: 86400, Retentions: []pb.Retention{{SecondsPerPoint: 60, NumberOfPoints: 1440}}},
+				}},
+			}},
+			expected: []pb.MetricsInfoResponse{
+				{Name: "foo.bar", MaxRetention: 86400, Retentions: []pb.Retention{{SecondsPerPoint: 60, NumberOfPoints: 1440}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// result must not depend on the order of servers in the map
+			for i := 0; i < 10; i++ {
+				res := mergeInfoResponses(tt.info)
+				if !reflect.DeepEqual(res.Metrics, tt.expected) {
+					t.Fatalf("got %+v, expected %+v", res.Metrics, tt.expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package limiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper/types"
+)
+
+const (
+	defaultInitialLimit = 20
+	defaultMinLimit     = 1
+	defaultMaxLimit     = 1000
+	defaultBackoffRatio = 0.9
+	defaultRTTWindow    = time.Minute
+
+	// how fast gradient limiter moves towards the new estimate
+	gradientSmoothing = 0.2
+)
+
+// algorithm calculates new limit after the request is done
+type algorithm interface {
+	update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64
+}
+
+// aimd increases limit by one while requests are fast and multiplies it by backoff ratio on timeouts and slow requests
+type aimd struct {
+	latencyThreshold time.Duration
+	backoffRatio     float64
+}
+
+func newAIMD(config types.ConcurrencyLimiter) *aimd {
+	a := &aimd{
+		latencyThreshold: config.LatencyThreshold,
+		backoffRatio:     config.BackoffRatio,
+	}
+	if a.backoffRatio <= 0 || a.backoffRatio >= 1 {
+		a.backoffRatio = defaultBackoffRatio
+	}
+	return a
+}
+
+func (a *aimd) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	if dropped || (a.latencyThreshold > 0 && rtt > a.latencyThreshold) {
+		return limit * a.backoffRatio
+	}
+	// Don't grow the limit if it's not used anyway
+	if float64(inFlight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// gradient compares latency with the lowest one seen during the window. Growing latency means that server starts to queue requests,
+// so the limit is decreased proportionally
+type gradient struct {
+	window time.Duration
+
+	minRTT      time.Duration
+	windowStart time.Time
+}
+
+func newGradient(config types.ConcurrencyLimiter) *gradient {
+	g := &gradient{
+		window: config.Window,
+	}
+	if g.window <= 0 {
+		g.window = defaultRTTWindow
+	}
+	return g
+}
+
+func (g *gradient) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	now := time.Now()
+	if now.Sub(g.windowStart) > g.window {
+		g.minRTT = 0
+		g.windowStart = now
+	}
+	if !dropped && rtt > 0 && (g.minRTT == 0 || rtt < g.minRTT) {
+		g.minRTT = rtt
+	}
+
+	grad := 0.5
+	if !dropped && rtt > 0 {
+		grad = math.Max(0.5, math.Min(1, float64(g.minRTT)/float64(rtt)))
+	}
+	newLimit := limit*grad + math.Sqrt(limit)
+	if newLimit > limit && float64(inFlight)*2 < limit {
+		return limit
+	}
+	return limit*(1-gradientSmoothing) + newLimit*gradientSmoothing
+}
+
+func newAlgorithm(config types.ConcurrencyLimiter) algorithm {
+	if config.Type == "gradient" {
+		return newGradient(config)
+	}
+	return newAIMD(config)
+}
+
+// State of the limiter for one server
+type State struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"inFlight"`
+	Queued   int `json:"queued"`
+}
+
+var limiters = struct {
+	sync.RWMutex
+	m map[string]*serverLimiter
+}{
+	m: make(map[string]*serverLimiter),
+}
+
+// States returns current state of all adaptive limiters, suitable for expvar.Func
+func States() interface{} {
+	limiters.RLock()
+	defer limiters.RUnlock()
+
+	res := make(map[string]State, len(limiters.m))
+	for s, l := range limiters.m {
+		res[s] = l.state()
+	}
+	return res
+}
+
+// AdaptiveLimiter changes amount of allowed concurrent requests per server based on their latency and timeouts
+type AdaptiveLimiter struct {
+	m map[string]*serverLimiter
+}
+
+// NewAdaptiveLimiter creates a limiter for specific servers list. Limit l is used as initial one, if config doesn't specify it.
+// Config's type selects the algorithm: "aimd" (default) or "gradient"
+func NewAdaptiveLimiter(servers []string, l int, config types.ConcurrencyLimiter) ServerLimiter {
+	initial := config.InitialLimit
+	if initial <= 0 {
+		initial = l
+	}
+	if initial <= 0 {
+		initial = defaultInitialLimit
+	}
+	min := config.MinLimit
+	if min <= 0 {
+		min = defaultMinLimit
+	}
+	max := config.MaxLimit
+	if max <= 0 {
+		max = defaultMaxLimit
+	}
+	if max < initial {
+		max = initial
+	}
+
+	al := &AdaptiveLimiter{
+		m: make(map[string]*serverLimiter, len(servers)),
+	}
+
+	for _, s := range servers {
+		sl := newServerLimiter(initial, config.MaxQueueWait)
+		sl.algorithm = newAlgorithm(config)
+		sl.min = float64(min)
+		sl.max = float64(max)
+		al.m[s] = sl
+	}
+
+	return al
+}
+
+// Register makes state of the limiter's servers visible in States, replacing the old limiters of the same servers
+func (al *AdaptiveLimiter) Register() {
+	limiters.Lock()
+	defer limiters.Unlock()
+	for s, sl := range al.m {
+		limiters.m[s] = sl
+	}
+}
+
+// Unregister removes state of the server from States. Should be called when server is removed
+func Unregister(server string) {
+	limiters.Lock()
+	delete(limiters.m, server)
+	limiters.Unlock()
+}
+
+// Capacity returns the highest current limit among the servers
+func (al *AdaptiveLimiter) Capacity() int {
+	res := 0
+	for _, l := range al.m {
+		if c := l.state().Limit; c > res {
+			res = c
+		}
+	}
+	return res
+}
+
+// Enter claims one of free slots or blocks until there is one.
+func (al *AdaptiveLimiter) Enter(ctx context.Context, s string) error {
+	l, ok := al.m[s]
+	if !ok {
+		return nil
+	}
+	return l.enter(ctx)
+}
+
+// Leave frees a slot in limiter and adjusts the limit based on request's latency
+func (al *AdaptiveLimiter) Leave(ctx context.Context, s string) {
+	l, ok := al.m[s]
+	if !ok {
+		return
+	}
+	l.leave(ctx)
+}
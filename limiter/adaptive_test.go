@@ -0,0 +1,105 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper/types"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	l := NewAdaptiveLimiter([]string{"TestAIMDLimiter"}, 2, types.ConcurrencyLimiter{
+		Type:             "aimd",
+		LatencyThreshold: 20 * time.Millisecond,
+		MaxLimit:         4,
+	})
+	l.(*AdaptiveLimiter).Register()
+	ctx := context.Background()
+
+	if l.Capacity() != 2 {
+		t.Fatalf("expected initial limit 2, got %v", l.Capacity())
+	}
+
+	// Fully used limit grows with fast requests
+	enter := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := l.Enter(ctx, "TestAIMDLimiter"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	enter(2)
+	l.Leave(ctx, "TestAIMDLimiter")
+	if l.Capacity() != 3 {
+		t.Fatalf("expected limit to grow to 3, got %v", l.Capacity())
+	}
+	enter(2)
+	l.Leave(ctx, "TestAIMDLimiter")
+	if l.Capacity() != 4 {
+		t.Fatalf("expected limit to grow to 4, got %v", l.Capacity())
+	}
+	enter(2)
+
+	// Limit is reached, so request is queued until timeout
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		st := States().(map[string]State)["TestAIMDLimiter"]
+		if st.Queued != 1 || st.InFlight != 4 {
+			t.Errorf("expected 4 in-flight and 1 queued request, got %+v", st)
+		}
+	}()
+	if err := l.Enter(timeoutCtx, "TestAIMDLimiter"); err == nil {
+		t.Fatalf("expected timeout waiting for a slot")
+	}
+
+	// Slow request decreases the limit
+	time.Sleep(25 * time.Millisecond)
+	l.Leave(ctx, "TestAIMDLimiter")
+	if l.Capacity() != 3 {
+		t.Fatalf("expected limit to decrease to 3, got %v", l.Capacity())
+	}
+	for i := 0; i < 3; i++ {
+		l.Leave(ctx, "TestAIMDLimiter")
+	}
+
+	st := States().(map[string]State)["TestAIMDLimiter"]
+	if st.Queued != 0 || st.InFlight != 0 {
+		t.Errorf("expected no requests, got %+v", st)
+	}
+}
+
+func TestAdaptiveLimiterGrantsQueuedRequests(t *testing.T) {
+	l := NewAdaptiveLimiter([]string{"TestAdaptiveLimiterGrantsQueuedRequests"}, 1, types.ConcurrencyLimiter{
+		Type:     "gradient",
+		MaxLimit: 1,
+	})
+	ctx := context.Background()
+
+	if err := l.Enter(ctx, "TestAdaptiveLimiterGrantsQueuedRequests"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- l.Enter(ctx, "TestAdaptiveLimiterGrantsQueuedRequests")
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("request shouldn't get a slot while limit is reached")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.Leave(ctx, "TestAdaptiveLimiterGrantsQueuedRequests")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("queued request didn't get a slot")
+	}
+	l.Leave(ctx, "TestAdaptiveLimiterGrantsQueuedRequests")
+}
@@ -3,55 +3,84 @@ package limiter
 import (
 	"context"
 	"errors"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper/types"
 )
 
 // ServerLimiter provides interface to limit amount of requests
-type ServerLimiter struct {
-	m   map[string]chan struct{}
+type ServerLimiter interface {
+	// Capacity returns current limit of concurrent requests per server, 0 means unlimited
+	Capacity() int
+	// Enter claims one of free slots or blocks until there is one. Priority of the request is taken from ctx, see WithPriority
+	Enter(ctx context.Context, s string) error
+	// Leave frees a slot in limiter, ctx must be the same that was passed to Enter
+	Leave(ctx context.Context, s string)
+}
+
+// New creates a limiter for specific servers list, using the algorithm from config. Nil config means fixed limiter
+func New(servers []string, l int, config *types.ConcurrencyLimiter) (ServerLimiter, error) {
+	if config == nil {
+		return NewServerLimiter(servers, l), nil
+	}
+
+	switch config.Type {
+	case "", "fixed":
+		return newFixedLimiter(servers, l, config.MaxQueueWait), nil
+	case "aimd", "gradient":
+		return NewAdaptiveLimiter(servers, l, *config), nil
+	}
+	return nil, errors.New("unknown concurrency limiter type '" + config.Type + "', supported: fixed, aimd, gradient")
+}
+
+// FixedLimiter allows up to a fixed amount of concurrent requests per server
+type FixedLimiter struct {
+	m   map[string]*serverLimiter
 	cap int
 }
 
-// NewServerLimiter creates a limiter for specific servers list.
-func NewServerLimiter(servers []string, l int) *ServerLimiter {
+// NewServerLimiter creates a fixed limiter for specific servers list.
+func NewServerLimiter(servers []string, l int) ServerLimiter {
+	return newFixedLimiter(servers, l, 0)
+}
+
+func newFixedLimiter(servers []string, l int, maxQueueWait time.Duration) ServerLimiter {
 	if l == 0 {
-		return &ServerLimiter{}
+		return &FixedLimiter{}
 	}
 
-	sl := make(map[string]chan struct{})
+	sl := make(map[string]*serverLimiter)
 
 	for _, s := range servers {
-		sl[s] = make(chan struct{}, l)
+		sl[s] = newServerLimiter(l, maxQueueWait)
 	}
 
-	return &ServerLimiter{
+	return &FixedLimiter{
 		m:   sl,
 		cap: l,
 	}
 }
 
-func (sl ServerLimiter) Capacity() int {
+func (sl FixedLimiter) Capacity() int {
 	return sl.cap
 }
 
-// Enter claims one of free slots or blocks until there is one.
-func (sl ServerLimiter) Enter(ctx context.Context, s string) error {
-	if sl.m == nil {
+// Enter claims one of free slots or blocks until there is one. Requests with higher priority get free slots first
+func (sl FixedLimiter) Enter(ctx context.Context, s string) error {
+	l, ok := sl.m[s]
+	if !ok {
 		return nil
 	}
 
-	select {
-	case sl.m[s] <- struct{}{}:
-		return nil
-	case <-ctx.Done():
-		return errors.New("timeout exceeded")
-	}
+	return l.enter(ctx)
 }
 
 // Frees a slot in limiter
-func (sl ServerLimiter) Leave(ctx context.Context, s string) {
-	if sl.m == nil {
+func (sl FixedLimiter) Leave(ctx context.Context, s string) {
+	l, ok := sl.m[s]
+	if !ok {
 		return
 	}
 
-	<-sl.m[s]
+	l.leave(ctx)
 }
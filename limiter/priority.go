@@ -0,0 +1,88 @@
+package limiter
+
+import (
+	"context"
+	"expvar"
+
+	cu "github.com/go-graphite/carbonzipper/util/apictx"
+)
+
+// Priority is a class of the request. Requests with higher priority get free slots more often, when they have to wait for them
+type Priority int
+
+const (
+	// ProbePriority is used for internal TLD probes
+	ProbePriority Priority = iota
+	// FindPriority is used for find requests
+	FindPriority
+	// InfoPriority is used for info, list and details requests
+	InfoPriority
+	// RenderPriority is used for render requests and for requests without priority
+	RenderPriority
+	// BatchPriority is used for all requests, except probes, from the callers that marked themselves as batch ones
+	BatchPriority
+
+	numPriorities = int(BatchPriority) + 1
+)
+
+// share of free slots, that each class gets when all classes have queued requests
+var priorityWeights = [numPriorities]int{16, 8, 4, 2, 1}
+
+func (p Priority) String() string {
+	switch p {
+	case ProbePriority:
+		return "probe"
+	case FindPriority:
+		return "find"
+	case InfoPriority:
+		return "info"
+	case BatchPriority:
+		return "batch"
+	}
+	return "render"
+}
+
+// Priorities returns all priority classes, from the highest to the lowest one
+func Priorities() []Priority {
+	res := make([]Priority, 0, numPriorities)
+	for p := 0; p < numPriorities; p++ {
+		res = append(res, Priority(p))
+	}
+	return res
+}
+
+// Queue depth of every priority class for all limiters and amount of requests that waited in queue for too long.
+// They should be published by the caller
+var (
+	QueueDepth    [numPriorities]expvar.Int
+	QueueTimeouts expvar.Int
+)
+
+type key int
+
+const priorityKey key = 0
+
+// WithPriority returns context, whose requests will be queued with specified priority
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey, p)
+}
+
+// WithDefaultPriority returns context with specified priority, unless ctx already has one
+func WithDefaultPriority(ctx context.Context, p Priority) context.Context {
+	if _, ok := ctx.Value(priorityKey).(Priority); ok {
+		return ctx
+	}
+	return WithPriority(ctx, p)
+}
+
+// PriorityFromContext returns priority of the request. Requests of batch callers are demoted to BatchPriority
+func PriorityFromContext(ctx context.Context) Priority {
+	p, ok := ctx.Value(priorityKey).(Priority)
+	if !ok {
+		p = RenderPriority
+	}
+	if p != ProbePriority && cu.GetPriority(ctx) == cu.PriorityBatch {
+		return BatchPriority
+	}
+	return p
+}
@@ -0,0 +1,173 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned when request's context is done while it waits for a slot
+	ErrTimeout = errors.New("timeout exceeded")
+	// ErrQueueTimeout is returned when request waited for a slot longer than allowed by limiter's maxQueueWait
+	ErrQueueTimeout = errors.New("limiter queue wait exceeded")
+)
+
+// serverLimiter limits concurrent requests to one server. Requests that wait for a slot are queued per priority class,
+// free slots are given to the classes using smooth weighted round-robin
+type serverLimiter struct {
+	sync.Mutex
+	// algorithm adjusts the limit after every request, nil means fixed limit
+	algorithm    algorithm
+	min          float64
+	max          float64
+	maxQueueWait time.Duration
+
+	limit    float64
+	inFlight int
+	queued   int
+	waiters  [numPriorities][]chan struct{}
+	current  [numPriorities]int
+	// start times of the requests, so latency can be calculated in Leave
+	started map[context.Context][]time.Time
+}
+
+func newServerLimiter(limit int, maxQueueWait time.Duration) *serverLimiter {
+	return &serverLimiter{
+		min:          float64(limit),
+		max:          float64(limit),
+		maxQueueWait: maxQueueWait,
+		limit:        float64(limit),
+		started:      make(map[context.Context][]time.Time),
+	}
+}
+
+func (l *serverLimiter) state() State {
+	l.Lock()
+	defer l.Unlock()
+
+	return State{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		Queued:   l.queued,
+	}
+}
+
+// next returns priority class, that should get a free slot. Should be called with lock held and with non-empty queue
+func (l *serverLimiter) next() Priority {
+	total := 0
+	best := -1
+	for p := range l.waiters {
+		if len(l.waiters[p]) == 0 {
+			continue
+		}
+		l.current[p] += priorityWeights[p]
+		total += priorityWeights[p]
+		if best < 0 || l.current[p] > l.current[best] {
+			best = p
+		}
+	}
+	l.current[best] -= total
+	return Priority(best)
+}
+
+// grant passes free slots to the waiters, should be called with lock held
+func (l *serverLimiter) grant() {
+	for l.queued > 0 && l.inFlight < int(l.limit) {
+		p := l.next()
+		l.inFlight++
+		close(l.waiters[p][0])
+		l.waiters[p] = l.waiters[p][1:]
+		l.queued--
+		QueueDepth[p].Add(-1)
+	}
+}
+
+// remove deletes the waiter from the queue, returns false if it was already granted a slot. Should be called with lock held
+func (l *serverLimiter) remove(p Priority, ch chan struct{}) bool {
+	for i, w := range l.waiters[p] {
+		if w == ch {
+			l.waiters[p] = append(l.waiters[p][:i], l.waiters[p][i+1:]...)
+			l.queued--
+			QueueDepth[p].Add(-1)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *serverLimiter) start(ctx context.Context) {
+	if l.algorithm == nil {
+		return
+	}
+	l.started[ctx] = append(l.started[ctx], time.Now())
+}
+
+func (l *serverLimiter) enter(ctx context.Context) error {
+	l.Lock()
+	if l.queued == 0 && l.inFlight < int(l.limit) {
+		l.inFlight++
+		l.start(ctx)
+		l.Unlock()
+		return nil
+	}
+	p := PriorityFromContext(ctx)
+	ch := make(chan struct{})
+	l.waiters[p] = append(l.waiters[p], ch)
+	l.queued++
+	QueueDepth[p].Add(1)
+	l.Unlock()
+
+	var queueTimeout <-chan time.Time
+	if l.maxQueueWait > 0 {
+		t := time.NewTimer(l.maxQueueWait)
+		defer t.Stop()
+		queueTimeout = t.C
+	}
+
+	err := ErrTimeout
+	select {
+	case <-ch:
+		l.Lock()
+		l.start(ctx)
+		l.Unlock()
+		return nil
+	case <-ctx.Done():
+	case <-queueTimeout:
+		QueueTimeouts.Add(1)
+		err = ErrQueueTimeout
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if !l.remove(p, ch) {
+		// Slot was granted while we were giving up, pass it to the next one
+		l.inFlight--
+		l.grant()
+	}
+	return err
+}
+
+func (l *serverLimiter) leave(ctx context.Context) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.algorithm != nil {
+		var rtt time.Duration
+		if started := l.started[ctx]; len(started) > 0 {
+			rtt = time.Since(started[len(started)-1])
+			if len(started) == 1 {
+				delete(l.started, ctx)
+			} else {
+				l.started[ctx] = started[:len(started)-1]
+			}
+		}
+
+		dropped := ctx.Err() == context.DeadlineExceeded
+		l.limit = math.Max(l.min, math.Min(l.max, l.algorithm.update(l.limit, rtt, l.inFlight, dropped)))
+	}
+	l.inFlight--
+	l.grant()
+}
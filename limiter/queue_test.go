@@ -0,0 +1,85 @@
+package limiter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	cu "github.com/go-graphite/carbonzipper/util/apictx"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	l := NewServerLimiter([]string{"server"}, 1)
+	sl := l.(*FixedLimiter).m["server"]
+	ctx := context.Background()
+
+	if err := l.Enter(ctx, "server"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	order := make(chan string, 3)
+	for i, p := range []Priority{RenderPriority, FindPriority, ProbePriority} {
+		p := p
+		go func() {
+			pCtx := WithPriority(ctx, p)
+			if err := l.Enter(pCtx, "server"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			order <- p.String()
+			l.Leave(pCtx, "server")
+		}()
+		// keep the order of arrival
+		for sl.state().Queued != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	l.Leave(ctx, "server")
+	res := []string{<-order, <-order, <-order}
+	expected := []string{"probe", "find", "render"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("got %v, expected %v", res, expected)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	l := newFixedLimiter([]string{"server"}, 1, 10*time.Millisecond)
+	ctx := context.Background()
+
+	if err := l.Enter(ctx, "server"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	timeouts := QueueTimeouts.Value()
+	if err := l.Enter(ctx, "server"); err != ErrQueueTimeout {
+		t.Fatalf("got %v, expected %v", err, ErrQueueTimeout)
+	}
+	if QueueTimeouts.Value() != timeouts+1 {
+		t.Errorf("queue timeout wasn't counted")
+	}
+	if d := QueueDepth[RenderPriority].Value(); d != 0 {
+		t.Errorf("expected empty queue, got %v", d)
+	}
+	l.Leave(ctx, "server")
+}
+
+func TestPriorityFromContext(t *testing.T) {
+	ctx := context.Background()
+	if p := PriorityFromContext(ctx); p != RenderPriority {
+		t.Errorf("got %v, expected %v", p, RenderPriority)
+	}
+
+	ctx = WithDefaultPriority(WithPriority(ctx, InfoPriority), FindPriority)
+	if p := PriorityFromContext(ctx); p != InfoPriority {
+		t.Errorf("got %v, expected %v", p, InfoPriority)
+	}
+
+	ctx = cu.SetPriority(ctx, cu.PriorityBatch)
+	if p := PriorityFromContext(ctx); p != BatchPriority {
+		t.Errorf("got %v, expected %v", p, BatchPriority)
+	}
+	if p := PriorityFromContext(WithPriority(ctx, ProbePriority)); p != ProbePriority {
+		t.Errorf("got %v, expected %v", p, ProbePriority)
+	}
+}
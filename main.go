@@ -6,32 +6,41 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dgryski/httputil"
 	"github.com/facebookgo/grace/gracehttp"
 	"github.com/facebookgo/pidfile"
+	"github.com/go-graphite/carbonzipper/admission"
 	"github.com/go-graphite/carbonzipper/intervalset"
+	"github.com/go-graphite/carbonzipper/limiter"
 	"github.com/go-graphite/carbonzipper/mstats"
-	"github.com/spf13/viper"
-	// "github.com/go-graphite/carbonzipper/pathcache"
+	"github.com/go-graphite/carbonzipper/pathcache"
 	cu "github.com/go-graphite/carbonzipper/util/apictx"
 	util "github.com/go-graphite/carbonzipper/util/zipperctx"
 	"github.com/go-graphite/carbonzipper/zipper"
+	"github.com/go-graphite/carbonzipper/zipper/breaker"
+	queryCache "github.com/go-graphite/carbonzipper/zipper/cache"
 	zipperConfig "github.com/go-graphite/carbonzipper/zipper/config"
+	"github.com/go-graphite/carbonzipper/zipper/helper"
 	"github.com/go-graphite/carbonzipper/zipper/types"
 	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	"github.com/lomik/zapwriter"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
 
 	pickle "github.com/lomik/og-rek"
 	"github.com/peterbourgon/g2g"
@@ -59,13 +68,14 @@ type GraphiteConfig struct {
 
 // config contains necessary information for global
 var config = struct {
-	Backends   []string         `mapstructure:"backends"`
-	Backendsv2 types.BackendsV2 `mapstructure:"backendsv2"`
-	MaxProcs   int              `mapstructure:"maxProcs"`
-	Graphite   GraphiteConfig   `mapstructure:"graphite"`
-	GRPCListen string           `mapstructure:"grpcListen"`
-	Listen     string           `mapstructure:"listen"`
-	Buckets    int              `mapstructure:"buckets"`
+	Backends    []string         `mapstructure:"backends"`
+	Backendsv2  types.BackendsV2 `mapstructure:"backendsv2"`
+	MaxProcs    int              `mapstructure:"maxProcs"`
+	Graphite    GraphiteConfig   `mapstructure:"graphite"`
+	GRPCListen  string           `mapstructure:"grpcListen"`
+	Listen      string           `mapstructure:"listen"`
+	AdminListen string           `mapstructure:"adminListen"`
+	Buckets     int              `mapstructure:"buckets"`
 
 	Timeouts          types.Timeouts `mapstructure:"timeouts"`
 	KeepAliveInterval time.Duration  `mapstructure:"keepAliveInterval"`
@@ -81,6 +91,13 @@ var config = struct {
 	Logger                     []zapwriter.Config `mapstructure:"logger"`
 	GraphiteWeb09Compatibility bool               `mapstructure:"graphite09compat"`
 
+	Admission  admission.Config `mapstructure:"admission"`
+	Guardrails types.Guardrails `mapstructure:"guardrails"`
+	Routing    pathcache.Config `mapstructure:"routing"`
+
+	SharedCache types.SharedCache `mapstructure:"sharedCache"`
+	FetchChunks types.FetchChunks `mapstructure:"fetchChunks"`
+
 	zipper *zipper.Zipper
 }{
 	MaxProcs: 1,
@@ -120,8 +137,38 @@ var Metrics = struct {
 	InfoRequests *expvar.Int
 	InfoErrors   *expvar.Int
 
+	ListRequests *expvar.Int
+	ListErrors   *expvar.Int
+
+	StatsRequests *expvar.Int
+	StatsErrors   *expvar.Int
+
 	Timeouts *expvar.Int
 
+	HedgedRequests *expvar.Int
+	HedgeWins      *expvar.Int
+
+	StaleResponses *expvar.Int
+
+	CircuitBreakerOpened     *expvar.Int
+	CircuitBreakerHalfOpened *expvar.Int
+	CircuitBreakerClosed     *expvar.Int
+
+	LimiterQueueTimeouts *expvar.Int
+
+	AdmissionAccepted *expvar.Int
+	AdmissionRejected *expvar.Int
+
+	RoutingSnapshotAge     expvar.Func
+	RoutingSnapshotEntries *expvar.Int
+
+	SharedCacheHits     *expvar.Int
+	SharedCacheMisses   *expvar.Int
+	SharedCacheTimeouts *expvar.Int
+
+	ChunkCacheHits   *expvar.Int
+	ChunkCacheMisses *expvar.Int
+
 	CacheSize         expvar.Func
 	CacheItems        expvar.Func
 	CacheMisses       *expvar.Int
@@ -142,8 +189,42 @@ var Metrics = struct {
 	InfoRequests: expvar.NewInt("info_requests"),
 	InfoErrors:   expvar.NewInt("info_errors"),
 
+	ListRequests: expvar.NewInt("list_requests"),
+	ListErrors:   expvar.NewInt("list_errors"),
+
+	StatsRequests: expvar.NewInt("stats_requests"),
+	StatsErrors:   expvar.NewInt("stats_errors"),
+
 	Timeouts: expvar.NewInt("timeouts"),
 
+	HedgedRequests: expvar.NewInt("hedged_requests"),
+	HedgeWins:      expvar.NewInt("hedge_wins"),
+
+	StaleResponses: expvar.NewInt("stale_responses"),
+
+	// Published in main(), as they are updated by the breaker package
+	CircuitBreakerOpened:     &breaker.Opened,
+	CircuitBreakerHalfOpened: &breaker.HalfOpened,
+	CircuitBreakerClosed:     &breaker.Reclosed,
+
+	// Published in main(), as it's updated by the limiter package
+	LimiterQueueTimeouts: &limiter.QueueTimeouts,
+
+	// Published in main(), as they are updated by the admission package
+	AdmissionAccepted: &admission.Accepted,
+	AdmissionRejected: &admission.Rejected,
+
+	// Published in main(), as they are updated by the pathcache package
+	RoutingSnapshotAge:     expvar.Func(pathcache.SnapshotAge),
+	RoutingSnapshotEntries: &pathcache.SnapshotEntries,
+
+	// Published in main(), as they are updated by the zipper's cache package
+	SharedCacheHits:     &queryCache.SharedHits,
+	SharedCacheMisses:   &queryCache.SharedMisses,
+	SharedCacheTimeouts: &queryCache.SharedTimeouts,
+	ChunkCacheHits:      &queryCache.ChunkHits,
+	ChunkCacheMisses:    &queryCache.ChunkMisses,
+
 	CacheHits:         expvar.NewInt("cache_hits"),
 	CacheMisses:       expvar.NewInt("cache_misses"),
 	SearchCacheHits:   expvar.NewInt("search_cache_hits"),
@@ -163,6 +244,9 @@ const (
 	contentTypeCarbonAPIv3PB = "application/x-carbonapi-v3-pb"
 )
 
+// staleHeader is set for responses, that were served from cache after they expired
+const staleHeader = "X-Carbonzipper-Stale"
+
 func findHandler(w http.ResponseWriter, req *http.Request) {
 	t0 := time.Now()
 	uuid := uuid.NewV4()
@@ -179,6 +263,9 @@ func findHandler(w http.ResponseWriter, req *http.Request) {
 
 	originalQuery := req.FormValue("query")
 	format := req.FormValue("format")
+	if noNegativeCache, _ := strconv.ParseBool(req.FormValue("noNegativeCache")); noNegativeCache {
+		ctx = types.WithoutNegativeCache(ctx)
+	}
 
 	Metrics.FindRequests.Add(1)
 
@@ -190,20 +277,77 @@ func findHandler(w http.ResponseWriter, req *http.Request) {
 		zap.String("carbonapi_uuid", cu.GetUUID(ctx)),
 	)
 
-	metrics, stats, err := config.zipper.FindProtoV2(ctx, []string{originalQuery})
-	sendStats(stats)
-	if err != nil {
-		accessLogger.Error("find failed",
-			zap.Int("http_code", http.StatusInternalServerError),
-			zap.String("reason", err.Error()),
-			zap.Duration("runtime_seconds", time.Since(t0)),
+	var err error
+	if format == "v3" || format == "carbonapi_v3_pb" {
+		var request *protov3.MultiGlobRequest
+		request, err = decodeFindRequestV3(req, originalQuery)
+		if err != nil {
+			accessLogger.Error("find failed",
+				zap.Int("http_code", http.StatusBadRequest),
+				zap.String("reason", "failed to parse request body"),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+				zap.Error(err),
+			)
+			http.Error(w, "failed to parse request body", http.StatusBadRequest)
+			return
+		}
+		accessLogger = accessLogger.With(
+			zap.Strings("targets", request.Metrics),
 		)
-		http.Error(w, "error fetching the data", http.StatusInternalServerError)
-		return
-	}
 
-	// There should be exactly one match at this moment
-	err = EncodeFindResponse(format, originalQuery, w, metrics[0].Matches)
+		if len(request.Metrics) == 0 {
+			accessLogger.Error("find failed",
+				zap.Int("http_code", http.StatusBadRequest),
+				zap.String("reason", "empty query"),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			http.Error(w, "empty query", http.StatusBadRequest)
+			return
+		}
+
+		var result *protov3.MultiGlobResponse
+		var stats *types.Stats
+		result, stats, err = config.zipper.FindProtoV3(ctx, request)
+		sendStats(stats)
+		markStale(w, stats)
+		if err != nil {
+			code, msg := errorResponse(err)
+			accessLogger.Error("find failed",
+				zap.Int("http_code", code),
+				zap.String("reason", err.Error()),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			http.Error(w, msg, code)
+			return
+		}
+
+		var b []byte
+		w.Header().Set("Content-Type", contentTypeCarbonAPIv3PB)
+		b, err = result.Marshal()
+		if err == nil {
+			/* #nosec */
+			_, _ = w.Write(b)
+		}
+	} else {
+		var metrics []*protov2.GlobResponse
+		var stats *types.Stats
+		metrics, stats, err = config.zipper.FindProtoV2(ctx, []string{originalQuery})
+		sendStats(stats)
+		markStale(w, stats)
+		if err != nil {
+			code, msg := errorResponse(err)
+			accessLogger.Error("find failed",
+				zap.Int("http_code", code),
+				zap.String("reason", err.Error()),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			http.Error(w, msg, code)
+			return
+		}
+
+		// There should be exactly one match at this moment
+		err = EncodeFindResponse(format, originalQuery, w, metrics[0].Matches)
+	}
 	if err != nil {
 		http.Error(w, "error marshaling data", http.StatusInternalServerError)
 		accessLogger.Error("find failed",
@@ -220,11 +364,54 @@ func findHandler(w http.ResponseWriter, req *http.Request) {
 	)
 }
 
+// decodeFindRequestV3 reads carbonapi_v3_pb MultiGlobRequest from request body.
+// If body is empty, query from the URL is used instead.
+func decodeFindRequestV3(req *http.Request, query string) (*protov3.MultiGlobRequest, error) {
+	request := &protov3.MultiGlobRequest{}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > 0 {
+		err = request.Unmarshal(body)
+		if err != nil {
+			return nil, err
+		}
+	} else if query != "" {
+		request.Metrics = []string{query}
+	}
+
+	return request, nil
+}
+
+// decodeFetchRequestV3 reads carbonapi_v3_pb MultiFetchRequest from request body.
+// It returns nil request if body is empty, so caller can fallback to URL parameters.
+func decodeFetchRequestV3(req *http.Request) (*protov3.MultiFetchRequest, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	request := &protov3.MultiFetchRequest{}
+	err = request.Unmarshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
 func EncodeFindResponse(format, query string, w http.ResponseWriter, metrics []protov2.GlobMatch) error {
 	var err error
 	var b []byte
 	switch format {
-	case "protobuf", "protobuf3":
+	case "protobuf", "protobuf3", "v2", "carbonapi_v2_pb":
 		w.Header().Set("Content-Type", contentTypeProtobuf)
 		var result protov2.GlobResponse
 		result.Name = query
@@ -278,7 +465,6 @@ func renderHandler(w http.ResponseWriter, req *http.Request) {
 
 	ctx = util.SetUUID(ctx, uuid.String())
 	logger := zapwriter.Logger("render").With(
-		zap.Int("memory_usage_bytes", memoryUsage),
 		zap.String("handler", "render"),
 		zap.String("carbonzipper_uuid", uuid.String()),
 		zap.String("carbonapi_uuid", cu.GetUUID(ctx)),
@@ -309,40 +495,124 @@ func renderHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	targets := req.Form["target"]
 	format := req.FormValue("format")
+	if noNegativeCache, _ := strconv.ParseBool(req.FormValue("noNegativeCache")); noNegativeCache {
+		ctx = types.WithoutNegativeCache(ctx)
+	}
+
+	var request *protov3.MultiFetchRequest
+	if format == "v3" || format == "carbonapi_v3_pb" {
+		request, err = decodeFetchRequestV3(req)
+		if err != nil {
+			http.Error(w, "failed to parse request body", http.StatusBadRequest)
+			accessLogger.Error("request failed",
+				zap.Int("memory_usage_bytes", memoryUsage),
+				zap.String("reason", "failed to parse request body"),
+				zap.Int("http_code", http.StatusBadRequest),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+				zap.Error(err),
+			)
+			return
+		}
+		if request != nil {
+			targets = make([]string, 0, len(request.Metrics))
+			for _, m := range request.Metrics {
+				targets = append(targets, m.Name)
+			}
+		}
+	}
+
 	accessLogger = accessLogger.With(
 		zap.String("format", format),
 		zap.Strings("targets", targets),
 	)
 
-	from, err := strconv.Atoi(req.FormValue("from"))
-	if err != nil {
-		http.Error(w, "from is not a integer", http.StatusBadRequest)
-		accessLogger.Error("request failed",
-			zap.Int("memory_usage_bytes", memoryUsage),
-			zap.String("reason", "from is not a integer"),
-			zap.Int("http_code", http.StatusBadRequest),
-			zap.Duration("runtime_seconds", time.Since(t0)),
-		)
-		return
+	var from, until int
+	if request == nil {
+		from, err = strconv.Atoi(req.FormValue("from"))
+		if err != nil {
+			http.Error(w, "from is not a integer", http.StatusBadRequest)
+			accessLogger.Error("request failed",
+				zap.Int("memory_usage_bytes", memoryUsage),
+				zap.String("reason", "from is not a integer"),
+				zap.Int("http_code", http.StatusBadRequest),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			return
+		}
+		until, err = strconv.Atoi(req.FormValue("until"))
+		if err != nil {
+			http.Error(w, "until is not a integer", http.StatusBadRequest)
+			accessLogger.Error("request failed",
+				zap.Int("memory_usage_bytes", memoryUsage),
+				zap.String("reason", "until is not a integer"),
+				zap.Int("http_code", http.StatusBadRequest),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			return
+		}
 	}
-	until, err := strconv.Atoi(req.FormValue("until"))
-	if err != nil {
-		http.Error(w, "until is not a integer", http.StatusBadRequest)
+
+	if len(targets) == 0 {
+		http.Error(w, "empty target", http.StatusBadRequest)
 		accessLogger.Error("request failed",
 			zap.Int("memory_usage_bytes", memoryUsage),
-			zap.String("reason", "until is not a integer"),
+			zap.String("reason", "empty target"),
 			zap.Int("http_code", http.StatusBadRequest),
 			zap.Duration("runtime_seconds", time.Since(t0)),
 		)
 		return
 	}
 
-	if len(targets) == 0 {
-		http.Error(w, "empty target", http.StatusBadRequest)
-		accessLogger.Error("request failed",
+	if format == "v3" || format == "carbonapi_v3_pb" {
+		if request == nil {
+			request = &protov3.MultiFetchRequest{
+				Metrics: make([]protov3.FetchRequest, 0, len(targets)),
+			}
+			for _, target := range targets {
+				request.Metrics = append(request.Metrics, protov3.FetchRequest{
+					Name:           target,
+					StartTime:      int64(from),
+					StopTime:       int64(until),
+					PathExpression: target,
+				})
+			}
+		}
+
+		result, stats, err := config.zipper.FetchProtoV3(ctx, request)
+		sendStats(stats)
+		markStale(w, stats)
+		if err != nil {
+			code, msg := errorResponse(err)
+			http.Error(w, msg, code)
+			accessLogger.Error("request failed",
+				zap.Int("memory_usage_bytes", memoryUsage),
+				zap.String("reason", err.Error()),
+				zap.Int("http_code", code),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeCarbonAPIv3PB)
+		b, err := result.Marshal()
+		if err != nil {
+			http.Error(w, "error marshaling data", http.StatusInternalServerError)
+			accessLogger.Error("render failed",
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.String("reason", "error marshaling data"),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+				zap.Int("memory_usage_bytes", memoryUsage),
+				zap.Error(err),
+			)
+			return
+		}
+		memoryUsage += len(b)
+		/* #nosec */
+		_, _ = w.Write(b)
+
+		accessLogger.Info("request served",
 			zap.Int("memory_usage_bytes", memoryUsage),
-			zap.String("reason", "empty target"),
-			zap.Int("http_code", http.StatusBadRequest),
+			zap.Int("http_code", http.StatusOK),
 			zap.Duration("runtime_seconds", time.Since(t0)),
 		)
 		return
@@ -350,12 +620,14 @@ func renderHandler(w http.ResponseWriter, req *http.Request) {
 
 	metrics, stats, err := config.zipper.FetchProtoV2(ctx, targets, int32(from), int32(until))
 	sendStats(stats)
+	markStale(w, stats)
 	if err != nil {
-		http.Error(w, "error fetching the data", http.StatusInternalServerError)
+		code, msg := errorResponse(err)
+		http.Error(w, msg, code)
 		accessLogger.Error("request failed",
 			zap.Int("memory_usage_bytes", memoryUsage),
 			zap.String("reason", err.Error()),
-			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Int("http_code", code),
 			zap.Duration("runtime_seconds", time.Since(t0)),
 		)
 		return
@@ -363,7 +635,7 @@ func renderHandler(w http.ResponseWriter, req *http.Request) {
 
 	var b []byte
 	switch format {
-	case "protobuf", "protobuf3":
+	case "protobuf", "protobuf3", "v2", "carbonapi_v2_pb":
 		w.Header().Set("Content-Type", contentTypeProtobuf)
 		b, err = metrics.Marshal()
 
@@ -373,13 +645,17 @@ func renderHandler(w http.ResponseWriter, req *http.Request) {
 	case "json":
 		presponse := createRenderResponse(metrics, nil)
 		w.Header().Set("Content-Type", contentTypeJSON)
-		e := json.NewEncoder(w)
+		cw := &countingWriter{w: w}
+		e := json.NewEncoder(cw)
 		err = e.Encode(presponse)
+		memoryUsage += cw.n
 	case "", "pickle":
 		presponse := createRenderResponse(metrics, pickle.None{})
 		w.Header().Set("Content-Type", contentTypePickle)
-		e := pickle.NewEncoder(w)
+		cw := &countingWriter{w: w}
+		e := pickle.NewEncoder(cw)
 		err = e.Encode(presponse)
+		memoryUsage += cw.n
 	}
 	if err != nil {
 		http.Error(w, "error marshaling data", http.StatusInternalServerError)
@@ -400,6 +676,26 @@ func renderHandler(w http.ResponseWriter, req *http.Request) {
 	)
 }
 
+// errorResponse returns http code and message for the error returned by zipper. Requests that exceed guardrails are client's fault
+func errorResponse(err error) (int, string) {
+	if _, ok := err.(*types.LimitExceededError); ok {
+		return http.StatusUnprocessableEntity, err.Error()
+	}
+	return http.StatusInternalServerError, "error fetching the data"
+}
+
+// countingWriter counts bytes written to the response
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
 func createRenderResponse(metrics *protov2.MultiFetchResponse, missing interface{}) []map[string]interface{} {
 
 	var response []map[string]interface{}
@@ -548,6 +844,302 @@ func infoHandler(w http.ResponseWriter, req *http.Request) {
 	)
 }
 
+func listHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	uuid := uuid.NewV4()
+	ctx := req.Context()
+	ctx = util.SetUUID(ctx, uuid.String())
+	logger := zapwriter.Logger("list").With(
+		zap.String("handler", "list"),
+		zap.String("carbonzipper_uuid", uuid.String()),
+		zap.String("carbonapi_uuid", cu.GetUUID(ctx)),
+	)
+
+	logger.Debug("request",
+		zap.String("request", req.URL.RequestURI()),
+	)
+
+	Metrics.ListRequests.Add(1)
+
+	format := req.FormValue("format")
+	accessLogger := zapwriter.Logger("access").With(
+		zap.String("handler", "list"),
+		zap.String("format", format),
+		zap.String("carbonzipper_uuid", uuid.String()),
+		zap.String("carbonapi_uuid", cu.GetUUID(ctx)),
+	)
+
+	var err error
+	var b []byte
+	switch format {
+	case "protobuf", "protobuf3", "v2", "carbonapi_v2_pb":
+		var result *protov2.ListMetricsResponse
+		var stats *types.Stats
+		result, stats, err = config.zipper.ListProtoV2(ctx)
+		sendStats(stats)
+		if err != nil {
+			Metrics.ListErrors.Add(1)
+			accessLogger.Error("list failed",
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.String("reason", err.Error()),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			http.Error(w, "list: error processing request", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeProtobuf)
+		b, err = result.Marshal()
+		if err == nil {
+			/* #nosec */
+			_, _ = w.Write(b)
+		}
+	case "", "json", "v3", "carbonapi_v3_pb":
+		var result *protov3.ListMetricsResponse
+		var stats *types.Stats
+		result, stats, err = config.zipper.ListProtoV3(ctx)
+		sendStats(stats)
+		if err != nil {
+			Metrics.ListErrors.Add(1)
+			accessLogger.Error("list failed",
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.String("reason", err.Error()),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			http.Error(w, "list: error processing request", http.StatusInternalServerError)
+			return
+		}
+
+		if format == "v3" || format == "carbonapi_v3_pb" {
+			w.Header().Set("Content-Type", contentTypeCarbonAPIv3PB)
+			b, err = result.Marshal()
+			if err == nil {
+				/* #nosec */
+				_, _ = w.Write(b)
+			}
+		} else {
+			w.Header().Set("Content-Type", contentTypeJSON)
+			jEnc := json.NewEncoder(w)
+			err = jEnc.Encode(result)
+		}
+	default:
+		Metrics.ListErrors.Add(1)
+		accessLogger.Error("list failed",
+			zap.Int("http_code", http.StatusBadRequest),
+			zap.String("reason", "unsupported format"),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+		)
+		http.Error(w, "list: unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		Metrics.ListErrors.Add(1)
+		http.Error(w, "error marshaling data", http.StatusInternalServerError)
+		accessLogger.Error("list failed",
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.String("reason", "error marshaling data"),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.Error(err),
+		)
+		return
+	}
+	accessLogger.Info("request served",
+		zap.Int("http_code", http.StatusOK),
+		zap.Duration("runtime_seconds", time.Since(t0)),
+	)
+}
+
+func detailsHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	uuid := uuid.NewV4()
+	ctx := req.Context()
+	ctx = util.SetUUID(ctx, uuid.String())
+	logger := zapwriter.Logger("details").With(
+		zap.String("handler", "details"),
+		zap.String("carbonzipper_uuid", uuid.String()),
+		zap.String("carbonapi_uuid", cu.GetUUID(ctx)),
+	)
+
+	logger.Debug("request",
+		zap.String("request", req.URL.RequestURI()),
+	)
+
+	Metrics.StatsRequests.Add(1)
+
+	format := req.FormValue("format")
+	accessLogger := zapwriter.Logger("access").With(
+		zap.String("handler", "details"),
+		zap.String("format", format),
+		zap.String("carbonzipper_uuid", uuid.String()),
+		zap.String("carbonapi_uuid", cu.GetUUID(ctx)),
+	)
+
+	var err error
+	var b []byte
+	switch format {
+	case "protobuf", "protobuf3", "v2", "carbonapi_v2_pb":
+		var result *protov2.MetricDetailsResponse
+		var stats *types.Stats
+		result, stats, err = config.zipper.StatsProtoV2(ctx)
+		sendStats(stats)
+		if err != nil {
+			Metrics.StatsErrors.Add(1)
+			accessLogger.Error("details failed",
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.String("reason", err.Error()),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			http.Error(w, "details: error processing request", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeProtobuf)
+		b, err = result.Marshal()
+		if err == nil {
+			/* #nosec */
+			_, _ = w.Write(b)
+		}
+	case "", "json", "v3", "carbonapi_v3_pb":
+		var result *protov3.MetricDetailsResponse
+		var stats *types.Stats
+		result, stats, err = config.zipper.StatsProtoV3(ctx)
+		sendStats(stats)
+		if err != nil {
+			Metrics.StatsErrors.Add(1)
+			accessLogger.Error("details failed",
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.String("reason", err.Error()),
+				zap.Duration("runtime_seconds", time.Since(t0)),
+			)
+			http.Error(w, "details: error processing request", http.StatusInternalServerError)
+			return
+		}
+
+		if format == "v3" || format == "carbonapi_v3_pb" {
+			w.Header().Set("Content-Type", contentTypeCarbonAPIv3PB)
+			b, err = result.Marshal()
+			if err == nil {
+				/* #nosec */
+				_, _ = w.Write(b)
+			}
+		} else {
+			w.Header().Set("Content-Type", contentTypeJSON)
+			jEnc := json.NewEncoder(w)
+			err = jEnc.Encode(result)
+		}
+	default:
+		Metrics.StatsErrors.Add(1)
+		accessLogger.Error("details failed",
+			zap.Int("http_code", http.StatusBadRequest),
+			zap.String("reason", "unsupported format"),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+		)
+		http.Error(w, "details: unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		Metrics.StatsErrors.Add(1)
+		http.Error(w, "error marshaling data", http.StatusInternalServerError)
+		accessLogger.Error("details failed",
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.String("reason", "error marshaling data"),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.Error(err),
+		)
+		return
+	}
+	accessLogger.Info("request served",
+		zap.Int("http_code", http.StatusOK),
+		zap.Duration("runtime_seconds", time.Since(t0)),
+	)
+}
+
+func capabilityHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	logger := zapwriter.Logger("capability").With(zap.String("handler", "capability"))
+	accessLogger := zapwriter.Logger("access").With(
+		zap.String("handler", "capability"),
+		zap.String("carbonapi_uuid", cu.GetUUID(req.Context())),
+	)
+	logger.Debug("got capability request",
+		zap.String("request", req.URL.RequestURI()),
+	)
+
+	format := req.FormValue("format")
+	accessLogger = accessLogger.With(
+		zap.String("format", format),
+	)
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err == nil && len(body) > 0 {
+		var request protov3.CapabilityRequest
+		err = request.Unmarshal(body)
+	}
+	if err != nil {
+		accessLogger.Error("capability failed",
+			zap.Int("http_code", http.StatusBadRequest),
+			zap.String("reason", "failed to parse request body"),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.Error(err),
+		)
+		http.Error(w, "failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	/* #nosec */
+	hostname, _ := os.Hostname()
+	response := protov3.CapabilityResponse{
+		// First protocol is the preferred one, "auto" backends will pick it
+		SupportedProtocols:        []string{"carbonapi_v3_pb", "carbonapi_v2_pb", "protobuf", "protobuf3", "pickle", "json"},
+		Name:                      hostname,
+		HighPrecisionTimestamps:   false,
+		SupportFilteringFunctions: false,
+		LikeSplittedRequests:      true,
+		SupportStreaming:          false,
+	}
+
+	var b []byte
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", contentTypeJSON)
+		jEnc := json.NewEncoder(w)
+		err = jEnc.Encode(response)
+	case "", "v3", "carbonapi_v3_pb":
+		w.Header().Set("Content-Type", contentTypeCarbonAPIv3PB)
+		b, err = response.Marshal()
+		if err == nil {
+			/* #nosec */
+			_, _ = w.Write(b)
+		}
+	default:
+		accessLogger.Error("capability failed",
+			zap.Int("http_code", http.StatusBadRequest),
+			zap.String("reason", "unsupported format"),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+		)
+		http.Error(w, "unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "error marshaling data", http.StatusInternalServerError)
+		accessLogger.Error("capability failed",
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.String("reason", "error marshaling data"),
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.Error(err),
+		)
+		return
+	}
+
+	accessLogger.Info("request served",
+		zap.Int("http_code", http.StatusOK),
+		zap.Duration("runtime_seconds", time.Since(t0)),
+	)
+}
+
 func lbCheckHandler(w http.ResponseWriter, req *http.Request) {
 	t0 := time.Now()
 	logger := zapwriter.Logger("loadbalancer").With(zap.String("handler", "loadbalancer"))
@@ -620,7 +1212,7 @@ func main() {
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
-	err = viper.Unmarshal(&config)
+	err = decodeConfig(viper.AllSettings(), &config)
 	if err != nil {
 		logger.Fatal("failed to parse config",
 			zap.String("config_path", *configFile),
@@ -669,22 +1261,44 @@ func main() {
 	// export config via expvars
 	expvar.Publish("config", expvar.Func(func() interface{} { return config }))
 
-	/* Configure zipper */
-	// set up caches
-	zipperConfig := &zipperConfig.Config{
-		ConcurrencyLimitPerServer: config.ConcurrencyLimitPerServer,
-		MaxIdleConnsPerHost:       config.MaxIdleConnsPerHost,
-		Backends:                  config.Backends,
-		BackendsV2:                config.Backendsv2,
-		ExpireDelaySec:            config.ExpireDelaySec,
-		MaxGlobs:                  config.MaxGlobs,
+	// export health of servers in round-robin groups
+	expvar.Publish("backendHealth", expvar.Func(helper.HealthState))
 
-		CarbonSearch:      config.CarbonSearch,
-		CarbonSearchV2:    config.CarbonSearchV2,
-		Timeouts:          config.Timeouts,
-		KeepAliveInterval: config.KeepAliveInterval,
+	// export circuit breakers state and transitions
+	expvar.Publish("circuitBreakers", expvar.Func(breaker.States))
+	expvar.Publish("circuit_breaker_opened", Metrics.CircuitBreakerOpened)
+	expvar.Publish("circuit_breaker_half_opened", Metrics.CircuitBreakerHalfOpened)
+	expvar.Publish("circuit_breaker_closed", Metrics.CircuitBreakerClosed)
+
+	// export current limit, in-flight and queued requests of adaptive concurrency limiters
+	expvar.Publish("concurrencyLimiters", expvar.Func(limiter.States))
+	expvar.Publish("queryCaches", expvar.Func(queryCache.AllStats))
+
+	// export limiters' queue depth per priority class
+	expvar.Publish("limiter_queue_timeouts", Metrics.LimiterQueueTimeouts)
+	for _, p := range limiter.Priorities() {
+		expvar.Publish("limiter_queue_"+p.String(), &limiter.QueueDepth[p])
 	}
 
+	// per-client rate and concurrency limits
+	admit := admission.New(zapwriter.Logger("admission"), config.Admission)
+	expvar.Publish("admission", expvar.Func(admit.Stats))
+	expvar.Publish("admission_accepted", Metrics.AdmissionAccepted)
+	expvar.Publish("admission_rejected", Metrics.AdmissionRejected)
+
+	expvar.Publish("routing_snapshot_age", Metrics.RoutingSnapshotAge)
+	expvar.Publish("routing_snapshot_entries", Metrics.RoutingSnapshotEntries)
+
+	expvar.Publish("shared_cache_hits", Metrics.SharedCacheHits)
+	expvar.Publish("shared_cache_misses", Metrics.SharedCacheMisses)
+	expvar.Publish("shared_cache_timeouts", Metrics.SharedCacheTimeouts)
+	expvar.Publish("chunk_cache_hits", Metrics.ChunkCacheHits)
+	expvar.Publish("chunk_cache_misses", Metrics.ChunkCacheMisses)
+
+	/* Configure zipper */
+	// set up caches
+	zipperConfig := newZipperConfig()
+
 	/*
 		TODO(civil): Restore those metrics
 		Metrics.CacheSize = expvar.Func(func() interface{} { return zipperConfig.PathCache.ECSize() })
@@ -707,9 +1321,12 @@ func main() {
 		)
 	}
 
-	http.HandleFunc("/metrics/find/", httputil.TrackConnections(httputil.TimeHandler(cu.ParseCtx(findHandler), bucketRequestTimes)))
-	http.HandleFunc("/render/", httputil.TrackConnections(httputil.TimeHandler(cu.ParseCtx(renderHandler), bucketRequestTimes)))
-	http.HandleFunc("/info/", httputil.TrackConnections(httputil.TimeHandler(cu.ParseCtx(infoHandler), bucketRequestTimes)))
+	http.HandleFunc("/metrics/find/", httputil.TrackConnections(admit.Handler(httputil.TimeHandler(cu.ParseCtx(findHandler), bucketRequestTimes))))
+	http.HandleFunc("/render/", httputil.TrackConnections(admit.Handler(httputil.TimeHandler(cu.ParseCtx(renderHandler), bucketRequestTimes))))
+	http.HandleFunc("/info/", httputil.TrackConnections(admit.Handler(httputil.TimeHandler(cu.ParseCtx(infoHandler), bucketRequestTimes))))
+	http.HandleFunc("/metrics/list/", httputil.TrackConnections(admit.Handler(httputil.TimeHandler(cu.ParseCtx(listHandler), bucketRequestTimes))))
+	http.HandleFunc("/metrics/details/", httputil.TrackConnections(admit.Handler(httputil.TimeHandler(cu.ParseCtx(detailsHandler), bucketRequestTimes))))
+	http.HandleFunc("/_internal/capabilities/", httputil.TrackConnections(httputil.TimeHandler(cu.ParseCtx(capabilityHandler), bucketRequestTimes)))
 	http.HandleFunc("/lb_check", lbCheckHandler)
 
 	// nothing in the config? check the environment
@@ -751,8 +1368,47 @@ func main() {
 		graphite.Register(fmt.Sprintf("%s.info_requests", pattern), Metrics.InfoRequests)
 		graphite.Register(fmt.Sprintf("%s.info_errors", pattern), Metrics.InfoErrors)
 
+		graphite.Register(fmt.Sprintf("%s.list_requests", pattern), Metrics.ListRequests)
+		graphite.Register(fmt.Sprintf("%s.list_errors", pattern), Metrics.ListErrors)
+
+		graphite.Register(fmt.Sprintf("%s.stats_requests", pattern), Metrics.StatsRequests)
+		graphite.Register(fmt.Sprintf("%s.stats_errors", pattern), Metrics.StatsErrors)
+
 		graphite.Register(fmt.Sprintf("%s.timeouts", pattern), Metrics.Timeouts)
 
+		graphite.Register(fmt.Sprintf("%s.hedged_requests", pattern), Metrics.HedgedRequests)
+		graphite.Register(fmt.Sprintf("%s.hedge_wins", pattern), Metrics.HedgeWins)
+		graphite.Register(fmt.Sprintf("%s.stale_responses", pattern), Metrics.StaleResponses)
+
+		graphite.Register(fmt.Sprintf("%s.circuit_breaker_opened", pattern), Metrics.CircuitBreakerOpened)
+		graphite.Register(fmt.Sprintf("%s.circuit_breaker_half_opened", pattern), Metrics.CircuitBreakerHalfOpened)
+		graphite.Register(fmt.Sprintf("%s.circuit_breaker_closed", pattern), Metrics.CircuitBreakerClosed)
+
+		graphite.Register(fmt.Sprintf("%s.limiter_queue_timeouts", pattern), Metrics.LimiterQueueTimeouts)
+		for _, p := range limiter.Priorities() {
+			graphite.Register(fmt.Sprintf("%s.limiter_queue_%s", pattern, p), &limiter.QueueDepth[p])
+		}
+
+		graphite.Register(fmt.Sprintf("%s.admission_accepted", pattern), Metrics.AdmissionAccepted)
+		graphite.Register(fmt.Sprintf("%s.admission_rejected", pattern), Metrics.AdmissionRejected)
+
+		graphite.Register(fmt.Sprintf("%s.routing_snapshot_age", pattern), Metrics.RoutingSnapshotAge)
+		graphite.Register(fmt.Sprintf("%s.routing_snapshot_entries", pattern), Metrics.RoutingSnapshotEntries)
+
+		graphite.Register(fmt.Sprintf("%s.shared_cache_hits", pattern), Metrics.SharedCacheHits)
+		graphite.Register(fmt.Sprintf("%s.shared_cache_misses", pattern), Metrics.SharedCacheMisses)
+		graphite.Register(fmt.Sprintf("%s.shared_cache_timeouts", pattern), Metrics.SharedCacheTimeouts)
+		graphite.Register(fmt.Sprintf("%s.chunk_cache_hits", pattern), Metrics.ChunkCacheHits)
+		graphite.Register(fmt.Sprintf("%s.chunk_cache_misses", pattern), Metrics.ChunkCacheMisses)
+
+		// groups, that are added by config reload, are registered after it
+		registerQueryCacheMetrics = func() {
+			for name, v := range queryCacheMetrics(pattern) {
+				graphite.Register(name, v)
+			}
+		}
+		registerQueryCacheMetrics()
+
 		for i := 0; i <= config.Buckets; i++ {
 			graphite.Register(fmt.Sprintf("%s.requests_in_%dms_to_%dms", pattern, i*100, (i+1)*100), bucketEntry(i))
 		}
@@ -787,6 +1443,8 @@ func main() {
 		}
 	}
 
+	go reloadOnSignal(*configFile, *envPrefix)
+
 	if len(config.GRPCListen) > 0 {
 		srv, err := NewGRPCServer(config.GRPCListen)
 		if err != nil {
@@ -797,16 +1455,161 @@ func main() {
 		go srv.serve()
 	}
 
-	err = gracehttp.Serve(&http.Server{
+	servers := []*http.Server{{
 		Addr:    config.Listen,
 		Handler: nil,
-	})
+	}}
+	if config.AdminListen != "" {
+		servers = append(servers, &http.Server{
+			Addr:    config.AdminListen,
+			Handler: adminHandler(*configFile, *envPrefix),
+		})
+	}
+
+	err = gracehttp.Serve(servers...)
 
 	if err != nil {
 		log.Fatal("error during gracehttp.Serve()",
 			zap.Error(err),
 		)
 	}
+
+	err = config.zipper.SaveRoutingSnapshot()
+	if err != nil {
+		logger.Error("failed to save routing snapshot",
+			zap.Error(err),
+		)
+	}
+}
+
+// newZipperConfig returns zipper-related part of the config
+func newZipperConfig() *zipperConfig.Config {
+	return &zipperConfig.Config{
+		ConcurrencyLimitPerServer: config.ConcurrencyLimitPerServer,
+		MaxIdleConnsPerHost:       config.MaxIdleConnsPerHost,
+		Backends:                  config.Backends,
+		BackendsV2:                config.Backendsv2,
+		Guardrails:                config.Guardrails,
+		Routing:                   config.Routing,
+		SharedCache:               config.SharedCache,
+		FetchChunks:               config.FetchChunks,
+		ExpireDelaySec:            config.ExpireDelaySec,
+		MaxGlobs:                  config.MaxGlobs,
+
+		CarbonSearch:      config.CarbonSearch,
+		CarbonSearchV2:    config.CarbonSearchV2,
+		Timeouts:          config.Timeouts,
+		KeepAliveInterval: config.KeepAliveInterval,
+	}
+}
+
+// decodeConfig is the same as viper.Unmarshal, but also allows servers in backendsv2 to have weights
+func decodeConfig(settings map[string]interface{}, cfg interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           cfg,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+			types.ServersDecodeHook,
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(settings)
+}
+
+// reloadConfig reads config file again and applies the parts that can be changed without restart: backend groups
+// and their weights
+func reloadConfig(configFile, envPrefix string) error {
+	cfg, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	v := viper.New()
+	if strings.HasSuffix(configFile, ".toml") {
+		v.SetConfigType("TOML")
+	} else {
+		v.SetConfigType("YAML")
+	}
+	err = v.ReadConfig(bytes.NewBuffer(cfg))
+	if err != nil {
+		return err
+	}
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	var newConfig struct {
+		Backends       []string             `mapstructure:"backends"`
+		Backendsv2     types.BackendsV2     `mapstructure:"backendsv2"`
+		CarbonSearch   types.CarbonSearch   `mapstructure:"carbonsearch"`
+		CarbonSearchV2 types.CarbonSearchV2 `mapstructure:"carbonsearchv2"`
+	}
+	err = decodeConfig(v.AllSettings(), &newConfig)
+	if err != nil {
+		return err
+	}
+
+	zc := newZipperConfig()
+	zc.Backends = newConfig.Backends
+	zc.BackendsV2 = newConfig.Backendsv2
+	zc.CarbonSearch = newConfig.CarbonSearch
+	zc.CarbonSearchV2 = newConfig.CarbonSearchV2
+	if err := config.zipper.Reload(zc); err != nil {
+		return err
+	}
+	registerQueryCacheMetrics()
+	return nil
+}
+
+func reloadOnSignal(configFile, envPrefix string) {
+	logger := zapwriter.Logger("reload")
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		logger.Info("reloading config",
+			zap.String("config_file", configFile),
+		)
+		err := reloadConfig(configFile, envPrefix)
+		if err != nil {
+			logger.Error("failed to reload config",
+				zap.String("config_file", configFile),
+				zap.Error(err),
+			)
+			continue
+		}
+		logger.Info("config reloaded")
+	}
+}
+
+// registerQueryCacheMetrics registers metrics of the query caches of all groups with graphite sender, if it's configured
+var registerQueryCacheMetrics = func() {}
+
+// queryCacheMetrics returns metrics of the query caches of all groups by their names. Caches are looked up on every send,
+// as groups can be replaced by config reload
+func queryCacheMetrics(pattern string) map[string]expvar.Var {
+	res := make(map[string]expvar.Var)
+	for group, caches := range queryCache.Caches() {
+		for kind := range caches {
+			stat := func(f func(queryCache.Stats) interface{}) expvar.Func {
+				group, kind := group, kind
+				return expvar.Func(func() interface{} { return f(queryCache.Lookup(group, kind).Stats()) })
+			}
+			name := fmt.Sprintf("%s.query_cache.%s.%s", pattern, strings.Replace(group, ".", "_", -1), kind)
+			res[name+".hits"] = stat(func(s queryCache.Stats) interface{} { return s.Hits })
+			res[name+".misses"] = stat(func(s queryCache.Stats) interface{} { return s.Misses })
+			res[name+".evictions"] = stat(func(s queryCache.Stats) interface{} { return s.Evictions })
+			res[name+".empty_hits"] = stat(func(s queryCache.Stats) interface{} { return s.EmptyHits })
+			res[name+".error_hits"] = stat(func(s queryCache.Stats) interface{} { return s.ErrorHits })
+			res[name+".stale_hits"] = stat(func(s queryCache.Stats) interface{} { return s.StaleHits })
+			res[name+".size"] = stat(func(s queryCache.Stats) interface{} { return s.Size })
+		}
+	}
+	return res
 }
 
 var timeBuckets []int64
@@ -853,4 +1656,14 @@ func sendStats(stats *types.Stats) {
 	Metrics.SearchCacheMisses.Add(stats.SearchCacheMisses)
 	Metrics.CacheMisses.Add(stats.CacheMisses)
 	Metrics.CacheHits.Add(stats.CacheHits)
+	Metrics.HedgedRequests.Add(stats.HedgedRequests)
+	Metrics.HedgeWins.Add(stats.HedgeWins)
+	Metrics.StaleResponses.Add(stats.StaleResponses)
+}
+
+// markStale sets header, that tells the client that response was served from cache after it expired
+func markStale(w http.ResponseWriter, stats *types.Stats) {
+	if stats != nil && stats.StaleResponses > 0 {
+		w.Header().Set(staleHeader, "true")
+	}
 }
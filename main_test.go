@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper"
+	queryCache "github.com/go-graphite/carbonzipper/zipper/cache"
+	zipperConfig "github.com/go-graphite/carbonzipper/zipper/config"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"go.uber.org/zap"
+)
+
+// testMetrics are the metrics of the test backend, by path. Value is true for leaves
+var testMetrics = map[string]bool{
+	"foo":     false,
+	"foo.bar": true,
+	"foo.baz": true,
+}
+
+func matchTestMetrics(query string) []protov3.GlobMatch {
+	var res []protov3.GlobMatch
+	for p, leaf := range testMetrics {
+		if strings.Count(p, ".") != strings.Count(query, ".") {
+			continue
+		}
+		if ok, _ := path.Match(query, p); ok {
+			res = append(res, protov3.GlobMatch{Path: p, IsLeaf: leaf})
+		}
+	}
+	return res
+}
+
+// newTestBackend starts carbonapi_v3_pb backend with testMetrics, every metric has value 1 at every 60s step
+func newTestBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var b []byte
+		switch req.URL.Path {
+		case "/metrics/find/":
+			var request protov3.MultiGlobRequest
+			if err := request.Unmarshal(body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var response protov3.MultiGlobResponse
+			for _, query := range request.Metrics {
+				response.Metrics = append(response.Metrics, protov3.GlobResponse{Name: query, Matches: matchTestMetrics(query)})
+			}
+			b, err = response.Marshal()
+		case "/render/":
+			var request protov3.MultiFetchRequest
+			if err := request.Unmarshal(body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var response protov3.MultiFetchResponse
+			for _, r := range request.Metrics {
+				for _, m := range matchTestMetrics(r.Name) {
+					if !m.IsLeaf {
+						continue
+					}
+					s := protov3.FetchResponse{
+						Name:           m.Path,
+						PathExpression: r.PathExpression,
+						StartTime:      r.StartTime,
+						StopTime:       r.StopTime,
+						StepTime:       60,
+					}
+					for t := r.StartTime; t < r.StopTime; t += 60 {
+						s.Values = append(s.Values, 1)
+					}
+					response.Metrics = append(response.Metrics, s)
+				}
+			}
+			b, err = response.Marshal()
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeCarbonAPIv3PB)
+		_, _ = w.Write(b)
+	}))
+}
+
+// setupTestZipper makes handlers use zipper over the test backend. Returned function stops both of them
+func setupTestZipper(t *testing.T) func() {
+	backend := newTestBackend()
+	limit := 10
+	cfg := &zipperConfig.Config{
+		ConcurrencyLimitPerServer: limit,
+		BackendsV2: types.BackendsV2{
+			Backends: []types.BackendV2{{
+				GroupName:        t.Name(),
+				Protocol:         "carbonapi_v3_pb",
+				LBMethod:         "broadcast",
+				Servers:          []string{backend.URL},
+				ConcurrencyLimit: &limit,
+			}},
+		},
+		InternalRoutingCache: time.Minute,
+	}
+
+	z, err := zipper.NewZipper(func(*types.Stats) {}, cfg, zap.NewNop())
+	if err != nil {
+		backend.Close()
+		t.Fatalf("failed to create zipper: %v", err)
+	}
+	config.zipper = z
+	return func() {
+		close(z.ProbeQuit)
+		backend.Close()
+	}
+}
+
+func TestV2Formats(t *testing.T) {
+	defer setupTestZipper(t)()
+
+	for _, format := range []string{"protobuf", "protobuf3", "v2", "carbonapi_v2_pb"} {
+		w := httptest.NewRecorder()
+		findHandler(w, httptest.NewRequest("GET", "/metrics/find/?query=foo.*&format="+format, nil))
+		var glob protov2.GlobResponse
+		if err := glob.Unmarshal(w.Body.Bytes()); err != nil || w.Code != http.StatusOK || len(glob.Matches) != 2 {
+			t.Errorf("find in %v format: got %v %v, error %v", format, w.Code, glob, err)
+		}
+
+		w = httptest.NewRecorder()
+		renderHandler(w, httptest.NewRequest("GET", "/render/?target=foo.bar&from=0&until=180&format="+format, nil))
+		var fetched protov2.MultiFetchResponse
+		if err := fetched.Unmarshal(w.Body.Bytes()); err != nil || w.Code != http.StatusOK || len(fetched.Metrics) != 1 {
+			t.Errorf("render in %v format: got %v %v, error %v", format, w.Code, fetched, err)
+		}
+	}
+}
+
+func TestQueryCacheMetrics(t *testing.T) {
+	name := "carbon.zipper.query_cache.added_by_reload.find"
+	if _, ok := queryCacheMetrics("carbon.zipper")[name+".hits"]; ok {
+		t.Fatalf("%v is registered before the group is added", name)
+	}
+
+	q := queryCache.NewQueryCache(1024, time.Minute)
+	q.Hits.Add(3)
+	queryCache.Register("added.by.reload", map[string]*queryCache.QueryCache{"find": q})
+	defer queryCache.Unregister("added.by.reload")
+
+	metrics := queryCacheMetrics("carbon.zipper")
+	hits, ok := metrics[name+".hits"]
+	if !ok {
+		t.Fatalf("%v is not registered, got %v", name, metrics)
+	}
+	if hits.String() != "3" {
+		t.Errorf("got %v hits, expected 3", hits.String())
+	}
+}
+
+func TestFindV3Body(t *testing.T) {
+	defer setupTestZipper(t)()
+
+	body, err := (&protov3.MultiGlobRequest{Metrics: []string{"foo.*", "foo"}}).Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		body     []byte
+		code     int
+		expected map[string]int
+	}{
+		{name: "GET with body", method: "GET", url: "/metrics/find/?format=carbonapi_v3_pb", body: body, code: http.StatusOK, expected: map[string]int{"foo.*": 2, "foo": 1}},
+		{name: "POST with body", method: "POST", url: "/metrics/find/?format=v3", body: body, code: http.StatusOK, expected: map[string]int{"foo.*": 2, "foo": 1}},
+		{name: "body overrides query", method: "POST", url: "/metrics/find/?format=v3&query=bar", body: body, code: http.StatusOK, expected: map[string]int{"foo.*": 2, "foo": 1}},
+		{name: "empty body", method: "GET", url: "/metrics/find/?format=carbonapi_v3_pb&query=foo.*", code: http.StatusOK, expected: map[string]int{"foo.*": 2}},
+		{name: "empty body and query", method: "GET", url: "/metrics/find/?format=carbonapi_v3_pb", code: http.StatusBadRequest},
+		{name: "malformed body", method: "POST", url: "/metrics/find/?format=carbonapi_v3_pb&query=foo.*", body: []byte("not a protobuf"), code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", contentTypeCarbonAPIv3PB)
+			w := httptest.NewRecorder()
+			findHandler(w, req)
+
+			if w.Code != tt.code {
+				t.Fatalf("got code %v, expected %v: %v", w.Code, tt.code, w.Body.String())
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var response protov3.MultiGlobResponse
+			if err := response.Unmarshal(w.Body.Bytes()); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			got := make(map[string]int)
+			for _, m := range response.Metrics {
+				got[m.Name] = len(m.Matches)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got matches %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRenderV3Body(t *testing.T) {
+	defer setupTestZipper(t)()
+
+	body, err := (&protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{
+		{Name: "foo.*", PathExpression: "foo.*", StartTime: 0, StopTime: 300},
+	}}).Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		body     []byte
+		code     int
+		expected map[string]int
+	}{
+		{name: "GET with body", method: "GET", url: "/render/?format=carbonapi_v3_pb", body: body, code: http.StatusOK, expected: map[string]int{"foo.bar": 5, "foo.baz": 5}},
+		{name: "POST with body", method: "POST", url: "/render/?format=v3", body: body, code: http.StatusOK, expected: map[string]int{"foo.bar": 5, "foo.baz": 5}},
+		{name: "body overrides target", method: "POST", url: "/render/?format=v3&target=foo.bar&from=0&until=60", body: body, code: http.StatusOK, expected: map[string]int{"foo.bar": 5, "foo.baz": 5}},
+		{name: "empty body", method: "GET", url: "/render/?format=carbonapi_v3_pb&target=foo.bar&from=0&until=180", code: http.StatusOK, expected: map[string]int{"foo.bar": 3}},
+		{name: "empty body and target", method: "GET", url: "/render/?format=carbonapi_v3_pb&from=0&until=180", code: http.StatusBadRequest},
+		{name: "malformed body", method: "POST", url: "/render/?format=carbonapi_v3_pb&target=foo.bar&from=0&until=180", body: []byte("not a protobuf"), code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", contentTypeCarbonAPIv3PB)
+			w := httptest.NewRecorder()
+			renderHandler(w, req)
+
+			if w.Code != tt.code {
+				t.Fatalf("got code %v, expected %v: %v", w.Code, tt.code, w.Body.String())
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var response protov3.MultiFetchResponse
+			if err := response.Unmarshal(w.Body.Bytes()); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			got := make(map[string]int)
+			for _, m := range response.Metrics {
+				got[m.Name] = len(m.Values)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got values %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package pathcache
+
+import (
+	"strings"
+)
+
+// globToken is one element of the path part pattern: any string for "*", otherwise one character of the set
+type globToken struct {
+	star bool
+	set  [256]bool
+}
+
+// parseGlob splits path part pattern (without {a,b} alternatives) into tokens, the way path.Match reads it. Malformed
+// character class is taken literally
+func parseGlob(pattern string) []globToken {
+	var res []globToken
+	for i := 0; i < len(pattern); i++ {
+		var t globToken
+		switch c := pattern[i]; c {
+		case '*':
+			t.star = true
+		case '?':
+			for b := range t.set {
+				t.set[b] = b != '/'
+			}
+		case '[':
+			end, ok := parseClass(pattern[i+1:], &t.set)
+			if !ok {
+				t.set['['] = true
+				break
+			}
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			t.set[pattern[i]] = true
+		default:
+			t.set[c] = true
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// parseClass fills the set from character class, that follows the "[". Returns index of the closing "]"
+func parseClass(class string, set *[256]bool) (int, bool) {
+	i := 0
+	negate := i < len(class) && class[i] == '^'
+	if negate {
+		i++
+	}
+	var members [256]bool
+	for first := true; i < len(class); first = false {
+		if class[i] == ']' && !first {
+			for b := range set {
+				set[b] = members[b] != negate
+			}
+			return i, true
+		}
+		lo, next, ok := classChar(class, i)
+		if !ok {
+			return 0, false
+		}
+		hi := lo
+		if next+1 < len(class) && class[next] == '-' && class[next+1] != ']' {
+			hi, next, ok = classChar(class, next+1)
+			if !ok {
+				return 0, false
+			}
+		}
+		for b := int(lo); b <= int(hi); b++ {
+			members[b] = true
+		}
+		i = next
+	}
+	return 0, false
+}
+
+func classChar(class string, i int) (byte, int, bool) {
+	if class[i] == '\\' {
+		i++
+	}
+	if i >= len(class) {
+		return 0, 0, false
+	}
+	return class[i], i + 1, true
+}
+
+// overlapTokens returns true if some string matches both patterns
+func overlapTokens(p, q []globToken) bool {
+	// seen[i][j] is true if patterns' tails starting at i and j were already checked
+	seen := make([][]bool, len(p)+1)
+	for i := range seen {
+		seen[i] = make([]bool, len(q)+1)
+	}
+	var overlap func(i, j int) bool
+	overlap = func(i, j int) bool {
+		if seen[i][j] {
+			return false
+		}
+		seen[i][j] = true
+
+		switch {
+		case i == len(p) && j == len(q):
+			return true
+		case i < len(p) && p[i].star:
+			// star matches nothing, or the next character of the other pattern
+			return overlap(i+1, j) || (j < len(q) && overlap(i, j+1))
+		case j < len(q) && q[j].star:
+			return overlap(i, j+1) || (i < len(p) && overlap(i+1, j))
+		case i == len(p) || j == len(q):
+			return false
+		}
+		for b := range p[i].set {
+			if p[i].set[b] && q[j].set[b] {
+				return overlap(i+1, j+1)
+			}
+		}
+		return false
+	}
+	return overlap(0, 0)
+}
+
+// Overlap returns true if some metric path matches both queries with graphite globs. For plain metric path it's the
+// same as Match
+func Overlap(a, b string) bool {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	if len(aParts) != len(bParts) {
+		return false
+	}
+	for i := range aParts {
+		if !overlapParts(aParts[i], bParts[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func overlapParts(a, b string) bool {
+	if !isGlob(a) && !isGlob(b) {
+		return a == b
+	}
+	for _, x := range expandBraces(a) {
+		for _, y := range expandBraces(b) {
+			if overlapTokens(parseGlob(x), parseGlob(y)) {
+				return true
+			}
+		}
+	}
+	return false
+}
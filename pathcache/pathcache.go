@@ -1,58 +1,401 @@
 package pathcache
 
 import (
-	"github.com/dgryski/go-expirecache"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-graphite/carbonzipper/zipper/types"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
 
-	"time"
+// Config contains settings of the routing index
+type Config struct {
+	// Depth of the paths that are enumerated by periodic probes, 1 means only top-level names. Default: 1
+	ProbeDepth int `mapstructure:"probeDepth"`
+	// Maximum depth of the paths that are learned from find responses, never less than ProbeDepth. Default: 3
+	MaxDepth int `mapstructure:"maxDepth"`
+
+	// File where routing index is saved periodically and on shutdown. Empty means no snapshots
+	SnapshotFile string `mapstructure:"snapshotFile"`
+	// How often snapshot is saved. Default: 1m
+	SnapshotInterval time.Duration `mapstructure:"snapshotInterval"`
+	// Snapshots older than that are not loaded at startup. Default: 1h
+	SnapshotMaxAge time.Duration `mapstructure:"snapshotMaxAge"`
+}
+
+const (
+	defaultProbeDepth = 1
+	defaultMaxDepth   = 3
 )
 
-// PathCache provides general interface to cache find and search queries
+var (
+	configLock sync.RWMutex
+	config     = Config{
+		ProbeDepth: defaultProbeDepth,
+		MaxDepth:   defaultMaxDepth,
+	}
+)
+
+// Configure sets depths for all path caches created after the call. Zero values mean defaults
+func Configure(c Config) {
+	if c.ProbeDepth <= 0 {
+		c.ProbeDepth = defaultProbeDepth
+	}
+	if c.MaxDepth <= 0 {
+		c.MaxDepth = defaultMaxDepth
+	}
+	if c.MaxDepth < c.ProbeDepth {
+		c.MaxDepth = c.ProbeDepth
+	}
+
+	configLock.Lock()
+	config = c
+	configLock.Unlock()
+}
+
+type node struct {
+	children map[string]*node
+	clients  []types.ServerClient
+	expires  time.Time
+}
+
+func (n *node) valid(now time.Time) bool {
+	return len(n.clients) > 0 && now.Before(n.expires)
+}
+
+// cleanup removes expired entries and returns true if node can be removed from it's parent
+func (n *node) cleanup(now time.Time) bool {
+	for k, c := range n.children {
+		if c.cleanup(now) {
+			delete(n.children, k)
+		}
+	}
+	if !n.valid(now) {
+		n.clients = nil
+	}
+	return len(n.clients) == 0 && len(n.children) == 0
+}
+
+// PathCache is a routing index, that knows which clients own subtrees of the metric namespace
 type PathCache struct {
-	ec *expirecache.Cache
+	lock *sync.RWMutex
+	root *node
+	// closed when the cache is not used anymore, stops the cleaner
+	done      chan struct{}
+	closeOnce *sync.Once
 
 	expireDelaySec int32
+	probeDepth     int
+	maxDepth       int
 }
 
 // NewPathCache initializes PathCache structure
 func NewPathCache(ExpireDelaySec int32) PathCache {
+	configLock.RLock()
+	c := config
+	configLock.RUnlock()
 
 	p := PathCache{
-		ec:             expirecache.New(0),
+		lock:           &sync.RWMutex{},
+		root:           &node{},
+		done:           make(chan struct{}),
+		closeOnce:      &sync.Once{},
 		expireDelaySec: ExpireDelaySec,
+		probeDepth:     c.ProbeDepth,
+		maxDepth:       c.MaxDepth,
 	}
 
-	go p.ec.ApproximateCleaner(10 * time.Second)
+	go p.cleaner(10 * time.Second)
 
 	return p
 }
 
+func (p *PathCache) cleaner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.lock.Lock()
+			p.root.cleanup(time.Now())
+			p.lock.Unlock()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Close stops background cleanup of the cache, it's still usable, but expired entries are not removed anymore
+func (p *PathCache) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// ProbeDepth returns depth of the paths, that should be enumerated by probes
+func (p *PathCache) ProbeDepth() int {
+	return p.probeDepth
+}
+
+// MaxDepth returns maximum depth of the paths, that should be learned
+func (p *PathCache) MaxDepth() int {
+	return p.maxDepth
+}
+
+// walk calls f for every valid entry
+func (p *PathCache) walk(f func(path string, n *node)) {
+	now := time.Now()
+	var walk func(path string, n *node)
+	walk = func(path string, n *node) {
+		if n.valid(now) {
+			f(path, n)
+		}
+		for k, c := range n.children {
+			if path == "" {
+				walk(k, c)
+			} else {
+				walk(path+"."+k, c)
+			}
+		}
+	}
+
+	p.lock.RLock()
+	walk("", p.root)
+	p.lock.RUnlock()
+}
+
 // ECItems returns amount of items in the cache
 func (p *PathCache) ECItems() int {
-	return p.ec.Items()
+	items := 0
+	p.walk(func(_ string, n *node) {
+		items++
+	})
+	return items
 }
 
 // ECSize returns size of the cache
 func (p *PathCache) ECSize() uint64 {
-	return p.ec.Size()
+	var size uint64
+	p.walk(func(_ string, n *node) {
+		for _, c := range n.clients {
+			size += uint64(len(c.Backends()))
+		}
+	})
+	return size
 }
 
-// Set allows to set a key (k) to value (v).
+// Set allows to set a key (k) to value (v). Key is a metric path and value is the list of clients that own it.
 func (p *PathCache) Set(k string, v []types.ServerClient) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-	var size uint64
-	for _, vv := range v {
-		size += uint64(len(vv.Backends()))
+	n := p.root
+	for _, part := range strings.Split(k, ".") {
+		child, ok := n.children[part]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*node)
+			}
+			child = &node{}
+			n.children[part] = child
+		}
+		n = child
 	}
-
-	p.ec.Set(k, v, size, p.expireDelaySec)
+	n.clients = v
+	n.expires = time.Now().Add(time.Duration(p.expireDelaySec) * time.Second)
 }
 
 // Get returns an an element by key. If not successful - returns also false in second var.
 func (p *PathCache) Get(k string) ([]types.ServerClient, bool) {
-	if v, ok := p.ec.Get(k); ok {
-		return v.([]types.ServerClient), true
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	n := p.root
+	for _, part := range strings.Split(k, ".") {
+		n = n.children[part]
+		if n == nil {
+			return nil, false
+		}
 	}
+	if !n.valid(time.Now()) {
+		return nil, false
+	}
+	return n.clients, true
+}
 
-	return nil, false
+// Route returns clients, that own the longest known prefix of the query. Prefix ends at the first glob in the query.
+func (p *PathCache) Route(query string) ([]types.ServerClient, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	now := time.Now()
+	var res []types.ServerClient
+	n := p.root
+	for _, part := range strings.Split(query, ".") {
+		if isGlob(part) {
+			break
+		}
+		n = n.children[part]
+		if n == nil {
+			break
+		}
+		if n.valid(now) {
+			res = n.clients
+		}
+	}
+	return res, res != nil
+}
+
+// Entries returns all valid entries of the cache
+func (p *PathCache) Entries() map[string][]types.ServerClient {
+	res := make(map[string][]types.ServerClient)
+	p.walk(func(path string, n *node) {
+		res[path] = n.clients
+	})
+	return res
+}
+
+// Purge removes entries with paths accepted by match, returns amount of removed entries
+func (p *PathCache) Purge(match func(path string) bool) int {
+	removed := 0
+	var walk func(path string, n *node)
+	walk = func(path string, n *node) {
+		if len(n.clients) > 0 && match(path) {
+			n.clients = nil
+			removed++
+		}
+		for k, c := range n.children {
+			if path == "" {
+				walk(k, c)
+			} else {
+				walk(path+"."+k, c)
+			}
+		}
+	}
+
+	p.lock.Lock()
+	walk("", p.root)
+	p.root.cleanup(time.Now())
+	p.lock.Unlock()
+	return removed
+}
+
+// Flush removes all entries, returns amount of removed entries
+func (p *PathCache) Flush() int {
+	return p.Purge(func(string) bool { return true })
+}
+
+// Learn stores owners of all the paths collected from find responses
+func (p *PathCache) Learn(o Owners) {
+	for k, v := range o {
+		p.Set(k, v)
+	}
+}
+
+func isGlob(part string) bool {
+	return strings.ContainsAny(part, "*?[{")
+}
+
+// expandBraces returns all variants of the path part with {a,b} alternatives
+func expandBraces(part string) []string {
+	start := strings.IndexByte(part, '{')
+	if start < 0 {
+		return []string{part}
+	}
+	end := strings.IndexByte(part[start:], '}')
+	if end < 0 {
+		return []string{part}
+	}
+	end += start
+
+	var res []string
+	for _, alt := range strings.Split(part[start+1:end], ",") {
+		res = append(res, expandBraces(part[:start]+alt+part[end+1:])...)
+	}
+	return res
+}
+
+// Match returns true if the metric path matches the query with graphite globs (*, ?, [...] and {a,b})
+func Match(query, metric string) bool {
+	queryParts := strings.Split(query, ".")
+	metricParts := strings.Split(metric, ".")
+	if len(queryParts) != len(metricParts) {
+		return false
+	}
+	for i, q := range queryParts {
+		matched := false
+		for _, pattern := range expandBraces(q) {
+			if ok, _ := path.Match(pattern, metricParts[i]); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Prefix returns part of the query before the first glob
+func Prefix(query string) string {
+	parts := strings.Split(query, ".")
+	for i, part := range parts {
+		if isGlob(part) {
+			return strings.Join(parts[:i], ".")
+		}
+	}
+	return query
+}
+
+func depth(path string) int {
+	return strings.Count(path, ".") + 1
+}
+
+// Owners collects clients, that own the paths found by find requests
+type Owners map[string][]types.ServerClient
+
+func (o Owners) add(path string, client types.ServerClient) {
+	clients := o[path]
+	if len(clients) > 0 && clients[len(clients)-1].Name() == client.Name() {
+		return
+	}
+	o[path] = append(clients, client)
+}
+
+// childrenPrefix returns prefix of the query, that lists all children of it ("<prefix>.*"), empty string otherwise
+func childrenPrefix(query string) string {
+	if !strings.HasSuffix(query, ".*") {
+		return ""
+	}
+	prefix := strings.TrimSuffix(query, ".*")
+	if Prefix(prefix) != prefix {
+		return ""
+	}
+	return prefix
+}
+
+// Add records paths from client's response, that are not deeper than maxDepth. Every found path is owned by the client.
+// Prefix of the query is owned by the client only if query lists all it's children, partial globs like "a.b*" or
+// "a.*.c" could miss children of the prefix, that are owned by other clients. Response must be complete, otherwise
+// ownership is unknown.
+func (o Owners) Add(client types.ServerClient, response *protov3.MultiGlobResponse, maxDepth int) {
+	if response == nil {
+		return
+	}
+	for _, m := range response.Metrics {
+		if len(m.Matches) == 0 {
+			continue
+		}
+		if prefix := childrenPrefix(m.Name); prefix != "" && depth(prefix) <= maxDepth {
+			o.add(prefix, client)
+		}
+		for _, match := range m.Matches {
+			if depth(match.Path) <= maxDepth {
+				o.add(match.Path, client)
+			}
+		}
+	}
 }
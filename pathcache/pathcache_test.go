@@ -0,0 +1,201 @@
+package pathcache
+
+import (
+	"testing"
+
+	"github.com/go-graphite/carbonzipper/zipper/dummy"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+func TestPrefix(t *testing.T) {
+	tests := map[string]string{
+		"a.b.c":   "a.b.c",
+		"a.b.*":   "a.b",
+		"a.{b,c}": "a",
+		"a.b?.c":  "a",
+		"*.b":     "",
+	}
+	for query, expected := range tests {
+		if got := Prefix(query); got != expected {
+			t.Errorf("Prefix(%q) = %q, expected %q", query, got, expected)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	client1 := dummy.NewDummyClient("client1", []string{"backend1"}, 0)
+	client2 := dummy.NewDummyClient("client2", []string{"backend2"}, 0)
+
+	p := NewPathCache(60)
+	p.Set("a", []types.ServerClient{client1, client2})
+	p.Set("a.b.c", []types.ServerClient{client2})
+
+	tests := []struct {
+		query    string
+		expected []types.ServerClient
+	}{
+		{query: "a.*", expected: []types.ServerClient{client1, client2}},
+		{query: "a.b.*", expected: []types.ServerClient{client1, client2}},
+		{query: "a.b.c.*", expected: []types.ServerClient{client2}},
+		{query: "a.b.c.d.e", expected: []types.ServerClient{client2}},
+		{query: "a.*.c", expected: []types.ServerClient{client1, client2}},
+		{query: "b.c", expected: nil},
+		{query: "*.b.c", expected: nil},
+	}
+	for _, tt := range tests {
+		res, ok := p.Route(tt.query)
+		if ok != (tt.expected != nil) || len(res) != len(tt.expected) {
+			t.Errorf("Route(%q) = %v, expected %v", tt.query, res, tt.expected)
+			continue
+		}
+		for i := range res {
+			if res[i] != tt.expected[i] {
+				t.Errorf("Route(%q) = %v, expected %v", tt.query, res, tt.expected)
+			}
+		}
+	}
+
+	if items := p.ECItems(); items != 2 {
+		t.Errorf("got %v items, expected 2", items)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		query    string
+		metric   string
+		expected bool
+	}{
+		{query: "a.b.c", metric: "a.b.c", expected: true},
+		{query: "a.*.c", metric: "a.b.c", expected: true},
+		{query: "a.*", metric: "a.b.c", expected: false},
+		{query: "a.b?.c", metric: "a.bb.c", expected: true},
+		{query: "a.[bc].c", metric: "a.c.c", expected: true},
+		{query: "a.{x,b}.c", metric: "a.b.c", expected: true},
+		{query: "a.b_{x,y}.c", metric: "a.b_z.c", expected: false},
+		{query: "a.*", metric: "a.*", expected: true},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.query, tt.metric); got != tt.expected {
+			t.Errorf("Match(%q, %q) = %v, expected %v", tt.query, tt.metric, got, tt.expected)
+		}
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected bool
+	}{
+		{a: "a.b.c", b: "a.b.c", expected: true},
+		{a: "a.b.c", b: "a.*.c", expected: true},
+		{a: "a.b.c", b: "a.*.d", expected: false},
+		{a: "a.b.c", b: "a.*", expected: false},
+		{a: "a.b*.c", b: "a.*x.c", expected: true},
+		{a: "a.b*", b: "a.c*", expected: false},
+		{a: "a.x*y", b: "a.*z", expected: false},
+		{a: "a.[bc]", b: "a.[cd]", expected: true},
+		{a: "a.[bc]", b: "a.[^bc]", expected: false},
+		{a: "a.[a-c]?", b: "a.d*", expected: false},
+		{a: "a.b?", b: "a.{x,b}z", expected: true},
+		{a: "a.{x,y}", b: "a.{b,c}*", expected: false},
+	}
+	for _, tt := range tests {
+		if got := Overlap(tt.a, tt.b); got != tt.expected {
+			t.Errorf("Overlap(%q, %q) = %v, expected %v", tt.a, tt.b, got, tt.expected)
+		}
+		if got := Overlap(tt.b, tt.a); got != tt.expected {
+			t.Errorf("Overlap(%q, %q) = %v, expected %v", tt.b, tt.a, got, tt.expected)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	client := dummy.NewDummyClient("client1", []string{"backend1"}, 0)
+
+	p := NewPathCache(60)
+	for _, k := range []string{"a", "a.b", "a.b.c", "b"} {
+		p.Set(k, []types.ServerClient{client})
+	}
+
+	if removed := p.Purge(func(path string) bool { return Match("a.*", path) }); removed != 1 {
+		t.Errorf("purged %v entries, expected 1", removed)
+	}
+	if _, ok := p.Get("a.b"); ok {
+		t.Error("purged entry is still cached")
+	}
+	if _, ok := p.Get("a.b.c"); !ok {
+		t.Error("entry under the purged one is not cached")
+	}
+	if removed := p.Flush(); removed != 3 {
+		t.Errorf("flushed %v entries, expected 3", removed)
+	}
+	if items := p.ECItems(); items != 0 {
+		t.Errorf("got %v items, expected none", items)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	client1 := dummy.NewDummyClient("client1", []string{"backend1"}, 0)
+	client2 := dummy.NewDummyClient("client2", []string{"backend2"}, 0)
+
+	o := make(Owners)
+	o.Add(client1, &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{
+			{Name: "a.b.*", Matches: []protov3.GlobMatch{{Path: "a.b.c"}, {Path: "a.b.d"}}},
+			{Name: "a.*.c.d", Matches: []protov3.GlobMatch{{Path: "a.x.c.d"}}},
+		},
+	}, 3)
+	o.Add(client2, &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{
+			{Name: "a.b.*", Matches: []protov3.GlobMatch{{Path: "a.b.c"}}},
+			{Name: "a.*.c.d", Matches: []protov3.GlobMatch{}},
+		},
+	}, 3)
+
+	expected := map[string][]string{
+		"a.b":   {"client1", "client2"},
+		"a.b.c": {"client1", "client2"},
+		"a.b.d": {"client1"},
+	}
+	if len(o) != len(expected) {
+		t.Fatalf("got owners of %v paths, expected %v", len(o), len(expected))
+	}
+	for path, names := range expected {
+		clients := o[path]
+		if len(clients) != len(names) {
+			t.Fatalf("path %v: got %v owners, expected %v", path, len(clients), names)
+		}
+		for i := range clients {
+			if clients[i].Name() != names[i] {
+				t.Errorf("path %v: got owner %v, expected %v", path, clients[i].Name(), names[i])
+			}
+		}
+	}
+}
+
+func TestOwnersPartialGlob(t *testing.T) {
+	client1 := dummy.NewDummyClient("client1", []string{"backend1"}, 0)
+	client2 := dummy.NewDummyClient("client2", []string{"backend2"}, 0)
+
+	p := NewPathCache(60)
+	p.Set("a", []types.ServerClient{client1, client2})
+
+	o := make(Owners)
+	o.Add(client1, &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{
+			{Name: "a.b*", Matches: []protov3.GlobMatch{{Path: "a.bc"}}},
+			{Name: "a.*.c.d", Matches: []protov3.GlobMatch{{Path: "a.x.c.d"}}},
+		},
+	}, 3)
+	p.Learn(o)
+
+	if res, _ := p.Route("a.y.*"); len(res) != 2 {
+		t.Errorf("got %v owners of a, expected both clients", len(res))
+	}
+	if res, _ := p.Route("a.bc.*"); len(res) != 1 || res[0] != client1 {
+		t.Errorf("got owners %v of a.bc, expected client1", res)
+	}
+}
@@ -0,0 +1,365 @@
+package pathcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/internal/ipb3"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSnapshotInterval = time.Minute
+	defaultSnapshotMaxAge   = time.Hour
+)
+
+// SnapshotEntries is amount of entries in the last saved or loaded snapshot, it should be published by the caller
+var SnapshotEntries expvar.Int
+
+// time of the last saved or loaded snapshot, unix nanoseconds
+var snapshotTime int64
+
+// SnapshotAge returns seconds since the last saved or loaded snapshot, -1 if there were none. Suitable for expvar.Func
+func SnapshotAge() interface{} {
+	t := atomic.LoadInt64(&snapshotTime)
+	if t == 0 {
+		return -1
+	}
+	return int64(time.Since(time.Unix(0, t)).Seconds())
+}
+
+type group struct {
+	cache   PathCache
+	clients []types.ServerClient
+}
+
+// groups contains path caches of all groups, so they can be saved and restored by name
+var groups = struct {
+	sync.RWMutex
+	m map[string]group
+}{
+	m: make(map[string]group),
+}
+
+// Register makes path cache of the group a part of snapshots. Group that registers with the same name replaces the old
+// one, path cache of the old group is closed
+func Register(name string, p PathCache, clients []types.ServerClient) {
+	groups.Lock()
+	old, ok := groups.m[name]
+	groups.m[name] = group{
+		cache:   p,
+		clients: clients,
+	}
+	groups.Unlock()
+
+	if ok && old.cache.lock != p.lock {
+		old.cache.Close()
+	}
+}
+
+// Unregister removes path cache of the group from snapshots and closes it. Should be called when group is removed
+func Unregister(name string) {
+	groups.Lock()
+	old, ok := groups.m[name]
+	delete(groups.m, name)
+	groups.Unlock()
+
+	if ok {
+		old.cache.Close()
+	}
+}
+
+// Stats contains size of one group's path cache
+type Stats struct {
+	Items int    `json:"items"`
+	Size  uint64 `json:"size"`
+}
+
+// AllStats returns sizes of the path caches of all registered groups
+func AllStats() map[string]Stats {
+	groups.RLock()
+	defer groups.RUnlock()
+
+	res := make(map[string]Stats, len(groups.m))
+	for name, g := range groups.m {
+		res[name] = Stats{
+			Items: g.cache.ECItems(),
+			Size:  g.cache.ECSize(),
+		}
+	}
+	return res
+}
+
+// Purge removes entries with paths accepted by match from the path cache of the group, empty group selects all of them.
+// Returns amount of removed entries by group name
+func Purge(group string, match func(path string) bool) map[string]int {
+	groups.RLock()
+	defer groups.RUnlock()
+
+	res := make(map[string]int)
+	for name, g := range groups.m {
+		if group == "" || name == group {
+			res[name] = g.cache.Purge(match)
+		}
+	}
+	return res
+}
+
+// Snapshot file is a sequence of records, each record is group name, path and marshaled ipb3.PathCacheEntry.
+// Every field is prefixed with it's length (uvarint). Record with empty path lists all the clients of the group at
+// the time of the snapshot.
+
+func writeField(w *bufio.Writer, b []byte) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(b)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func writeRecord(w *bufio.Writer, name, path string, hosts []string) error {
+	entry := ipb3.PathCacheEntry{Hosts: hosts}
+	data, err := entry.Marshal()
+	if err != nil {
+		return err
+	}
+	for _, b := range [][]byte{[]byte(name), []byte(path), data} {
+		if err := writeField(w, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readField(r *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func readRecord(r *bufio.Reader) (string, string, []string, error) {
+	var fields [3][]byte
+	for i := range fields {
+		b, err := readField(r)
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", "", nil, err
+		}
+		fields[i] = b
+	}
+	var entry ipb3.PathCacheEntry
+	if err := entry.Unmarshal(fields[2]); err != nil {
+		return "", "", nil, err
+	}
+	return string(fields[0]), string(fields[1]), entry.Hosts, nil
+}
+
+func clientNames(clients []types.ServerClient) []string {
+	res := make([]string, 0, len(clients))
+	for _, c := range clients {
+		res = append(res, c.Name())
+	}
+	return res
+}
+
+// Snapshotter saves path caches of all registered groups to a file and restores them
+type Snapshotter struct {
+	logger   *zap.Logger
+	file     string
+	interval time.Duration
+	maxAge   time.Duration
+}
+
+// NewSnapshotter creates Snapshotter, returns nil if snapshots are disabled in config
+func NewSnapshotter(logger *zap.Logger, config Config) *Snapshotter {
+	if config.SnapshotFile == "" {
+		return nil
+	}
+	s := &Snapshotter{
+		logger:   logger.With(zap.String("file", config.SnapshotFile)),
+		file:     config.SnapshotFile,
+		interval: config.SnapshotInterval,
+		maxAge:   config.SnapshotMaxAge,
+	}
+	if s.interval <= 0 {
+		s.interval = defaultSnapshotInterval
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = defaultSnapshotMaxAge
+	}
+	return s
+}
+
+// Save writes all registered path caches to the file. File is replaced atomically
+func (s *Snapshotter) Save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), filepath.Base(s.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	entries := 0
+	groups.RLock()
+	for name, g := range groups.m {
+		if err = writeRecord(w, name, "", clientNames(g.clients)); err != nil {
+			break
+		}
+		for path, clients := range g.cache.Entries() {
+			if err = writeRecord(w, name, path, clientNames(clients)); err != nil {
+				break
+			}
+			entries++
+		}
+		if err != nil {
+			break
+		}
+	}
+	groups.RUnlock()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.file); err != nil {
+		return err
+	}
+
+	SnapshotEntries.Set(int64(entries))
+	atomic.StoreInt64(&snapshotTime, time.Now().UnixNano())
+	s.logger.Debug("routing snapshot saved",
+		zap.Int("entries", entries),
+	)
+	return nil
+}
+
+// Load restores registered path caches from the file. Groups that got new clients since the snapshot are skipped, as
+// new clients can own any path. Clients that were removed are dropped from the entries.
+func (s *Snapshotter) Load() error {
+	f, err := os.Open(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if age := time.Since(info.ModTime()); age > s.maxAge {
+		s.logger.Info("routing snapshot is too old, ignoring it",
+			zap.Duration("age", age),
+			zap.Duration("max_age", s.maxAge),
+		)
+		return nil
+	}
+
+	groups.RLock()
+	defer groups.RUnlock()
+
+	// clients of the groups that are restored, nil for the skipped ones
+	restored := make(map[string]map[string]types.ServerClient)
+	entries := 0
+	r := bufio.NewReader(f)
+	for {
+		name, path, hosts, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		clients, seen := restored[name]
+		if !seen {
+			g, ok := groups.m[name]
+			if ok && path == "" {
+				clients = validClients(g.clients, hosts)
+			}
+			if clients == nil {
+				s.logger.Info("group is unknown or it's clients have changed since the snapshot, not restoring it",
+					zap.String("group", name),
+				)
+			}
+			restored[name] = clients
+			continue
+		}
+		if clients == nil {
+			continue
+		}
+
+		owners := make([]types.ServerClient, 0, len(hosts))
+		for _, h := range hosts {
+			if c, ok := clients[h]; ok {
+				owners = append(owners, c)
+			}
+		}
+		if len(owners) > 0 {
+			cache := groups.m[name].cache
+			cache.Set(path, owners)
+			entries++
+		}
+	}
+
+	SnapshotEntries.Set(int64(entries))
+	atomic.StoreInt64(&snapshotTime, info.ModTime().UnixNano())
+	s.logger.Info("routing snapshot loaded",
+		zap.Int("entries", entries),
+	)
+	return nil
+}
+
+// validClients returns current clients by name, if all of them existed at the time of the snapshot
+func validClients(current []types.ServerClient, hosts []string) map[string]types.ServerClient {
+	known := make(map[string]struct{}, len(hosts))
+	for _, h := range hosts {
+		known[h] = struct{}{}
+	}
+	res := make(map[string]types.ServerClient, len(current))
+	for _, c := range current {
+		if _, ok := known[c.Name()]; !ok {
+			return nil
+		}
+		res[c.Name()] = c
+	}
+	return res
+}
+
+// Run saves snapshots periodically
+func (s *Snapshotter) Run() {
+	for range time.Tick(s.interval) {
+		if err := s.Save(); err != nil {
+			s.logger.Error("failed to save routing snapshot",
+				zap.Error(err),
+			)
+		}
+	}
+}
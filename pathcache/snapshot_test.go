@@ -0,0 +1,61 @@
+package pathcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-graphite/carbonzipper/zipper/dummy"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+
+	"go.uber.org/zap"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pathcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client1 := dummy.NewDummyClient("client1", []string{"backend1"}, 0)
+	client2 := dummy.NewDummyClient("client2", []string{"backend2"}, 0)
+	client3 := dummy.NewDummyClient("client3", []string{"backend3"}, 0)
+
+	p1 := NewPathCache(60)
+	p1.Set("a", []types.ServerClient{client1, client2})
+	p1.Set("a.b.c", []types.ServerClient{client2})
+	Register("TestSnapshot1", p1, []types.ServerClient{client1, client2})
+	p2 := NewPathCache(60)
+	p2.Set("x", []types.ServerClient{client1})
+	Register("TestSnapshot2", p2, []types.ServerClient{client1})
+
+	s := NewSnapshotter(zap.NewNop(), Config{SnapshotFile: filepath.Join(dir, "routing")})
+	if err := s.Save(); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	// client1 was removed from the first group, second group got a new client
+	r1 := NewPathCache(60)
+	Register("TestSnapshot1", r1, []types.ServerClient{client2})
+	r2 := NewPathCache(60)
+	Register("TestSnapshot2", r2, []types.ServerClient{client1, client3})
+
+	if err := s.Load(); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+
+	entries := r1.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("got entries %v, expected 2", entries)
+	}
+	for _, path := range []string{"a", "a.b.c"} {
+		if len(entries[path]) != 1 || entries[path][0] != client2 {
+			t.Errorf("path %v: got owners %v, expected only client2", path, entries[path])
+		}
+	}
+	if items := r2.ECItems(); items != 0 {
+		t.Errorf("group with new clients was restored: %v", r2.Entries())
+	}
+}
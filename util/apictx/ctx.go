@@ -8,9 +8,17 @@ import (
 type key int
 
 const (
-	ctxHeaderUUID = "X-CTX-CarbonAPI-UUID"
+	ctxHeaderUUID     = "X-CTX-CarbonAPI-UUID"
+	ctxHeaderPriority = "X-CTX-CarbonAPI-Priority"
 
-	uuidKey key = 0
+	uuidKey     key = 0
+	priorityKey key = 1
+)
+
+// Valid values of priority header. Requests without it are treated as interactive ones
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
 )
 
 func ifaceToString(v interface{}) string {
@@ -32,12 +40,23 @@ func SetUUID(ctx context.Context, v string) context.Context {
 	return context.WithValue(ctx, uuidKey, v)
 }
 
+func GetPriority(ctx context.Context) string {
+	return getCtxString(ctx, priorityKey)
+}
+
+func SetPriority(ctx context.Context, v string) context.Context {
+	return context.WithValue(ctx, priorityKey, v)
+}
+
 func ParseCtx(h http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		uuid := req.Header.Get(ctxHeaderUUID)
 
 		ctx := req.Context()
 		ctx = SetUUID(ctx, uuid)
+		if priority := req.Header.Get(ctxHeaderPriority); priority != "" {
+			ctx = SetPriority(ctx, priority)
+		}
 
 		h.ServeHTTP(rw, req.WithContext(ctx))
 	})
@@ -45,6 +64,9 @@ func ParseCtx(h http.HandlerFunc) http.HandlerFunc {
 
 func MarshalCtx(ctx context.Context, response *http.Request) *http.Request {
 	response.Header.Add(ctxHeaderUUID, GetUUID(ctx))
+	if priority := GetPriority(ctx); priority != "" {
+		response.Header.Add(ctxHeaderPriority, priority)
+	}
 
 	return response
-}
\ No newline at end of file
+}
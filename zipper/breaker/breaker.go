@@ -0,0 +1,265 @@
+package breaker
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultErrorRate        = 0.5
+	defaultMinRequests      = 20
+	defaultWindow           = 10 * time.Second
+	defaultOpenTime         = 30 * time.Second
+	defaultHalfOpenRequests = 1
+)
+
+// State of the circuit breaker
+type State int
+
+const (
+	// Closed circuit passes all requests
+	Closed State = iota
+	// Open circuit rejects all requests
+	Open
+	// HalfOpen circuit passes limited amount of trial requests
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Outcome of the request
+type Outcome int
+
+const (
+	// Success means that server replied
+	Success Outcome = iota
+	// Failure means that server failed to reply
+	Failure
+	// Ignored requests were cancelled and say nothing about server's health
+	Ignored
+)
+
+// Counters of state transitions for all breakers, they should be published by the caller
+var (
+	Opened     expvar.Int
+	HalfOpened expvar.Int
+	Reclosed   expvar.Int
+)
+
+var breakers = struct {
+	sync.RWMutex
+	m map[string]*Breaker
+}{
+	m: make(map[string]*Breaker),
+}
+
+// ForServer returns circuit breaker for the server. All groups that use the same server with the same settings share
+// the breaker. Breaker of the new server is registered right away, while breaker that replaces the one with different
+// settings is registered only by Register, so groups that are not in use yet don't affect the current ones
+func ForServer(logger *zap.Logger, server string, config types.CircuitBreaker) *Breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	b := New(logger, server, config)
+	if old, ok := breakers.m[server]; ok {
+		if old.config == b.config {
+			return old
+		}
+		return b
+	}
+	breakers.m[server] = b
+	return b
+}
+
+// Register makes the breaker the one of it's server, replacing breaker with the old settings
+func Register(b *Breaker) {
+	breakers.Lock()
+	breakers.m[b.server] = b
+	breakers.Unlock()
+}
+
+// Unregister removes breaker of the server. Should be called when server is removed from all the groups
+func Unregister(server string) {
+	breakers.Lock()
+	delete(breakers.m, server)
+	breakers.Unlock()
+}
+
+// Lookup returns circuit breaker for the server or nil if server doesn't have one
+func Lookup(server string) *Breaker {
+	breakers.RLock()
+	defer breakers.RUnlock()
+
+	return breakers.m[server]
+}
+
+// States returns current state of all breakers, suitable for expvar.Func
+func States() interface{} {
+	breakers.RLock()
+	defer breakers.RUnlock()
+
+	res := make(map[string]string, len(breakers.m))
+	for s, b := range breakers.m {
+		res[s] = b.State().String()
+	}
+	return res
+}
+
+// Breaker is a circuit breaker for one server
+type Breaker struct {
+	sync.Mutex
+	server string
+	config types.CircuitBreaker
+	logger *zap.Logger
+
+	state       State
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	trials         int
+	trialSuccesses int
+}
+
+// New creates circuit breaker in closed state
+func New(logger *zap.Logger, server string, config types.CircuitBreaker) *Breaker {
+	if config.ErrorRate <= 0 || config.ErrorRate > 1 {
+		config.ErrorRate = defaultErrorRate
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultMinRequests
+	}
+	if config.Window <= 0 {
+		config.Window = defaultWindow
+	}
+	if config.OpenTime <= 0 {
+		config.OpenTime = defaultOpenTime
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = defaultHalfOpenRequests
+	}
+
+	return &Breaker{
+		server:      server,
+		config:      config,
+		logger:      logger.With(zap.String("type", "circuitBreaker"), zap.String("server", server)),
+		windowStart: time.Now(),
+	}
+}
+
+// setState must be called with lock held
+func (b *Breaker) setState(state State, now time.Time) {
+	if b.state == state {
+		return
+	}
+	b.logger.Info("circuit breaker state changed",
+		zap.Stringer("from", b.state),
+		zap.Stringer("to", state),
+		zap.Int("requests", b.requests),
+		zap.Int("failures", b.failures),
+	)
+	b.state = state
+
+	switch state {
+	case Open:
+		Opened.Add(1)
+		b.openedAt = now
+	case HalfOpen:
+		HalfOpened.Add(1)
+		b.trials = 0
+		b.trialSuccesses = 0
+	case Closed:
+		Reclosed.Add(1)
+	}
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// state must be called with lock held
+func (b *Breaker) currentState(now time.Time) State {
+	if b.state == Open && now.Sub(b.openedAt) >= b.config.OpenTime {
+		b.setState(HalfOpen, now)
+	}
+	return b.state
+}
+
+// State returns current state of the breaker
+func (b *Breaker) State() State {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.currentState(time.Now())
+}
+
+// Allow returns true if request can be sent to the server. Every allowed request must be reported
+func (b *Breaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.currentState(time.Now()) {
+	case Open:
+		return false
+	case HalfOpen:
+		if b.trials >= b.config.HalfOpenRequests {
+			return false
+		}
+		b.trials++
+	}
+	return true
+}
+
+// Report records outcome of the allowed request
+func (b *Breaker) Report(outcome Outcome, latency time.Duration) {
+	if outcome == Success && b.config.LatencyThreshold > 0 && latency > b.config.LatencyThreshold {
+		outcome = Failure
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	switch b.currentState(now) {
+	case HalfOpen:
+		switch outcome {
+		case Ignored:
+			b.trials--
+		case Failure:
+			b.setState(Open, now)
+		case Success:
+			b.trialSuccesses++
+			if b.trialSuccesses >= b.config.HalfOpenRequests {
+				b.setState(Closed, now)
+			}
+		}
+	case Closed:
+		if outcome == Ignored {
+			return
+		}
+		if now.Sub(b.windowStart) > b.config.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+		b.requests++
+		if outcome == Failure {
+			b.failures++
+		}
+		if b.requests >= b.config.MinRequests && float64(b.failures) >= b.config.ErrorRate*float64(b.requests) {
+			b.setState(Open, now)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	"go.uber.org/zap"
+)
+
+func TestBreaker(t *testing.T) {
+	b := New(zap.NewNop(), "server", types.CircuitBreaker{
+		ErrorRate:        0.5,
+		LatencyThreshold: time.Second,
+		MinRequests:      4,
+		OpenTime:         50 * time.Millisecond,
+	})
+
+	for _, o := range []Outcome{Success, Failure, Ignored, Success} {
+		if !b.Allow() {
+			t.Fatalf("closed circuit should allow requests")
+		}
+		b.Report(o, time.Millisecond)
+	}
+	if b.State() != Closed {
+		t.Fatalf("circuit shouldn't open before minRequests, state: %v", b.State())
+	}
+
+	// Slow request is counted as failure
+	b.Report(Success, 2*time.Second)
+	if b.State() != Open {
+		t.Fatalf("circuit should be open, state: %v", b.State())
+	}
+	if b.Allow() {
+		t.Fatalf("open circuit shouldn't allow requests")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("half-open circuit should allow trial request")
+	}
+	if b.Allow() {
+		t.Fatalf("half-open circuit should allow only one trial request")
+	}
+	b.Report(Failure, time.Millisecond)
+	if b.State() != Open {
+		t.Fatalf("failed trial should open circuit, state: %v", b.State())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("half-open circuit should allow trial request")
+	}
+	b.Report(Ignored, 0)
+	if !b.Allow() {
+		t.Fatalf("cancelled trial request should free it's slot")
+	}
+	b.Report(Success, time.Millisecond)
+	if b.State() != Closed {
+		t.Fatalf("successful trial should close circuit, state: %v", b.State())
+	}
+}
+
+func TestForServer(t *testing.T) {
+	server := "TestForServer"
+	b := ForServer(zap.NewNop(), server, types.CircuitBreaker{})
+	if Lookup(server) != b {
+		t.Fatal("breaker of the new server should be registered")
+	}
+	if ForServer(zap.NewNop(), server, types.CircuitBreaker{ErrorRate: defaultErrorRate}) != b {
+		t.Error("breaker with the same settings should be shared")
+	}
+
+	changed := ForServer(zap.NewNop(), server, types.CircuitBreaker{ErrorRate: 0.1})
+	if changed == b {
+		t.Fatal("breaker with changed settings should be a new one")
+	}
+	if Lookup(server) != b {
+		t.Error("breaker with changed settings shouldn't replace the old one before it's registered")
+	}
+	Register(changed)
+	if Lookup(server) != changed {
+		t.Error("registered breaker should replace the old one")
+	}
+
+	Unregister(server)
+	if Lookup(server) != nil {
+		t.Error("breaker of the removed server should be unregistered")
+	}
+}
@@ -2,13 +2,18 @@ package broadcast
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-graphite/carbonzipper/limiter"
 	"github.com/go-graphite/carbonzipper/pathcache"
+	"github.com/go-graphite/carbonzipper/zipper/breaker"
 	"github.com/go-graphite/carbonzipper/zipper/cache"
 	"github.com/go-graphite/carbonzipper/zipper/errors"
+	"github.com/go-graphite/carbonzipper/zipper/hashring"
 	"github.com/go-graphite/carbonzipper/zipper/types"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
 
@@ -16,7 +21,7 @@ import (
 )
 
 type BroadcastGroup struct {
-	limiter   *limiter.ServerLimiter
+	limiter   limiter.ServerLimiter
 	groupName string
 	timeout   types.Timeouts
 	clients   []types.ServerClient
@@ -25,10 +30,22 @@ type BroadcastGroup struct {
 	pathCache pathcache.PathCache
 	logger    *zap.Logger
 
+	// Only set for consistent hashing groups
+	hashRing          *hashring.Ring
+	replicationFactor int
+	clientsByName     map[string]types.ServerClient
+
+	// Only set for quorum groups
+	quorum int
+
 	infoCache  *cache.QueryCache
 	findCache  *cache.QueryCache
 	fetchCache *cache.QueryCache
 	probeCache *cache.QueryCache
+	// second-level cache for find and fetch responses, nil if disabled
+	sharedCache *cache.SharedCache
+	// fetched data in time chunks, nil if disabled
+	chunkCache *cache.ChunkCache
 }
 
 func NewBroadcastGroup(logger *zap.Logger, groupName string, servers []types.ServerClient, expireDelaySec int32, concurencyLimit int, timeout types.Timeouts) (*BroadcastGroup, *errors.Errors) {
@@ -45,7 +62,18 @@ func NewBroadcastGroup(logger *zap.Logger, groupName string, servers []types.Ser
 	return NewBroadcastGroupWithLimiter(logger, groupName, servers, serverNames, pathCache, limiter, timeout)
 }
 
-func NewBroadcastGroupWithLimiter(logger *zap.Logger, groupName string, servers []types.ServerClient, serverNames []string, pathCache pathcache.PathCache, limiter *limiter.ServerLimiter, timeout types.Timeouts) (*BroadcastGroup, *errors.Errors) {
+func newQueryCache(c *types.QueryCache) *cache.QueryCache {
+	if c.Disabled {
+		return nil
+	}
+	q := cache.NewQueryCache(c.Size, c.TTL)
+	q.SetNegativeTTL(c.EmptyTTL, c.ErrorTTL)
+	q.SetStaleTTL(c.StaleTTL, c.Revalidate)
+	return q
+}
+
+func NewBroadcastGroupWithLimiter(logger *zap.Logger, groupName string, servers []types.ServerClient, serverNames []string, pathCache pathcache.PathCache, limiter limiter.ServerLimiter, timeout types.Timeouts) (*BroadcastGroup, *errors.Errors) {
+	caches := types.DefaultQueryCaches
 	b := &BroadcastGroup{
 		timeout:   timeout,
 		groupName: groupName,
@@ -56,11 +84,10 @@ func NewBroadcastGroupWithLimiter(logger *zap.Logger, groupName string, servers
 		pathCache: pathCache,
 		logger:    logger.With(zap.String("type", "broadcastGroup"), zap.String("groupName", groupName)),
 
-		// TODO: remove hardcode
-		infoCache:  cache.NewQueryCache(1024, 5),
-		findCache:  cache.NewQueryCache(1024, 5),
-		fetchCache: cache.NewQueryCache(25600, 1),
-		probeCache: cache.NewQueryCache(1024, 10),
+		infoCache:  newQueryCache(caches.Info),
+		findCache:  newQueryCache(caches.Find),
+		fetchCache: newQueryCache(caches.Fetch),
+		probeCache: newQueryCache(caches.Probe),
 	}
 
 	b.logger.Debug("created broadcast group",
@@ -71,6 +98,88 @@ func NewBroadcastGroupWithLimiter(logger *zap.Logger, groupName string, servers
 	return b, nil
 }
 
+// NewBroadcastGroupWithHashRing creates group that sends fetch requests only to the servers that own the metrics according to the ring.
+// Find, Info, List and Stats requests are still sent to all servers.
+func NewBroadcastGroupWithHashRing(logger *zap.Logger, groupName string, servers []types.ServerClient, ring *hashring.Ring, replicationFactor int, expireDelaySec int32, concurencyLimit int, timeout types.Timeouts) (*BroadcastGroup, *errors.Errors) {
+	if ring == nil {
+		return nil, errors.Fatal("no hash ring specified")
+	}
+	if replicationFactor <= 0 {
+		replicationFactor = 1
+	}
+
+	b, e := NewBroadcastGroup(logger, groupName, servers, expireDelaySec, concurencyLimit, timeout)
+	if e != nil && e.HaveFatalErrors {
+		return nil, e
+	}
+
+	b.hashRing = ring
+	b.replicationFactor = replicationFactor
+	b.clientsByName = make(map[string]types.ServerClient, len(servers))
+	for _, s := range servers {
+		b.clientsByName[s.Name()] = s
+	}
+
+	return b, e
+}
+
+// NewBroadcastGroupWithQuorum creates group of replicas, that replies to fetch requests as soon as quorum of them answered successfully.
+// Requests to the rest of the replicas are cancelled.
+func NewBroadcastGroupWithQuorum(logger *zap.Logger, groupName string, servers []types.ServerClient, replicas, quorum int, expireDelaySec int32, concurencyLimit int, timeout types.Timeouts) (*BroadcastGroup, *errors.Errors) {
+	if replicas == 0 {
+		replicas = len(servers)
+	}
+	if replicas != len(servers) {
+		return nil, errors.Fatalf("group have %v servers, but %v replicas specified", len(servers), replicas)
+	}
+	if quorum <= 0 || quorum > replicas {
+		return nil, errors.Fatalf("quorum should be between 1 and %v, got %v", replicas, quorum)
+	}
+
+	b, e := NewBroadcastGroup(logger, groupName, servers, expireDelaySec, concurencyLimit, timeout)
+	if e != nil && e.HaveFatalErrors {
+		return nil, e
+	}
+
+	b.quorum = quorum
+
+	return b, e
+}
+
+// SetQueryCaches replaces query caches of the group with the configured ones. Should be called before the group is used
+func (bg *BroadcastGroup) SetQueryCaches(caches types.QueryCaches) {
+	bg.infoCache = newQueryCache(caches.Info)
+	bg.findCache = newQueryCache(caches.Find)
+	bg.fetchCache = newQueryCache(caches.Fetch)
+	bg.probeCache = newQueryCache(caches.Probe)
+}
+
+// Register publishes query caches and path cache of the group, replacing the ones of the old group with the same name,
+// and registers the clients of the group
+func (bg *BroadcastGroup) Register() {
+	pathcache.Register(bg.groupName, bg.pathCache, bg.clients)
+	cache.Register(bg.groupName, map[string]*cache.QueryCache{
+		"info":  bg.infoCache,
+		"find":  bg.findCache,
+		"fetch": bg.fetchCache,
+		"probe": bg.probeCache,
+	})
+	for _, c := range bg.clients {
+		types.Register(c)
+	}
+}
+
+// SetSharedCache makes group consult shared cache for find and fetch responses, that are not in it's own caches
+func (bg *BroadcastGroup) SetSharedCache(c *cache.SharedCache) {
+	bg.sharedCache = c
+}
+
+// SetChunkCache makes group serve fetch requests from cached time chunks, so only the missing part of the time range
+// is fetched from backends
+func (bg *BroadcastGroup) SetChunkCache(c *cache.ChunkCache) {
+	bg.chunkCache = c
+}
+
 func (bg BroadcastGroup) Name() string {
 	return bg.groupName
 }
@@ -79,16 +188,22 @@ func (bg BroadcastGroup) Backends() []string {
 	return bg.servers
 }
 
+// chooseServers returns clients that own the longest known prefixes of all requests. If at least one of the requests
+// can't be routed, request is sent to all clients.
 func (bg *BroadcastGroup) chooseServers(requests []string) []types.ServerClient {
 	var res []types.ServerClient
+	seen := make(map[string]struct{})
 
 	for _, request := range requests {
-		idx := strings.Index(request, ".")
-		if idx > 0 {
-			request = request[:idx]
+		clients, ok := bg.pathCache.Route(request)
+		if !ok {
+			return bg.clients
 		}
-		if clients, ok := bg.pathCache.Get(request); ok && len(clients) > 0 {
-			res = append(res, clients...)
+		for _, client := range clients {
+			if _, ok := seen[client.Name()]; !ok {
+				seen[client.Name()] = struct{}{}
+				res = append(res, client)
+			}
 		}
 	}
 
@@ -98,6 +213,100 @@ func (bg *BroadcastGroup) chooseServers(requests []string) []types.ServerClient
 	return bg.clients
 }
 
+// withoutDrained removes replicas with weight 0, unless all of them are drained
+func (bg *BroadcastGroup) withoutDrained(servers []string) []string {
+	if types.ServerWeights.Uniform(bg.groupName) {
+		return servers
+	}
+
+	res := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if types.ServerWeights.Get(bg.groupName, s) > 0 {
+			res = append(res, s)
+		}
+	}
+	if len(res) == 0 {
+		return servers
+	}
+	return res
+}
+
+// circuitOpen returns true if client talks to a single server and that server's circuit breaker is open
+func circuitOpen(client types.ServerClient) bool {
+	b := breaker.Lookup(client.Name())
+	return b != nil && b.State() == breaker.Open
+}
+
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[{")
+}
+
+// splitRequestByOwner expands globs and splits request into separate requests for each server that owns the metrics.
+func (bg *BroadcastGroup) splitRequestByOwner(ctx context.Context, logger *zap.Logger, request *protov3.MultiFetchRequest) ([]types.ServerClient, []*protov3.MultiFetchRequest) {
+	requests := make(map[string]*protov3.MultiFetchRequest)
+	var clientNames []string
+
+	addMetric := func(metric protov3.FetchRequest) {
+		for _, name := range bg.withoutDrained(bg.hashRing.GetNodes(metric.Name, bg.replicationFactor)) {
+			r, ok := requests[name]
+			if !ok {
+				r = &protov3.MultiFetchRequest{}
+				requests[name] = r
+				clientNames = append(clientNames, name)
+			}
+			r.Metrics = append(r.Metrics, metric)
+		}
+	}
+
+	for _, metric := range request.Metrics {
+		if metric.PathExpression == "" {
+			metric.PathExpression = metric.Name
+		}
+		if !isGlob(metric.Name) {
+			addMetric(metric)
+			continue
+		}
+
+		f, _, e := bg.Find(ctx, &protov3.MultiGlobRequest{Metrics: []string{metric.Name}})
+		if (e != nil && e.HaveFatalErrors && len(e.Errors) > 0) || f == nil {
+			logger.Debug("failed to expand glob",
+				zap.String("metric", metric.Name),
+			)
+			continue
+		}
+		for _, m := range f.Metrics {
+			for _, match := range m.Matches {
+				if !match.IsLeaf {
+					continue
+				}
+				newMetric := metric
+				newMetric.Name = match.Path
+				addMetric(newMetric)
+			}
+		}
+	}
+
+	clients := make([]types.ServerClient, 0, len(clientNames))
+	res := make([]*protov3.MultiFetchRequest, 0, len(clientNames))
+	for _, name := range clientNames {
+		client, ok := bg.clientsByName[name]
+		if !ok {
+			logger.Warn("hash ring points to unknown server",
+				zap.String("server", name),
+			)
+			continue
+		}
+		clients = append(clients, client)
+		res = append(res, requests[name])
+	}
+
+	logger.Debug("splitted request by owner",
+		zap.Strings("servers", clientNames),
+	)
+
+	return clients, res
+}
+
 func (bg BroadcastGroup) MaxMetricsPerRequest() int {
 	return 0
 }
@@ -111,18 +320,35 @@ func fetchRequestToKey(prefix string, request *protov3.MultiFetchRequest) string
 	return string(key)
 }
 
+// doSingleFetch sends the request to the client, split by MaxMetricsPerRequest, and passes every response to resCh.
+// Caller stops reading the channels once it has enough responses or gave up, and cancels ctx then
 func (bg *BroadcastGroup) doSingleFetch(ctx context.Context, logger *zap.Logger, client types.ServerClient, request *protov3.MultiFetchRequest, doneCh chan<- string, resCh chan<- *types.ServerFetchResponse) {
+	send := func(r *types.ServerFetchResponse) {
+		select {
+		case resCh <- r:
+		case <-ctx.Done():
+		}
+	}
+	done := func() {
+		select {
+		case doneCh <- client.Name():
+		case <-ctx.Done():
+		}
+	}
+
 	logger.Debug("waiting for slot",
 		zap.Int("maxConns", bg.limiter.Capacity()),
 	)
 	err := bg.limiter.Enter(ctx, client.Name())
 	if err != nil {
-		logger.Debug("timeout waiting for a slot")
-		resCh <- &types.ServerFetchResponse{
+		logger.Debug("timeout waiting for a slot",
+			zap.Error(err),
+		)
+		send(&types.ServerFetchResponse{
 			Server: client.Name(),
 			Err:    errors.FromErrNonFatal(err),
-		}
-		doneCh <- client.Name()
+		})
+		done()
 		return
 	}
 	logger.Debug("got slot")
@@ -137,6 +363,8 @@ func (bg *BroadcastGroup) doSingleFetch(ctx context.Context, logger *zap.Logger,
 		logger.Debug("will do my best to split request",
 			zap.Int("max_metrics", maxMetricPerRequest),
 		)
+		guardrails := types.GuardrailsFromContext(ctx)
+		expanded := 0
 		for _, metric := range request.Metrics {
 			f, _, e := bg.Find(ctx, &protov3.MultiGlobRequest{Metrics: []string{metric.Name}})
 			if (e != nil && e.HaveFatalErrors && len(e.Errors) > 0) || f == nil || len(f.Metrics) == 0 {
@@ -148,6 +376,20 @@ func (bg *BroadcastGroup) doSingleFetch(ctx context.Context, logger *zap.Logger,
 				zap.Int("metrics", len(f.Metrics)),
 				zap.Int("max_metrics", maxMetricPerRequest),
 			)
+			for _, m := range f.Metrics {
+				expanded += len(m.Matches)
+			}
+			if e := guardrails.CheckMetrics(expanded); e != nil {
+				logger.Warn("too many metrics after expanding globs",
+					zap.Error(e),
+				)
+				send(&types.ServerFetchResponse{
+					Server: client.Name(),
+					Err:    errors.FromErr(e),
+				})
+				done()
+				return
+			}
 			for _, m := range f.Metrics {
 				for _, match := range m.Matches {
 					newRequest.Metrics = append(newRequest.Metrics, protov3.FetchRequest{
@@ -180,9 +422,9 @@ func (bg *BroadcastGroup) doSingleFetch(ctx context.Context, logger *zap.Logger,
 			Server: client.Name(),
 		}
 		r.Response, r.Stats, r.Err = client.Fetch(ctx, req)
-		resCh <- r
+		send(r)
 	}
-	doneCh <- client.Name()
+	done()
 }
 
 func (bg *BroadcastGroup) Fetch(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, *errors.Errors) {
@@ -194,7 +436,20 @@ func (bg *BroadcastGroup) Fetch(ctx context.Context, request *protov3.MultiFetch
 	logger.Debug("will try to fetch data")
 
 	key := fetchRequestToKey(bg.groupName, request)
+	if types.NegativeCacheBypassed(ctx) {
+		bg.fetchCache.ForgetNegative(key)
+	}
 	item := bg.fetchCache.GetQueryItem(key)
+	if stale, refresh, ok := item.Revalidate(); ok {
+		logger.Debug("serving stale response",
+			zap.Bool("refresh", refresh),
+		)
+		if refresh {
+			go bg.fetchAndStore(valuesOnlyContext{ctx}, logger, request, key, item)
+		}
+		result := stale.(*types.ServerFetchResponse)
+		return result.Response, staleStats(result.Stats), nil
+	}
 	res, ok := item.FetchOrLock(ctx)
 	if ok {
 		if res == nil {
@@ -202,19 +457,132 @@ func (bg *BroadcastGroup) Fetch(ctx context.Context, request *protov3.MultiFetch
 		}
 		logger.Debug("cache hit")
 		result := res.(*types.ServerFetchResponse)
+		if result.Response == nil || item.Failed() {
+			return result.Response, result.Stats, result.Err
+		}
 		return result.Response, result.Stats, nil
 	}
+
+	response, stats, err := bg.fetchAndStore(ctx, logger, request, key, item)
+	if response == nil && err != nil && types.LimitExceeded(err.Errors) == nil {
+		if stale, ok := item.Stale(); ok {
+			logger.Warn("failed to fetch response, serving stale one",
+				zap.Any("errors", err.Errors),
+			)
+			result := stale.(*types.ServerFetchResponse)
+			return result.Response, staleStats(result.Stats), nil
+		}
+	}
+	return response, stats, err
+}
+
+// staleStats returns copy of the stats of the cached response, that marks it as stale
+func staleStats(stats *types.Stats) *types.Stats {
+	res := &types.Stats{}
+	if stats != nil {
+		*res = *stats
+	}
+	res.StaleResponses++
+	return res
+}
+
+// fetchAndStore fetches response for the locked cache item and stores it. Item is unlocked in any case
+func (bg *BroadcastGroup) fetchAndStore(ctx context.Context, logger *zap.Logger, request *protov3.MultiFetchRequest, key string, item *cache.QueryItem) (*protov3.MultiFetchResponse, *types.Stats, *errors.Errors) {
 	defer item.StoreAbort()
 
+	if response, ok := bg.sharedCache.GetFetch(key); ok {
+		logger.Debug("shared cache hit")
+		result := &types.ServerFetchResponse{
+			Response: response,
+			Stats:    &types.Stats{},
+		}
+		item.StoreAndUnlock(result, uint64(response.Size()))
+		return result.Response, result.Stats, nil
+	}
+
 	// Now we have global lock for fetching data for this metric
+	plan := bg.chunkCache.Plan(bg.groupName, request, time.Now())
+	stats := &types.Stats{}
+	var err errors.Errors
+	var fetched *protov3.MultiFetchResponse
+	if len(plan.Missing.Metrics) > 0 {
+		var s *types.Stats
+		var e *errors.Errors
+		fetched, s, e = bg.fetchFromBackends(ctx, logger, plan.Missing)
+		stats.Merge(s)
+		err.Merge(e)
+		if err.HaveFatalErrors {
+			return nil, stats, &err
+		}
+	} else {
+		logger.Debug("chunk cache hit")
+	}
+
+	response, retry := plan.Complete(fetched, &err)
+	if len(retry.Metrics) > 0 {
+		logger.Debug("cached chunks can't be merged with fetched data, fetching whole time range",
+			zap.Int("metrics", len(retry.Metrics)),
+		)
+		r, s, e := bg.fetchFromBackends(ctx, logger, retry)
+		stats.Merge(s)
+		err.Merge(e)
+		if err.HaveFatalErrors {
+			return nil, stats, &err
+		}
+		if r != nil {
+			response.Metrics = append(response.Metrics, r.Metrics...)
+		}
+	}
+
+	if len(response.Metrics) == 0 {
+		logger.Error("failed to get any response")
+
+		// Response without errors means that backends don't have the metrics
+		failed := len(err.Errors) > 0
+		err.Addf("failed to get any response from backend group: %v", bg.groupName)
+		// Stale response is better than cached failure
+		if !failed || !item.HasStale() {
+			stored := err
+			item.StoreNegativeAndUnlock(&types.ServerFetchResponse{Err: &stored}, failed)
+		}
+		return nil, nil, &err
+	}
+
+	result := &types.ServerFetchResponse{
+		Response: response,
+		Stats:    stats,
+	}
+	item.StoreAndUnlock(result, uint64(result.Response.Size()))
+	// Partial responses are not shared
+	if len(err.Errors) == 0 {
+		bg.sharedCache.SetFetch(key, result.Response)
+	}
+
+	return result.Response, result.Stats, &err
+}
+
+// fetchFromBackends sends request to the clients, that own the metrics, and merges their responses
+func (bg *BroadcastGroup) fetchFromBackends(ctx context.Context, logger *zap.Logger, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, *errors.Errors) {
+	requestNames := make([]string, 0, len(request.Metrics))
+	for i := range request.Metrics {
+		requestNames = append(requestNames, request.Metrics[i].Name)
+	}
+
 	resCh := make(chan *types.ServerFetchResponse, len(bg.clients))
 	doneCh := make(chan string, len(bg.clients))
 	ctx, cancel := context.WithTimeout(ctx, bg.timeout.Render)
 	defer cancel()
 
-	clients := bg.chooseServers(requestNames)
-	for _, client := range clients {
-		go bg.doSingleFetch(ctx, logger, client, request, doneCh, resCh)
+	var clients []types.ServerClient
+	var requests []*protov3.MultiFetchRequest
+	if bg.hashRing != nil {
+		clients, requests = bg.splitRequestByOwner(ctx, logger, request)
+	} else {
+		clients = bg.chooseServers(requestNames)
+		requests = make([]*protov3.MultiFetchRequest, len(clients))
+		for i := range requests {
+			requests[i] = request
+		}
 	}
 
 	result := &types.ServerFetchResponse{
@@ -225,13 +593,54 @@ func (bg *BroadcastGroup) Fetch(ctx context.Context, request *protov3.MultiFetch
 		Err:          &errors.Errors{},
 	}
 	var err errors.Errors
+
+	running := make([]types.ServerClient, 0, len(clients))
+	for i, client := range clients {
+		if circuitOpen(client) {
+			result.Stats.FailedServers = append(result.Stats.FailedServers, client.Name())
+			err.Add(errors.ErrCircuitOpen)
+			continue
+		}
+		running = append(running, client)
+		go bg.doSingleFetch(ctx, logger, client, requests[i], doneCh, resCh)
+	}
+	clients = running
 	answeredServers := make(map[string]struct{})
+	failedServers := make(map[string]struct{})
 	responseCounts := 0
+	guardrails := types.GuardrailsFromContext(ctx)
+	quorum := bg.quorum
 GATHER:
 	for {
+		// Replicas with open circuit count as failed ones, so request fails as soon as the rest can't reach quorum
+		if quorum > 0 && len(clients)-len(failedServers) < quorum {
+			logger.Warn("not enough replicas to reach quorum, cancelling the rest of requests",
+				zap.Int("quorum", quorum),
+				zap.Int("replicas", len(bg.clients)),
+				zap.Int("available", len(clients)-len(failedServers)),
+			)
+			cancel()
+			return nil, result.Stats, err.AddFatal(types.ErrQuorumNotReached)
+		}
 		if responseCounts == len(clients) && len(resCh) == 0 {
 			break GATHER
 		}
+		// Client sends all it's responses before reporting that it's done, so with empty resCh we know the outcome for all answered servers
+		if quorum > 0 && len(resCh) == 0 && len(answeredServers)-len(failedServers) >= quorum {
+			skipped := make([]string, 0, len(clients)-len(answeredServers))
+			for _, s := range clients {
+				if _, ok := answeredServers[s.Name()]; !ok {
+					skipped = append(skipped, s.Name())
+				}
+			}
+			logger.Debug("got quorum, cancelling the rest of requests",
+				zap.Int("quorum", quorum),
+				zap.Strings("skipped_servers", skipped),
+			)
+			result.Stats.SkippedServers = append(result.Stats.SkippedServers, skipped...)
+			cancel()
+			break GATHER
+		}
 		select {
 		case name := <-doneCh:
 			responseCounts++
@@ -239,8 +648,18 @@ GATHER:
 		case res := <-resCh:
 			if res.Err != nil {
 				err.Merge(res.Err)
+				if res.Err.HaveFatalErrors || (res.Response == nil && len(res.Err.Errors) > 0) {
+					failedServers[res.Server] = struct{}{}
+				}
 			}
 			result.Merge(res)
+			if e := guardrails.CheckFetchResponse(result.Response); e != nil {
+				logger.Warn("response is too big, cancelling the rest of requests",
+					zap.Error(e),
+				)
+				cancel()
+				return nil, result.Stats, err.AddFatal(e)
+			}
 		case <-ctx.Done():
 			noAnswer := make([]string, 0)
 			for _, s := range clients {
@@ -256,12 +675,6 @@ GATHER:
 		}
 	}
 
-	if len(result.Response.Metrics) == 0 {
-		logger.Error("failed to get any response")
-
-		return nil, nil, err.Addf("failed to get any response from backend group: %v", bg.groupName)
-	}
-
 	logger.Debug("got some responses",
 		zap.Int("clients_count", len(bg.clients)),
 		zap.Int("response_count", responseCounts),
@@ -270,13 +683,28 @@ GATHER:
 		zap.Int("response_count", len(result.Response.Metrics)),
 	)
 
-	item.StoreAndUnlock(result, uint64(result.Response.Size()))
-
 	return result.Response, result.Stats, &err
 }
 
 // Find request handling
 
+// valuesOnlyContext keeps values of the parent context (uuids, priority, guardrails), but not it's deadline and cancellation
+type valuesOnlyContext struct {
+	context.Context
+}
+
+func (valuesOnlyContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valuesOnlyContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valuesOnlyContext) Err() error {
+	return nil
+}
+
 func findRequestToKey(prefix string, request *protov3.MultiGlobRequest) string {
 	return "prefix=" + prefix + "&" + strings.Join(request.Metrics, "&")
 }
@@ -294,8 +722,10 @@ func (bg *BroadcastGroup) doFind(ctx context.Context, logger *zap.Logger, client
 
 	err := bg.limiter.Enter(ctx, client.Name())
 	if err != nil {
-		logger.Debug("timeout waiting for a slot")
-		r.Err = errors.FromErrNonFatal(types.ErrTimeoutExceeded)
+		logger.Debug("timeout waiting for a slot",
+			zap.Error(err),
+		)
+		r.Err = errors.FromErrNonFatal(err)
 		resCh <- r
 		return
 	}
@@ -314,7 +744,20 @@ func (bg *BroadcastGroup) Find(ctx context.Context, request *protov3.MultiGlobRe
 	logger := bg.logger.With(zap.String("type", "find"), zap.Strings("request", request.Metrics))
 
 	key := findRequestToKey(bg.groupName, request)
+	if types.NegativeCacheBypassed(ctx) {
+		bg.findCache.ForgetNegative(key)
+	}
 	item := bg.findCache.GetQueryItem(key)
+	if stale, refresh, ok := item.Revalidate(); ok {
+		logger.Debug("serving stale response",
+			zap.Bool("refresh", refresh),
+		)
+		if refresh {
+			go bg.findAndStore(valuesOnlyContext{ctx}, logger, request, key, item)
+		}
+		result := stale.(*types.ServerFindResponse)
+		return result.Response, staleStats(result.Stats), nil
+	}
 	res, ok := item.FetchOrLock(ctx)
 	if ok {
 		if res == nil {
@@ -324,29 +767,76 @@ func (bg *BroadcastGroup) Find(ctx context.Context, request *protov3.MultiGlobRe
 		logger.Debug("cache hit",
 			zap.Any("result", result),
 		)
+		if item.Failed() {
+			return result.Response, result.Stats, result.Err
+		}
 		return result.Response, result.Stats, nil
 	}
+
+	response, stats, err := bg.findAndStore(ctx, logger, request, key, item)
+	if err != nil && len(err.Errors) > 0 && (response == nil || !haveMatches(response)) && types.LimitExceeded(err.Errors) == nil {
+		if stale, ok := item.Stale(); ok {
+			logger.Warn("failed to find metrics, serving stale response",
+				zap.Any("errors", err.Errors),
+			)
+			result := stale.(*types.ServerFindResponse)
+			return result.Response, staleStats(result.Stats), nil
+		}
+	}
+	return response, stats, err
+}
+
+// findAndStore finds metrics for the locked cache item and stores the response. Item is unlocked in any case
+func (bg *BroadcastGroup) findAndStore(ctx context.Context, logger *zap.Logger, request *protov3.MultiGlobRequest, key string, item *cache.QueryItem) (*protov3.MultiGlobResponse, *types.Stats, *errors.Errors) {
 	defer item.StoreAbort()
 
+	if response, ok := bg.sharedCache.GetFind(key); ok {
+		logger.Debug("shared cache hit")
+		result := &types.ServerFindResponse{
+			Response: response,
+			Stats:    &types.Stats{},
+		}
+		item.StoreAndUnlock(result, uint64(response.Size()))
+		return result.Response, result.Stats, nil
+	}
+
 	resCh := make(chan *types.ServerFindResponse, len(bg.clients))
 
 	logger.Debug("will do query with timeout",
 		zap.Float64("timeout", bg.timeout.Find.Seconds()),
 	)
 
-	ctx, cancel := context.WithTimeout(ctx, bg.timeout.Render)
+	// Requests are not bound to the caller's deadline, but are cancelled when the response exceeds the guardrails
+	ctx, cancel := context.WithCancel(valuesOnlyContext{ctx})
 	defer cancel()
-	ctx = context.Background()
 
-	clients := bg.chooseServers(request.Metrics)
-	for _, client := range clients {
+	var err errors.Errors
+	var openCircuits []string
+	clients := make([]types.ServerClient, 0, len(bg.clients))
+	for _, client := range bg.chooseServers(request.Metrics) {
+		if circuitOpen(client) {
+			openCircuits = append(openCircuits, client.Name())
+			err.Add(errors.ErrCircuitOpen)
+			continue
+		}
+		clients = append(clients, client)
 		go bg.doFind(ctx, logger, client, request, resCh)
 	}
+	if len(clients) == 0 {
+		logger.Warn("circuit breakers are open for all servers")
+		err.HaveFatalErrors = true
+		return &protov3.MultiGlobResponse{}, &types.Stats{FailedServers: openCircuits}, err.Addf("failed to fetch response from the server %v", bg.groupName)
+	}
 
 	result := &types.ServerFindResponse{}
-	var err errors.Errors
 	responseCounts := 0
+	guardrails := types.GuardrailsFromContext(ctx)
 	answeredServers := make(map[string]struct{})
+	clientsByName := make(map[string]types.ServerClient, len(clients))
+	for _, client := range clients {
+		clientsByName[client.Name()] = client
+	}
+	owners := make(pathcache.Owners)
 GATHER:
 	for {
 		select {
@@ -356,11 +846,22 @@ GATHER:
 			if r.Err != nil {
 				err.Merge(r.Err)
 			}
+			if r.Err == nil || len(r.Err.Errors) == 0 {
+				// must be done before merge, as it modifies the response
+				owners.Add(clientsByName[r.Server], r.Response, bg.pathCache.MaxDepth())
+			}
 			if result.Response == nil {
 				result = r
 			} else {
 				result.Merge(r)
 			}
+			if e := guardrails.CheckFindResponse(result.Response); e != nil {
+				logger.Warn("response is too big, cancelling the rest of requests",
+					zap.Error(e),
+				)
+				cancel()
+				return nil, result.Stats, err.AddFatal(e)
+			}
 
 			if responseCounts == len(clients) {
 				break GATHER
@@ -387,14 +888,45 @@ GATHER:
 		zap.Any("response", result.Response),
 	)
 
+	if len(openCircuits) > 0 {
+		if result.Stats == nil {
+			result.Stats = &types.Stats{}
+		}
+		result.Stats.FailedServers = append(result.Stats.FailedServers, openCircuits...)
+	}
+
 	if result.Response == nil {
-		return &protov3.MultiGlobResponse{}, result.Stats, err.Addf("failed to fetch response from the server %v", bg.groupName)
+		err.Addf("failed to fetch response from the server %v", bg.groupName)
+		// Stale response is better than cached failure
+		if !item.HasStale() {
+			stored := err
+			item.StoreNegativeAndUnlock(&types.ServerFindResponse{Response: &protov3.MultiGlobResponse{}, Stats: result.Stats, Err: &stored}, true)
+		}
+		return &protov3.MultiGlobResponse{}, result.Stats, &err
+	}
+	// Results that found nothing are kept for their own TTL, if it's set
+	if len(err.Errors) > 0 || haveMatches(result.Response) || !item.StoreNegativeAndUnlock(result, false) {
+		item.StoreAndUnlock(result, uint64(result.Response.Size()))
+	}
+
+	// Ownership can be learned only if all servers that could have the metrics replied
+	if len(err.Errors) == 0 && responseCounts == len(clients) {
+		bg.pathCache.Learn(owners)
+		bg.sharedCache.SetFind(key, result.Response)
 	}
-	item.StoreAndUnlock(result, uint64(result.Response.Size()))
 
 	return result.Response, result.Stats, &err
 }
 
+func haveMatches(response *protov3.MultiGlobResponse) bool {
+	for i := range response.Metrics {
+		if len(response.Metrics[i].Matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // Info request handling
 
 func infoRequestToKey(prefix string, request *protov3.MultiMetricsInfoRequest) string {
@@ -411,7 +943,9 @@ func (bg *BroadcastGroup) doInfoRequest(ctx context.Context, logger *zap.Logger,
 	)
 	err := bg.limiter.Enter(ctx, client.Name())
 	if err != nil {
-		logger.Debug("timeout waiting for a slot")
+		logger.Debug("timeout waiting for a slot",
+			zap.Error(err),
+		)
 		r.Err = errors.FromErrNonFatal(err)
 		resCh <- r
 		return
@@ -497,11 +1031,188 @@ GATHER:
 	return result.Response, result.Stats, &err
 }
 
+// List request handling
+
+func (bg *BroadcastGroup) doListRequest(ctx context.Context, logger *zap.Logger, client types.ServerClient, resCh chan<- *types.ServerListResponse) {
+	r := &types.ServerListResponse{
+		Server: client.Name(),
+	}
+	logger.Debug("waiting for a slot",
+		zap.String("group_name", bg.groupName),
+		zap.String("client_name", client.Name()),
+	)
+	err := bg.limiter.Enter(ctx, client.Name())
+	if err != nil {
+		logger.Debug("timeout waiting for a slot",
+			zap.Error(err),
+		)
+		r.Err = errors.FromErrNonFatal(err)
+		resCh <- r
+		return
+	}
+	defer bg.limiter.Leave(ctx, client.Name())
+
+	logger.Debug("got a slot")
+	r.Response, r.Stats, r.Err = client.List(ctx)
+	resCh <- r
+}
+
 func (bg *BroadcastGroup) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.FromErr(types.ErrNotImplementedYet)
+	logger := bg.logger.With(zap.String("type", "list"))
+
+	resCh := make(chan *types.ServerListResponse, len(bg.clients))
+	ctx, cancel := context.WithTimeout(ctx, bg.timeout.Render)
+	defer cancel()
+
+	for _, client := range bg.clients {
+		go bg.doListRequest(ctx, logger, client, resCh)
+	}
+
+	result := &types.ServerListResponse{
+		Response: &protov3.ListMetricsResponse{},
+		Stats:    &types.Stats{},
+	}
+	var err errors.Errors
+	haveResponse := false
+	responseCounts := 0
+	answeredServers := make(map[string]struct{})
+GATHER:
+	for {
+		select {
+		case res := <-resCh:
+			answeredServers[res.Server] = struct{}{}
+			responseCounts++
+			if res.Err != nil {
+				err.Merge(res.Err)
+			}
+			if res.Response != nil {
+				haveResponse = true
+			}
+			result.Merge(res)
+
+			if responseCounts == len(bg.clients) {
+				break GATHER
+			}
+		case <-ctx.Done():
+			noAnswer := make([]string, 0)
+			for _, s := range bg.clients {
+				if _, ok := answeredServers[s.Name()]; !ok {
+					noAnswer = append(noAnswer, s.Name())
+				}
+			}
+			logger.Warn("timeout waiting for more responses",
+				zap.Strings("no_answers_from", noAnswer),
+			)
+			err.Add(types.ErrTimeoutExceeded)
+			break GATHER
+		}
+	}
+	logger.Debug("got some responses",
+		zap.Int("clients_count", len(bg.clients)),
+		zap.Int("response_count", responseCounts),
+		zap.Bool("have_errors", len(err.Errors) != 0),
+	)
+
+	if !haveResponse {
+		logger.Error("failed to get any response")
+		return nil, result.Stats, err.AddFatal(fmt.Errorf("failed to get any response from backend group: %v", bg.groupName))
+	}
+
+	sort.Strings(result.Response.Metrics)
+
+	return result.Response, result.Stats, &err
 }
+
+// Stats request handling
+
+func (bg *BroadcastGroup) doStatsRequest(ctx context.Context, logger *zap.Logger, client types.ServerClient, resCh chan<- *types.ServerStatsResponse) {
+	r := &types.ServerStatsResponse{
+		Server: client.Name(),
+	}
+	logger.Debug("waiting for a slot",
+		zap.String("group_name", bg.groupName),
+		zap.String("client_name", client.Name()),
+	)
+	err := bg.limiter.Enter(ctx, client.Name())
+	if err != nil {
+		logger.Debug("timeout waiting for a slot",
+			zap.Error(err),
+		)
+		r.Err = errors.FromErrNonFatal(err)
+		resCh <- r
+		return
+	}
+	defer bg.limiter.Leave(ctx, client.Name())
+
+	logger.Debug("got a slot")
+	r.Response, r.Stats, r.Err = client.Stats(ctx)
+	resCh <- r
+}
+
 func (bg *BroadcastGroup) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.FromErr(types.ErrNotImplementedYet)
+	logger := bg.logger.With(zap.String("type", "stats"))
+
+	resCh := make(chan *types.ServerStatsResponse, len(bg.clients))
+	ctx, cancel := context.WithTimeout(ctx, bg.timeout.Render)
+	defer cancel()
+
+	for _, client := range bg.clients {
+		go bg.doStatsRequest(ctx, logger, client, resCh)
+	}
+
+	result := &types.ServerStatsResponse{
+		Response: &protov3.MetricDetailsResponse{
+			Metrics: make(map[string]*protov3.MetricDetails),
+		},
+		Stats: &types.Stats{},
+	}
+	var err errors.Errors
+	haveResponse := false
+	responseCounts := 0
+	answeredServers := make(map[string]struct{})
+GATHER:
+	for {
+		select {
+		case res := <-resCh:
+			answeredServers[res.Server] = struct{}{}
+			responseCounts++
+			if res.Err != nil {
+				err.Merge(res.Err)
+			}
+			if res.Response != nil {
+				haveResponse = true
+			}
+			result.Merge(res)
+
+			if responseCounts == len(bg.clients) {
+				break GATHER
+			}
+		case <-ctx.Done():
+			noAnswer := make([]string, 0)
+			for _, s := range bg.clients {
+				if _, ok := answeredServers[s.Name()]; !ok {
+					noAnswer = append(noAnswer, s.Name())
+				}
+			}
+			logger.Warn("timeout waiting for more responses",
+				zap.Strings("no_answers_from", noAnswer),
+			)
+			err.Add(types.ErrTimeoutExceeded)
+			break GATHER
+		}
+	}
+	logger.Debug("got some responses",
+		zap.Int("clients_count", len(bg.clients)),
+		zap.Int("response_count", responseCounts),
+		zap.Bool("have_errors", len(err.Errors) != 0),
+	)
+
+	if !haveResponse {
+		logger.Error("failed to get any response")
+		return nil, result.Stats, err.AddFatal(fmt.Errorf("failed to get any response from backend group: %v", bg.groupName))
+	}
+
+	return result.Response, result.Stats, &err
 }
 
 type tldResponse struct {
@@ -539,7 +1250,7 @@ func (bg *BroadcastGroup) ProbeTLDs(ctx context.Context) ([]string, *errors.Erro
 
 	var tlds []string
 	resCh := make(chan tldResponse, len(bg.clients))
-	ctx, cancel := context.WithTimeout(context.Background(), bg.timeout.Find)
+	ctx, cancel := context.WithTimeout(valuesOnlyContext{ctx}, bg.timeout.Find)
 	defer cancel()
 
 	for _, client := range bg.clients {
@@ -598,5 +1309,20 @@ GATHER:
 		bg.pathCache.Set(k, v)
 	}
 
+	// Deeper levels are enumerated by finds, that teach the path cache
+	query := "*"
+	for depth := 2; depth <= bg.pathCache.ProbeDepth(); depth++ {
+		query += ".*"
+		_, _, e := bg.Find(valuesOnlyContext{ctx}, &protov3.MultiGlobRequest{Metrics: []string{query}})
+		if e != nil && len(e.Errors) > 0 {
+			logger.Warn("failed to probe deeper paths",
+				zap.String("query", query),
+				zap.Any("errors", e.Errors),
+			)
+			err.Merge(e)
+			break
+		}
+	}
+
 	return tlds, &err
 }
@@ -5,13 +5,17 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"runtime"
 	"sort"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-graphite/carbonzipper/zipper/breaker"
+	"github.com/go-graphite/carbonzipper/zipper/cache"
 	"github.com/go-graphite/carbonzipper/zipper/dummy"
 	"github.com/go-graphite/carbonzipper/zipper/errors"
+	"github.com/go-graphite/carbonzipper/zipper/hashring"
 	"github.com/go-graphite/carbonzipper/zipper/types"
 
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
@@ -174,6 +178,207 @@ func TestProbeTLDs(t *testing.T) {
 	}
 }
 
+type testCaseList struct {
+	name            string
+	servers         []types.ServerClient
+	clientResponses map[string]dummy.ListResponse
+	response        []string
+	expectedErr     *errors.Errors
+}
+
+func TestListRequests(t *testing.T) {
+	tests := []testCaseList{
+		{
+			name: "two clients different data",
+			servers: []types.ServerClient{
+				dummy.NewDummyClient("client1", []string{"backend1", "backend2"}, 1),
+				dummy.NewDummyClient("client2", []string{"backend3", "backend4"}, 1),
+			},
+			clientResponses: map[string]dummy.ListResponse{
+				"client1": {
+					Response: &protov3.ListMetricsResponse{Metrics: []string{"a.b", "a.c", "b.d"}},
+					Stats:    &types.Stats{},
+				},
+				"client2": {
+					Response: &protov3.ListMetricsResponse{Metrics: []string{"a.b", "c.e"}},
+					Stats:    &types.Stats{},
+				},
+			},
+			response:    []string{"a.b", "a.c", "b.d", "c.e"},
+			expectedErr: &errors.Errors{},
+		},
+		{
+			name: "one client with error",
+			servers: []types.ServerClient{
+				dummy.NewDummyClient("client1", []string{"backend1", "backend2"}, 1),
+				dummy.NewDummyClient("client2", []string{"backend3", "backend4"}, 1),
+			},
+			clientResponses: map[string]dummy.ListResponse{
+				"client1": {
+					Response: &protov3.ListMetricsResponse{Metrics: []string{"a.b", "a.c"}},
+					Stats:    &types.Stats{},
+				},
+				"client2": {
+					Errors: errors.Error("some error"),
+				},
+			},
+			response:    []string{"a.b", "a.c"},
+			expectedErr: errors.Error("some error"),
+		},
+		{
+			name: "all clients with errors",
+			servers: []types.ServerClient{
+				dummy.NewDummyClient("client1", []string{"backend1", "backend2"}, 1),
+			},
+			clientResponses: map[string]dummy.ListResponse{
+				"client1": {
+					Errors: errors.Error("some error"),
+				},
+			},
+			expectedErr: &errors.Errors{
+				HaveFatalErrors: true,
+				Errors: []error{
+					fmt.Errorf("some error"),
+					fmt.Errorf("failed to get any response from backend group: all clients with errors"),
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		b, err := NewBroadcastGroup(logger, tt.name, tt.servers, 60, 500, timeouts)
+		if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+			t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+		}
+
+		for i := range tt.servers {
+			name := fmt.Sprintf("client%v", i+1)
+			s := tt.servers[i].(*dummy.DummyClient)
+			s.SetListResponse(tt.clientResponses[name])
+		}
+
+		t.Run(tt.name, func(t *testing.T) {
+			res, _, err := b.List(context.Background())
+			if !errorsAreEqual(err, tt.expectedErr) {
+				t.Fatalf("unexpected error %v, expected %v", err, tt.expectedErr)
+			}
+
+			if len(res.GetMetrics()) != len(tt.response) {
+				t.Fatalf("different amount of responses %v, expected %v", res.GetMetrics(), tt.response)
+			}
+
+			for i := range res.GetMetrics() {
+				if res.Metrics[i] != tt.response[i] {
+					t.Errorf("got %v, expected %v", res.Metrics[i], tt.response[i])
+				}
+			}
+		})
+	}
+}
+
+type testCaseStats struct {
+	name            string
+	servers         []types.ServerClient
+	clientResponses map[string]dummy.StatsResponse
+	response        *protov3.MetricDetailsResponse
+	expectedErr     *errors.Errors
+}
+
+func TestStatsRequests(t *testing.T) {
+	tests := []testCaseStats{
+		{
+			name: "two clients different data",
+			servers: []types.ServerClient{
+				dummy.NewDummyClient("client1", []string{"backend1", "backend2"}, 1),
+				dummy.NewDummyClient("client2", []string{"backend3", "backend4"}, 1),
+			},
+			clientResponses: map[string]dummy.StatsResponse{
+				"client1": {
+					Response: &protov3.MetricDetailsResponse{
+						Metrics: map[string]*protov3.MetricDetails{
+							"a.b": {Size_: 10, ModTime: 100},
+							"a.c": {Size_: 20, ModTime: 100},
+						},
+						FreeSpace:  100,
+						TotalSpace: 1000,
+					},
+					Stats: &types.Stats{},
+				},
+				"client2": {
+					Response: &protov3.MetricDetailsResponse{
+						Metrics: map[string]*protov3.MetricDetails{
+							"a.b": {Size_: 15, ModTime: 200},
+							"c.d": {Size_: 30, ModTime: 50},
+						},
+						FreeSpace:  200,
+						TotalSpace: 2000,
+					},
+					Stats: &types.Stats{},
+				},
+			},
+			response: &protov3.MetricDetailsResponse{
+				Metrics: map[string]*protov3.MetricDetails{
+					"a.b": {Size_: 15, ModTime: 200},
+					"a.c": {Size_: 20, ModTime: 100},
+					"c.d": {Size_: 30, ModTime: 50},
+				},
+				FreeSpace:  300,
+				TotalSpace: 3000,
+			},
+			expectedErr: &errors.Errors{},
+		},
+		{
+			name: "all clients with errors",
+			servers: []types.ServerClient{
+				dummy.NewDummyClient("client1", []string{"backend1", "backend2"}, 1),
+			},
+			clientResponses: map[string]dummy.StatsResponse{
+				"client1": {
+					Errors: errors.Error("some error"),
+				},
+			},
+			expectedErr: &errors.Errors{
+				HaveFatalErrors: true,
+				Errors: []error{
+					fmt.Errorf("some error"),
+					fmt.Errorf("failed to get any response from backend group: all clients with errors"),
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		b, err := NewBroadcastGroup(logger, tt.name, tt.servers, 60, 500, timeouts)
+		if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+			t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+		}
+
+		for i := range tt.servers {
+			name := fmt.Sprintf("client%v", i+1)
+			s := tt.servers[i].(*dummy.DummyClient)
+			s.SetStatsResponse(tt.clientResponses[name])
+		}
+
+		t.Run(tt.name, func(t *testing.T) {
+			res, _, err := b.Stats(context.Background())
+			if !errorsAreEqual(err, tt.expectedErr) {
+				t.Fatalf("unexpected error %v, expected %v", err, tt.expectedErr)
+			}
+
+			if tt.response == nil {
+				if res != nil {
+					t.Fatalf("result is not nil, but should be: %+v", res)
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(res, tt.response) {
+				t.Errorf("got %v, expected %v", res, tt.response)
+			}
+		})
+	}
+}
+
 type testCaseFetch struct {
 	name           string
 	servers        []types.ServerClient
@@ -1394,3 +1599,553 @@ func TestFetchRequestsWithTimeout(t *testing.T) {
 		}
 	}
 }
+
+func TestFetchRequestsWithHashRing(t *testing.T) {
+	var servers []types.ServerClient
+	var nodes []hashring.Node
+	for i, d := range []string{"10.0.0.1:2003", "10.0.0.2", "10.0.0.3:2003=c"} {
+		name := fmt.Sprintf("server%v", i+1)
+		servers = append(servers, dummy.NewDummyClient(name, []string{name}, 0))
+		n, err := hashring.ParseNode(name, d)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	b, err := NewBroadcastGroupWithHashRing(logger, "hashring", servers, hashring.New(hashring.CarbonCH, nodes), 1, 60, 500, timeouts)
+	if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+		t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+	}
+
+	response := func(name, pathExpression string, value float64) protov3.FetchResponse {
+		return protov3.FetchResponse{
+			Name:           name,
+			PathExpression: pathExpression,
+			StartTime:      0,
+			StopTime:       120,
+			StepTime:       60,
+			Values:         []float64{value, value},
+		}
+	}
+
+	// "foo.bar" belongs to server3, "a.b.c.d" and "test" to server2
+	server1 := servers[0].(*dummy.DummyClient)
+	server2 := servers[1].(*dummy.DummyClient)
+	server3 := servers[2].(*dummy.DummyClient)
+
+	server1.AddFindResponse(&protov3.MultiGlobRequest{Metrics: []string{"te*"}}, &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{
+			{
+				Name: "te*",
+				Matches: []protov3.GlobMatch{
+					{Path: "test", IsLeaf: true},
+					{Path: "tests", IsLeaf: false},
+				},
+			},
+		},
+	}, &types.Stats{}, nil)
+	server1.AddFetchResponse(&protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.bar", StopTime: 120},
+			{Name: "a.b.c.d", StopTime: 120},
+			{Name: "test", StopTime: 120},
+		},
+	}, &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			response("foo.bar", "foo.bar", 1),
+			response("a.b.c.d", "a.b.c.d", 1),
+			response("test", "te*", 1),
+		},
+	}, &types.Stats{}, nil)
+	server2.AddFetchResponse(&protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "a.b.c.d", StopTime: 120},
+			{Name: "test", StopTime: 120},
+		},
+	}, &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			response("a.b.c.d", "a.b.c.d", 2),
+			response("test", "te*", 2),
+		},
+	}, &types.Stats{}, nil)
+	server3.AddFetchResponse(&protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.bar", StopTime: 120},
+		},
+	}, &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			response("foo.bar", "foo.bar", 3),
+		},
+	}, &types.Stats{}, nil)
+
+	expectedResponse := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			response("a.b.c.d", "a.b.c.d", 2),
+			response("foo.bar", "foo.bar", 3),
+			response("test", "te*", 2),
+		},
+	}
+
+	res, _, err := b.Fetch(context.Background(), &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.bar", StopTime: 120},
+			{Name: "a.b.c.d", StopTime: 120},
+			{Name: "te*", StopTime: 120},
+		},
+	})
+	if err != nil && err.HaveFatalErrors {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if res == nil {
+		t.Fatal("result is nil")
+	}
+
+	sort.Slice(res.Metrics, func(i, j int) bool {
+		return res.Metrics[i].Name < res.Metrics[j].Name
+	})
+	if !reflect.DeepEqual(res, expectedResponse) {
+		t.Errorf("got %v, expected %v", res, expectedResponse)
+	}
+}
+
+func TestFetchRequestsWithQuorum(t *testing.T) {
+	fetchRequest := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo", StopTime: 120},
+		},
+	}
+	response := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{
+				Name:           "foo",
+				PathExpression: "foo",
+				StartTime:      0,
+				StopTime:       120,
+				StepTime:       60,
+				Values:         []float64{0, 1},
+			},
+		},
+	}
+
+	client1 := dummy.NewDummyClient("client1", []string{"backend1"}, 0)
+	client2 := dummy.NewDummyClient("client2", []string{"backend2"}, 0)
+	client3 := dummy.NewDummyClientWithTimeout("client3", []string{"backend3"}, 0, 2*time.Second)
+	client1.AddFetchResponse(fetchRequest, response, &types.Stats{}, nil)
+	client2.AddFetchResponse(fetchRequest, response, &types.Stats{}, nil)
+	servers := []types.ServerClient{client1, client2, client3}
+
+	_, err := NewBroadcastGroupWithQuorum(logger, "quorum", servers, 0, 4, 60, 500, timeouts)
+	if err == nil || !err.HaveFatalErrors {
+		t.Fatalf("expected error for quorum bigger than amount of replicas, got %v", err)
+	}
+
+	b, err := NewBroadcastGroupWithQuorum(logger, "quorum", servers, 3, 2, 60, 500, timeouts)
+	if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+		t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+	}
+
+	start := time.Now()
+	res, stats, err := b.Fetch(context.Background(), fetchRequest)
+	if err != nil && err.HaveFatalErrors {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("fetch took %v, it shouldn't wait for the slow replica", d)
+	}
+	if !reflect.DeepEqual(res, response) {
+		t.Errorf("got %v, expected %v", res, response)
+	}
+	if !reflect.DeepEqual(stats.SkippedServers, []string{"client3"}) {
+		t.Errorf("got skipped servers %v, expected %v", stats.SkippedServers, []string{"client3"})
+	}
+}
+
+func TestFetchRequestsWithQuorumAndOpenCircuits(t *testing.T) {
+	fetchRequest := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo", StopTime: 120},
+		},
+	}
+	response := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo", StopTime: 120, StepTime: 60, Values: []float64{0, 1}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		open   int
+		failed int
+		fatal  bool
+	}{
+		{name: "one open circuit", open: 1},
+		{name: "two open circuits", open: 2, fatal: true},
+		{name: "open circuit and failed replica", open: 1, failed: 1, fatal: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var servers []types.ServerClient
+			for i := 0; i < 3; i++ {
+				client := dummy.NewDummyClient(fmt.Sprintf("TestFetchRequestsWithQuorumAndOpenCircuits %v %v", tt.name, i), []string{"backend"}, 0)
+				switch {
+				case i < tt.open:
+					b := breaker.ForServer(logger, client.Name(), types.CircuitBreaker{MinRequests: 1, OpenTime: time.Hour})
+					b.Report(breaker.Failure, 0)
+				case i < tt.open+tt.failed:
+					client.AddFetchResponse(fetchRequest, nil, &types.Stats{}, errors.Fatalf("failed"))
+				default:
+					client.AddFetchResponse(fetchRequest, response, &types.Stats{}, nil)
+				}
+				servers = append(servers, client)
+			}
+
+			b, err := NewBroadcastGroupWithQuorum(logger, "TestFetchRequestsWithQuorumAndOpenCircuits "+tt.name, servers, 3, 2, 60, 500, timeouts)
+			if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+				t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+			}
+
+			res, _, err := b.Fetch(context.Background(), fetchRequest)
+			if tt.fatal {
+				if err == nil || !err.HaveFatalErrors {
+					t.Fatalf("got %v, expected request to fail without quorum", res)
+				}
+				return
+			}
+			if err != nil && err.HaveFatalErrors {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(res, response) {
+				t.Errorf("got %v, expected %v", res, response)
+			}
+		})
+	}
+}
+
+func TestFetchRequestsWithOpenCircuit(t *testing.T) {
+	fetchRequest := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo", StopTime: 120},
+		},
+	}
+	response := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{
+				Name:     "foo",
+				StopTime: 120,
+				StepTime: 60,
+				Values:   []float64{0, 1},
+			},
+		},
+	}
+
+	client1 := dummy.NewDummyClient("TestFetchRequestsWithOpenCircuit1", []string{"backend1"}, 0)
+	client2 := dummy.NewDummyClient("TestFetchRequestsWithOpenCircuit2", []string{"backend2"}, 0)
+	client1.AddFetchResponse(fetchRequest, response, &types.Stats{}, nil)
+	client2.AddFetchResponse(fetchRequest, response, &types.Stats{}, nil)
+
+	b := breaker.ForServer(logger, client2.Name(), types.CircuitBreaker{MinRequests: 1, OpenTime: time.Hour})
+	b.Report(breaker.Failure, 0)
+
+	bg, err := NewBroadcastGroup(logger, "circuit", []types.ServerClient{client1, client2}, 60, 500, timeouts)
+	if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+		t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+	}
+
+	res, stats, err := bg.Fetch(context.Background(), fetchRequest)
+	if err != nil && err.HaveFatalErrors {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(res, response) {
+		t.Errorf("got %v, expected %v", res, response)
+	}
+	if !reflect.DeepEqual(stats.FailedServers, []string{client2.Name()}) {
+		t.Errorf("got failed servers %v, expected %v", stats.FailedServers, []string{client2.Name()})
+	}
+}
+
+func TestFetchRequestsWithGuardrails(t *testing.T) {
+	fetchRequest := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.*", StopTime: 180},
+		},
+	}
+	response1 := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo.bar", StopTime: 180, StepTime: 60, Values: []float64{0, 1, 2}},
+		},
+	}
+	response2 := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo.baz", StopTime: 180, StepTime: 60, Values: []float64{0, 1, 2}},
+		},
+	}
+
+	client1 := dummy.NewDummyClient("TestFetchRequestsWithGuardrails1", []string{"backend1"}, 0)
+	client2 := dummy.NewDummyClient("TestFetchRequestsWithGuardrails2", []string{"backend2"}, 0)
+	client1.AddFetchResponse(fetchRequest, response1, &types.Stats{}, nil)
+	client2.AddFetchResponse(fetchRequest, response2, &types.Stats{}, nil)
+
+	tests := []struct {
+		name       string
+		guardrails *types.Guardrails
+		limit      string
+	}{
+		{name: "no limits", guardrails: &types.Guardrails{}},
+		{name: "metrics", guardrails: &types.Guardrails{MaxMetrics: 1}, limit: "metrics"},
+		{name: "points", guardrails: &types.Guardrails{MaxPoints: 5}, limit: "points"},
+		{name: "bytes", guardrails: &types.Guardrails{MaxResponseBytes: 10}, limit: "bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bg, err := NewBroadcastGroup(logger, "guardrails "+tt.name, []types.ServerClient{client1, client2}, 60, 500, timeouts)
+			if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+				t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+			}
+
+			ctx := types.WithGuardrails(context.Background(), tt.guardrails)
+			res, _, err := bg.Fetch(ctx, fetchRequest)
+			if tt.limit == "" {
+				if err != nil && err.HaveFatalErrors {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if len(res.Metrics) != 2 {
+					t.Fatalf("expected 2 metrics, got %v", res.Metrics)
+				}
+				return
+			}
+			if err == nil || !err.HaveFatalErrors {
+				t.Fatalf("expected fatal error, got %v", err)
+			}
+			e, ok := types.LimitExceeded(err.Errors).(*types.LimitExceededError)
+			if !ok || e.Limit != tt.limit {
+				t.Fatalf("expected %v limit to be exceeded, got %v", tt.limit, err.Errors)
+			}
+		})
+	}
+}
+
+// TestFetchDoesntLeakClients checks that clients, that split the request and still have responses to send, don't block
+// forever when the group stops waiting for them
+func TestFetchDoesntLeakClients(t *testing.T) {
+	names := []string{"foo", "bar", "baz"}
+	fetchRequest := &protov3.MultiFetchRequest{}
+	for _, name := range names {
+		fetchRequest.Metrics = append(fetchRequest.Metrics, protov3.FetchRequest{Name: name, StopTime: 120})
+	}
+
+	tests := []struct {
+		name       string
+		quorum     int
+		guardrails *types.Guardrails
+	}{
+		{name: "quorum", quorum: 1, guardrails: &types.Guardrails{}},
+		{name: "guardrails", quorum: 2, guardrails: &types.Guardrails{MaxPoints: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var clients []types.ServerClient
+			for i := 0; i < 2; i++ {
+				client := dummy.NewDummyClient(fmt.Sprintf("TestFetchDoesntLeakClients %v %v", tt.name, i), []string{"backend"}, 1)
+				for _, name := range names {
+					request := &protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{{Name: name, StopTime: 120}}}
+					client.AddFetchResponse(request, &protov3.MultiFetchResponse{
+						Metrics: []protov3.FetchResponse{{Name: name, StopTime: 120, StepTime: 60, Values: []float64{0, 1}}},
+					}, &types.Stats{}, nil)
+				}
+				clients = append(clients, client)
+			}
+			bg, err := NewBroadcastGroupWithQuorum(logger, "TestFetchDoesntLeakClients "+tt.name, clients, len(clients), tt.quorum, 60, 500, timeouts)
+			if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+				t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+			}
+
+			goroutines := runtime.NumGoroutine()
+			for i := 0; i < 10; i++ {
+				bg.Fetch(types.WithGuardrails(context.Background(), tt.guardrails), fetchRequest)
+			}
+			for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > goroutines {
+				t.Errorf("%v goroutines are left after fetch", n-goroutines)
+			}
+		})
+	}
+}
+
+func TestFindLearnsRoutes(t *testing.T) {
+	findRequest := &protov3.MultiGlobRequest{Metrics: []string{"a.*"}}
+	client1 := dummy.NewDummyClient("TestFindLearnsRoutes1", []string{"backend1"}, 0)
+	client2 := dummy.NewDummyClient("TestFindLearnsRoutes2", []string{"backend2"}, 0)
+	client1.AddFindResponse(findRequest, &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{
+			{Name: "a.*", Matches: []protov3.GlobMatch{{Path: "a.b"}}},
+		},
+	}, &types.Stats{}, nil)
+	client2.AddFindResponse(findRequest, &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{
+			{Name: "a.*", Matches: []protov3.GlobMatch{{Path: "a.c"}}},
+		},
+	}, &types.Stats{}, nil)
+
+	bg, err := NewBroadcastGroup(logger, "TestFindLearnsRoutes", []types.ServerClient{client1, client2}, 60, 500, timeouts)
+	if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+		t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+	}
+
+	_, _, err = bg.Find(context.Background(), findRequest)
+	if err != nil && len(err.Errors) > 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := []struct {
+		requests []string
+		expected []string
+	}{
+		{requests: []string{"a.b.*"}, expected: []string{client1.Name()}},
+		{requests: []string{"a.c.d"}, expected: []string{client2.Name()}},
+		{requests: []string{"a.d.*"}, expected: []string{client1.Name(), client2.Name()}},
+		{requests: []string{"a.b.*", "a.c.d"}, expected: []string{client1.Name(), client2.Name()}},
+		{requests: []string{"a.b.*", "x.*"}, expected: []string{client1.Name(), client2.Name()}},
+	}
+
+	for _, tt := range tests {
+		var names []string
+		for _, c := range bg.chooseServers(tt.requests) {
+			names = append(names, c.Name())
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("requests %v: got servers %v, expected %v", tt.requests, names, tt.expected)
+		}
+	}
+}
+
+func TestFetchRequestsWithSharedCache(t *testing.T) {
+	fetchRequest := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.bar", StopTime: 180},
+		},
+	}
+	response := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo.bar", StopTime: 180, StepTime: 60, Values: []float64{0, 1, 2}},
+		},
+	}
+
+	shared, e := cache.NewSharedCache(types.SharedCache{Type: "mem"})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// Two groups with the same name act as the same group of two zipper instances
+	client1 := dummy.NewDummyClient("TestFetchRequestsWithSharedCache1", []string{"backend1"}, 0)
+	client1.AddFetchResponse(fetchRequest, response, &types.Stats{}, nil)
+	bg1, err := NewBroadcastGroup(logger, "TestFetchRequestsWithSharedCache", []types.ServerClient{client1}, 60, 500, timeouts)
+	if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+		t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+	}
+	bg1.SetSharedCache(shared)
+
+	client2 := dummy.NewDummyClient("TestFetchRequestsWithSharedCache2", []string{"backend2"}, 0)
+	bg2, err := NewBroadcastGroup(logger, "TestFetchRequestsWithSharedCache", []types.ServerClient{client2}, 60, 500, timeouts)
+	if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+		t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+	}
+	bg2.SetSharedCache(shared)
+
+	_, _, err = bg1.Fetch(context.Background(), fetchRequest)
+	if err != nil && len(err.Errors) > 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	res, _, err := bg2.Fetch(context.Background(), fetchRequest)
+	if err != nil && len(err.Errors) > 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(res.Metrics) != 1 || !reflect.DeepEqual(res.Metrics[0].Values, response.Metrics[0].Values) {
+		t.Fatalf("got %v, expected response from shared cache %v", res, response)
+	}
+}
+
+func TestFindNegativeCache(t *testing.T) {
+	groupName := "TestFindNegativeCache"
+	request := &protov3.MultiGlobRequest{Metrics: []string{"foo.bar"}}
+	response := &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{
+			{Name: "foo.bar", Matches: []protov3.GlobMatch{{Path: "foo.bar", IsLeaf: true}}},
+		},
+	}
+
+	client := dummy.NewDummyClient("client", []string{"backend"}, 0)
+	bg, err := NewBroadcastGroup(logger, groupName, []types.ServerClient{client}, 60, 500, timeouts)
+	if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+		t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+	}
+	bg.SetQueryCaches(types.QueryCaches{
+		Find: &types.QueryCache{ErrorTTL: time.Minute},
+	}.Merge(types.DefaultQueryCaches))
+
+	// Client has no response yet, so the find fails and failure is cached
+	if _, _, err = bg.Find(context.Background(), request); err == nil || len(err.Errors) == 0 {
+		t.Fatal("expected find to fail")
+	}
+	client.AddFindResponse(request, response, &types.Stats{}, nil)
+	if _, _, err = bg.Find(context.Background(), request); err == nil || len(err.Errors) == 0 {
+		t.Fatal("expected cached failure")
+	}
+
+	res, _, err := bg.Find(types.WithoutNegativeCache(context.Background()), request)
+	if err != nil && len(err.Errors) > 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(res, response) {
+		t.Fatalf("got %v, expected %v", res, response)
+	}
+}
+
+func TestFetchStaleOnError(t *testing.T) {
+	groupName := "TestFetchStaleOnError"
+	fetchRequest := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.bar", StopTime: 180},
+		},
+	}
+	response := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo.bar", StopTime: 180, StepTime: 60, Values: []float64{0, 1, 2}},
+		},
+	}
+
+	client := dummy.NewDummyClient("client", []string{"backend"}, 0)
+	client.AddFetchResponse(fetchRequest, response, &types.Stats{}, nil)
+	bg, err := NewBroadcastGroup(logger, groupName, []types.ServerClient{client}, 60, 500, timeouts)
+	if err != nil && (err.HaveFatalErrors || len(err.Errors) > 0) {
+		t.Fatalf("error while initializing group, when it shouldn't be: %v", err)
+	}
+	bg.SetQueryCaches(types.QueryCaches{
+		Fetch: &types.QueryCache{TTL: 10 * time.Millisecond, StaleTTL: time.Minute},
+	}.Merge(types.DefaultQueryCaches))
+
+	_, stats, err := bg.Fetch(context.Background(), fetchRequest)
+	if err != nil && len(err.Errors) > 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if stats.StaleResponses != 0 {
+		t.Fatalf("fresh response is marked as stale")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	client.AddFetchResponse(fetchRequest, nil, nil, errors.Fatal("backend is down"))
+	res, stats, err := bg.Fetch(context.Background(), fetchRequest)
+	if err != nil && len(err.Errors) > 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(res, response) || stats.StaleResponses != 1 {
+		t.Fatalf("got %v, %+v, expected stale response %v", res, stats, response)
+	}
+}
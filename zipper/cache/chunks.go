@@ -0,0 +1,506 @@
+package cache
+
+import (
+	"expvar"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper/errors"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/dgryski/go-expirecache"
+)
+
+const (
+	defaultChunkCacheSize = 100 * 1024 * 1024
+	defaultChunkTTL       = 10 * time.Minute
+	defaultChunkNowTTL    = 10 * time.Second
+	defaultChunkNowGrace  = time.Minute
+)
+
+// Counters of the chunk cache, every chunk of every requested metric is counted. They should be published by the caller
+var (
+	ChunkHits   expvar.Int
+	ChunkMisses expvar.Int
+)
+
+// ChunkCache stores fetched data in time chunks, aligned to multiples of the chunk size. Chunk contains all the metrics
+// that request name (possibly a glob) matches. Nil ChunkCache is a disabled one
+type ChunkCache struct {
+	ec        *expirecache.Cache
+	chunkSize int64
+	ttl       int32
+	nowTTL    int32
+	// chunks that end less than that before current time are kept for nowTTL
+	nowGrace int64
+	// keys of the stored chunks, as expirecache can't list them
+	index *keyIndex
+}
+
+// NewChunkCache creates chunk cache from config, returns nil if it's disabled
+func NewChunkCache(config types.FetchChunks) *ChunkCache {
+	if config.ChunkSize < time.Second {
+		return nil
+	}
+	if config.Size == 0 {
+		config.Size = defaultChunkCacheSize
+	}
+	if config.TTL <= 0 {
+		config.TTL = defaultChunkTTL
+	}
+	if config.NowTTL <= 0 {
+		config.NowTTL = defaultChunkNowTTL
+	}
+	if config.NowGrace == 0 {
+		config.NowGrace = defaultChunkNowGrace
+	} else if config.NowGrace < 0 {
+		config.NowGrace = 0
+	}
+
+	c := &ChunkCache{
+		ec:        expirecache.New(config.Size),
+		chunkSize: int64(config.ChunkSize.Seconds()),
+		ttl:       ttlSeconds(config.TTL),
+		nowTTL:    ttlSeconds(config.NowTTL),
+		nowGrace:  int64(config.NowGrace.Seconds()),
+		index:     newKeyIndex(),
+	}
+	go c.ec.ApproximateCleaner(10 * time.Second)
+
+	return c
+}
+
+// Items returns amount of chunks in the cache
+func (c *ChunkCache) Items() int {
+	if c == nil {
+		return 0
+	}
+	return c.ec.Items()
+}
+
+// Size returns size of the cache in bytes
+func (c *ChunkCache) Size() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.ec.Size()
+}
+
+// key is a key of the chunk, that contains series with the steps. The same data could be returned with different
+// resolution, depending on how old the requested data is
+func (c *ChunkCache) key(prefix, name string, chunk int64, steps string) string {
+	return prefix + "&" + name + "&chunk=" + strconv.FormatInt(chunk, 10) + "&steps=" + steps
+}
+
+// stepsKey is a key of the steps, that backends return for the metric, if request starts that many chunks before now
+func (c *ChunkCache) stepsKey(prefix, name string, age int64) string {
+	return prefix + "&" + name + "&age=" + strconv.FormatInt(age, 10)
+}
+
+// seriesSteps returns distinct steps of the series in ascending order, joined by comma
+func seriesSteps(series []protov3.FetchResponse) string {
+	steps := make([]int64, 0, 1)
+	for _, s := range series {
+		i := sort.Search(len(steps), func(i int) bool { return steps[i] >= s.StepTime })
+		if i < len(steps) && steps[i] == s.StepTime {
+			continue
+		}
+		steps = append(steps, 0)
+		copy(steps[i+1:], steps[i:])
+		steps[i] = s.StepTime
+	}
+	res := make([]string, len(steps))
+	for i, step := range steps {
+		res[i] = strconv.FormatInt(step, 10)
+	}
+	return strings.Join(res, ",")
+}
+
+// chunkMetric returns name of the metric (possibly a glob), that the chunk was requested for
+func chunkMetric(key string) string {
+	if i := strings.LastIndex(key, "&chunk="); i >= 0 {
+		key = key[:i]
+	}
+	return key[strings.Index(key, "&")+1:]
+}
+
+// Purge removes chunks, that were requested for metrics accepted by match. Returns amount of removed chunks
+func (c *ChunkCache) Purge(match func(metric string) bool) int {
+	if c == nil {
+		return 0
+	}
+	keys := c.index.remove(func(key string) bool {
+		return match(chunkMetric(key))
+	})
+	// expirecache can't remove items, so they are replaced by expired ones, which are dropped by the cleaner later
+	for _, k := range keys {
+		c.ec.Set(k, (*protov3.MultiFetchResponse)(nil), 0, 0)
+	}
+	return len(keys)
+}
+
+// Flush removes all chunks, returns amount of removed chunks
+func (c *ChunkCache) Flush() int {
+	return c.Purge(func(string) bool { return true })
+}
+
+type chunkedMetric struct {
+	request protov3.FetchRequest
+	expr    string
+	// chunks that are served from cache, by index
+	cached map[int64]*protov3.MultiFetchResponse
+	// range of chunks that are fetched, empty if fetchFirst > fetchLast
+	fetchFirst, fetchLast int64
+}
+
+// ChunkPlan tells which part of the request has to be fetched and assembles response from cached chunks and fetched data
+type ChunkPlan struct {
+	c        *ChunkCache
+	prefix   string
+	now      int64
+	nowChunk int64
+	metrics  []chunkedMetric
+	// index in metrics by path expression
+	byExpr map[string]int
+
+	// Request for the data that is not in cache. Chunked metrics are requested by whole chunks
+	Missing *protov3.MultiFetchRequest
+}
+
+func cacheable(r *protov3.FetchRequest) bool {
+	return r.StopTime > r.StartTime && r.StartTime > 0 && !r.HighPrecisionTimestamps && len(r.FilterFunctions) == 0
+}
+
+func pathExpression(name, expr string) string {
+	if expr == "" {
+		return name
+	}
+	return expr
+}
+
+// Plan looks up chunks of the request in cache. Metrics that can't be chunked, and metrics whose path expressions are
+// not unique in the request (so fetched data can't be told apart), are requested as is
+func (c *ChunkCache) Plan(prefix string, request *protov3.MultiFetchRequest, now time.Time) *ChunkPlan {
+	if c == nil {
+		return &ChunkPlan{Missing: request}
+	}
+
+	p := &ChunkPlan{
+		c:        c,
+		prefix:   prefix,
+		now:      now.Unix(),
+		nowChunk: now.Unix() / c.chunkSize,
+		byExpr:   make(map[string]int),
+		Missing:  &protov3.MultiFetchRequest{},
+	}
+
+	exprs := make(map[string]int, len(request.Metrics))
+	for i := range request.Metrics {
+		exprs[pathExpression(request.Metrics[i].Name, request.Metrics[i].PathExpression)]++
+	}
+
+	nowChunk := p.nowChunk
+	for _, r := range request.Metrics {
+		expr := pathExpression(r.Name, r.PathExpression)
+		first, last := r.StartTime/c.chunkSize, r.StopTime/c.chunkSize
+		if last > nowChunk {
+			last = nowChunk
+		}
+		if !cacheable(&r) || exprs[expr] > 1 || first > last {
+			p.Missing.Metrics = append(p.Missing.Metrics, r)
+			continue
+		}
+
+		m := chunkedMetric{
+			request:    r,
+			expr:       expr,
+			cached:     make(map[int64]*protov3.MultiFetchResponse),
+			fetchFirst: last + 1,
+			fetchLast:  first - 1,
+		}
+		// Backends choose resolution by the age of the requested data, so only chunks with the steps, that were returned
+		// for requests starting as long ago, are used. Until they are known, all the chunks are fetched
+		steps, known := c.ec.Get(c.stepsKey(prefix, r.Name, nowChunk-first))
+		for k := first; k <= last; k++ {
+			if known {
+				if v, ok := c.ec.Get(c.key(prefix, r.Name, k, steps.(string))); ok && v.(*protov3.MultiFetchResponse) != nil {
+					ChunkHits.Add(1)
+					m.cached[k] = v.(*protov3.MultiFetchResponse)
+					continue
+				}
+			}
+			ChunkMisses.Add(1)
+			if k < m.fetchFirst {
+				m.fetchFirst = k
+			}
+			m.fetchLast = k
+		}
+		// Cached chunks in the middle of the fetched range are fetched again, as it's still one request
+		for k := m.fetchFirst; k <= m.fetchLast; k++ {
+			delete(m.cached, k)
+		}
+
+		if m.fetchFirst <= m.fetchLast {
+			p.Missing.Metrics = append(p.Missing.Metrics, protov3.FetchRequest{
+				Name: r.Name,
+				// Whisper returns points after the start time, so the first point of the chunk is requested explicitly
+				StartTime:      m.fetchFirst*c.chunkSize - 1,
+				StopTime:       (m.fetchLast+1)*c.chunkSize - 1,
+				PathExpression: expr,
+			})
+		}
+		p.byExpr[expr] = len(p.metrics)
+		p.metrics = append(p.metrics, m)
+	}
+
+	return p
+}
+
+// Complete stores fetched chunks and returns response for the original request. Nothing is stored if fetch failed on some
+// of the backends, as the data could be incomplete. Metrics, whose cached and fetched data have steps that can't be
+// consolidated to one, are returned in request, that should be fetched as is.
+func (p *ChunkPlan) Complete(fetched *protov3.MultiFetchResponse, err *errors.Errors) (*protov3.MultiFetchResponse, *protov3.MultiFetchRequest) {
+	res := &protov3.MultiFetchResponse{}
+	retry := &protov3.MultiFetchRequest{}
+	if p.c == nil {
+		if fetched != nil {
+			res = fetched
+		}
+		return res, retry
+	}
+
+	complete := err == nil || len(err.Errors) == 0
+	fresh := make([][]protov3.FetchResponse, len(p.metrics))
+	if fetched != nil {
+		for _, s := range fetched.Metrics {
+			if i, ok := p.byExpr[pathExpression(s.Name, s.PathExpression)]; ok {
+				fresh[i] = append(fresh[i], s)
+				continue
+			}
+			res.Metrics = append(res.Metrics, s)
+		}
+	}
+
+	for i := range p.metrics {
+		m := &p.metrics[i]
+		if complete && m.fetchFirst <= m.fetchLast && len(fresh[i]) > 0 {
+			p.store(m, fresh[i])
+		}
+
+		pieces := make([]protov3.FetchResponse, 0, len(fresh[i]))
+		for k := m.request.StartTime / p.c.chunkSize; k <= m.request.StopTime/p.c.chunkSize; k++ {
+			if chunk, ok := m.cached[k]; ok {
+				pieces = append(pieces, chunk.Metrics...)
+			}
+		}
+		pieces = append(pieces, fresh[i]...)
+
+		series, ok := assemble(m, pieces)
+		if !ok {
+			retry.Metrics = append(retry.Metrics, m.request)
+			continue
+		}
+		res.Metrics = append(res.Metrics, series...)
+	}
+
+	return res, retry
+}
+
+func alignedTo(t, step int64) bool {
+	return t%step == 0
+}
+
+// store splits fetched series of the metric into chunks. Nothing is stored if some of the series are not aligned to chunks
+func (p *ChunkPlan) store(m *chunkedMetric, series []protov3.FetchResponse) {
+	size := p.c.chunkSize
+	for i := range series {
+		step := series[i].StepTime
+		if step <= 0 || !alignedTo(size, step) || !alignedTo(series[i].StartTime, step) {
+			return
+		}
+	}
+
+	steps := seriesSteps(series)
+	p.c.ec.Set(p.c.stepsKey(p.prefix, m.request.Name, p.nowChunk-m.fetchFirst), steps, uint64(len(steps)), p.c.ttl)
+
+	for k := m.fetchFirst; k <= m.fetchLast; k++ {
+		chunk := &protov3.MultiFetchResponse{}
+		chunkStart, chunkStop := k*size, (k+1)*size
+		for _, s := range series {
+			from := (chunkStart - s.StartTime) / s.StepTime
+			if from < 0 {
+				from = 0
+			}
+			to := (chunkStop - s.StartTime) / s.StepTime
+			if to > int64(len(s.Values)) {
+				to = int64(len(s.Values))
+			}
+			if from >= to {
+				continue
+			}
+			piece := s
+			piece.StartTime = s.StartTime + from*s.StepTime
+			piece.StopTime = s.StartTime + to*s.StepTime
+			piece.Values = append([]float64(nil), s.Values[from:to]...)
+			chunk.Metrics = append(chunk.Metrics, piece)
+		}
+
+		key, ttl := p.c.key(p.prefix, m.request.Name, k, steps), p.ttl(chunkStop)
+		p.c.ec.Set(key, chunk, uint64(chunk.Size()), ttl)
+		p.c.index.add(key, ttl)
+	}
+}
+
+// ttl returns how long the chunk, that ends at chunkStop, is kept. Late points could still arrive to the recent chunks
+func (p *ChunkPlan) ttl(chunkStop int64) int32 {
+	if chunkStop > p.now-p.c.nowGrace {
+		return p.c.nowTTL
+	}
+	return p.c.ttl
+}
+
+func mod(a, b int64) int64 {
+	return ((a % b) + b) % b
+}
+
+// consolidate aggregates points of the series to the bigger step, the way ConsolidationFunc says. Buckets start at
+// multiples of the step plus phase.
+func consolidate(s protov3.FetchResponse, step, phase int64) protov3.FetchResponse {
+	var buckets []float64
+	var known []int
+	start := s.StartTime - mod(s.StartTime-phase, step)
+	for i, v := range s.Values {
+		b := (s.StartTime + int64(i)*s.StepTime - start) / step
+		for int64(len(buckets)) <= b {
+			buckets = append(buckets, math.NaN())
+			known = append(known, 0)
+		}
+		if math.IsNaN(v) {
+			continue
+		}
+		switch {
+		case known[b] == 0:
+			buckets[b] = v
+		case s.ConsolidationFunc == "sum" || s.ConsolidationFunc == "average" || s.ConsolidationFunc == "avg" || s.ConsolidationFunc == "":
+			buckets[b] += v
+		case s.ConsolidationFunc == "min":
+			buckets[b] = math.Min(buckets[b], v)
+		case s.ConsolidationFunc == "max":
+			buckets[b] = math.Max(buckets[b], v)
+		case s.ConsolidationFunc == "last":
+			buckets[b] = v
+		}
+		known[b]++
+	}
+
+	perBucket := step / s.StepTime
+	for b := range buckets {
+		if known[b] == 0 {
+			continue
+		}
+		if float32(known[b])/float32(perBucket) < s.XFilesFactor {
+			buckets[b] = math.NaN()
+			continue
+		}
+		if s.ConsolidationFunc == "average" || s.ConsolidationFunc == "avg" || s.ConsolidationFunc == "" {
+			buckets[b] /= float64(known[b])
+		}
+	}
+
+	s.StartTime = start
+	s.StopTime = start + int64(len(buckets))*step
+	s.StepTime = step
+	s.Values = buckets
+	return s
+}
+
+// assemble merges pieces of the series into ones, that cover requested time range. As whisper does, points after the
+// start time and up to the stop time are returned. Pieces with smaller steps (e.g. recent data, that was fetched from
+// more precise retention) are consolidated to the biggest step, if it's a multiple of theirs. Later pieces take
+// precedence over earlier ones.
+func assemble(m *chunkedMetric, pieces []protov3.FetchResponse) ([]protov3.FetchResponse, bool) {
+	var names []string
+	byName := make(map[string][]protov3.FetchResponse)
+	for _, p := range pieces {
+		if _, ok := byName[p.Name]; !ok {
+			names = append(names, p.Name)
+		}
+		byName[p.Name] = append(byName[p.Name], p)
+	}
+
+	res := make([]protov3.FetchResponse, 0, len(names))
+	for _, name := range names {
+		pieces := byName[name]
+		var step, phase int64
+		for _, p := range pieces {
+			if p.StepTime <= 0 {
+				return nil, false
+			}
+			if p.StepTime > step {
+				step, phase = p.StepTime, mod(p.StartTime, p.StepTime)
+			}
+		}
+		dataStart, dataStop := int64(math.MaxInt64), int64(math.MinInt64)
+		for i, p := range pieces {
+			if !alignedTo(step, p.StepTime) || (p.StepTime == step && mod(p.StartTime, step) != phase) {
+				return nil, false
+			}
+			if p.StepTime != step {
+				p = consolidate(p, step, phase)
+				pieces[i] = p
+			}
+			if p.StartTime < dataStart {
+				dataStart = p.StartTime
+			}
+			if stop := p.StartTime + int64(len(p.Values))*step; stop > dataStop {
+				dataStop = stop
+			}
+		}
+
+		from := m.request.StartTime - mod(m.request.StartTime-phase, step) + step
+		if from < dataStart {
+			from = dataStart
+		}
+		to := m.request.StopTime - mod(m.request.StopTime-phase, step)
+		if to > dataStop-step {
+			to = dataStop - step
+		}
+		if to < from {
+			continue
+		}
+
+		values := make([]float64, (to-from)/step+1)
+		for i := range values {
+			values[i] = math.NaN()
+		}
+		for _, p := range pieces {
+			for i, v := range p.Values {
+				t := p.StartTime + int64(i)*step
+				if t < from || t > to || math.IsNaN(v) {
+					continue
+				}
+				values[(t-from)/step] = v
+			}
+		}
+
+		last := pieces[len(pieces)-1]
+		res = append(res, protov3.FetchResponse{
+			Name:              name,
+			PathExpression:    m.expr,
+			ConsolidationFunc: last.ConsolidationFunc,
+			StartTime:         from,
+			StopTime:          to + step,
+			StepTime:          step,
+			XFilesFactor:      last.XFilesFactor,
+			Values:            values,
+			AppliedFunctions:  last.AppliedFunctions,
+			RequestStartTime:  m.request.StartTime,
+			RequestStopTime:   m.request.StopTime,
+		})
+	}
+	return res, true
+}
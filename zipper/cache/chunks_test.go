@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper/errors"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+// whisperFetch answers the request the way whisper does: points after the start time and up to the stop time or now,
+// every point's value is it's timestamp divided by step
+func whisperFetch(request *protov3.MultiFetchRequest, now, step int64) *protov3.MultiFetchResponse {
+	res := &protov3.MultiFetchResponse{}
+	for _, r := range request.Metrics {
+		until := r.StopTime
+		if until > now {
+			until = now
+		}
+		from := r.StartTime - r.StartTime%step + step
+		until = until - until%step + step
+		s := protov3.FetchResponse{
+			Name:             r.Name,
+			PathExpression:   r.PathExpression,
+			StartTime:        from,
+			StopTime:         until,
+			StepTime:         step,
+			RequestStartTime: r.StartTime,
+			RequestStopTime:  r.StopTime,
+		}
+		for t := from; t < until; t += step {
+			s.Values = append(s.Values, float64(t/step))
+		}
+		res.Metrics = append(res.Metrics, s)
+	}
+	return res
+}
+
+func TestChunkCache(t *testing.T) {
+	c := NewChunkCache(types.FetchChunks{ChunkSize: 10 * time.Minute})
+
+	// now is near the end of a chunk, so the next request moves to the next chunk
+	now := int64(1500000000) - int64(1500000000)%600 + 590
+	request := func(now int64) *protov3.MultiFetchRequest {
+		return &protov3.MultiFetchRequest{
+			Metrics: []protov3.FetchRequest{
+				{Name: "foo.bar", StartTime: now - 3600, StopTime: now, PathExpression: "foo.bar"},
+			},
+		}
+	}
+
+	for i, tc := range []struct {
+		now     int64
+		missing int64
+	}{
+		{now: now, missing: 7},
+		{now: now, missing: 0},
+		{now: now + 60, missing: 1},
+	} {
+		hits, misses := ChunkHits.Value(), ChunkMisses.Value()
+		plan := c.Plan("root", request(tc.now), time.Unix(tc.now, 0))
+		if len(plan.Missing.Metrics) > 0 {
+			r := plan.Missing.Metrics[0]
+			if chunks := (r.StopTime + 1 - (r.StartTime + 1)) / 600; chunks != tc.missing {
+				t.Errorf("%v: %v chunks are fetched, expected %v", i, chunks, tc.missing)
+			}
+		} else if tc.missing != 0 {
+			t.Errorf("%v: nothing is fetched, expected %v chunks", i, tc.missing)
+		}
+		if ChunkMisses.Value()-misses != tc.missing || ChunkHits.Value()-hits != 7-tc.missing {
+			t.Errorf("%v: got %v hits and %v misses", i, ChunkHits.Value()-hits, ChunkMisses.Value()-misses)
+		}
+
+		res, retry := plan.Complete(whisperFetch(plan.Missing, tc.now, 60), nil)
+		if len(retry.Metrics) > 0 {
+			t.Fatalf("%v: unexpected retry %v", i, retry)
+		}
+		expected := whisperFetch(request(tc.now), tc.now, 60)
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("%v: got %v, expected %v", i, res, expected)
+		}
+	}
+}
+
+// retentionFetch answers the request the way whisper with 60s:1d,1h:30d retentions does: resolution is chosen by the age of
+// the start time
+func retentionFetch(request *protov3.MultiFetchRequest, now int64) *protov3.MultiFetchResponse {
+	res := &protov3.MultiFetchResponse{}
+	for _, r := range request.Metrics {
+		step := int64(60)
+		if now-r.StartTime > 86400 {
+			step = 3600
+		}
+		res.Metrics = append(res.Metrics, whisperFetch(&protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{r}}, now, step).Metrics...)
+	}
+	return res
+}
+
+func TestChunkCacheResolution(t *testing.T) {
+	c := NewChunkCache(types.FetchChunks{ChunkSize: time.Hour})
+	now := int64(1500000000)
+	request := func(from, until int64) *protov3.MultiFetchRequest {
+		return &protov3.MultiFetchRequest{
+			Metrics: []protov3.FetchRequest{
+				{Name: "foo.bar", StartTime: now - from, StopTime: now - until, PathExpression: "foo.bar"},
+			},
+		}
+	}
+
+	for i, tc := range []struct {
+		request *protov3.MultiFetchRequest
+		cached  bool
+	}{
+		{request: request(30*86400, 0)},
+		// recent chunks are cached with 1h step, but backend returns 1m step for this range
+		{request: request(6*3600, 3*3600)},
+		{request: request(6*3600, 3*3600), cached: true},
+		{request: request(30*86400, 0), cached: true},
+	} {
+		plan := c.Plan("root", tc.request, time.Unix(now, 0))
+		if cached := len(plan.Missing.Metrics) == 0; cached != tc.cached {
+			t.Errorf("%v: got cached %v, expected %v", i, cached, tc.cached)
+		}
+		res, retry := plan.Complete(retentionFetch(plan.Missing, now), nil)
+		if len(retry.Metrics) > 0 {
+			t.Fatalf("%v: unexpected retry %v", i, retry)
+		}
+		expected := retentionFetch(tc.request, now)
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("%v: got %v points with step %v, expected %v points with step %v", i,
+				len(res.Metrics[0].Values), res.Metrics[0].StepTime, len(expected.Metrics[0].Values), expected.Metrics[0].StepTime)
+		}
+	}
+}
+
+func TestChunkCacheNotCacheable(t *testing.T) {
+	c := NewChunkCache(types.FetchChunks{ChunkSize: 10 * time.Minute})
+	now := time.Unix(1500000000, 0)
+
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.bar", StartTime: 1499990000, StopTime: 1500000000, FilterFunctions: []*protov3.FilteringFunction{{Name: "sum"}}},
+			{Name: "foo.baz", StopTime: 1500000000},
+		},
+	}
+	plan := c.Plan("root", request, now)
+	if !reflect.DeepEqual(plan.Missing, request) {
+		t.Fatalf("got %v, expected request to be fetched as is", plan.Missing)
+	}
+
+	fetched := whisperFetch(request, now.Unix(), 60)
+	res, retry := plan.Complete(fetched, nil)
+	if len(retry.Metrics) > 0 || !reflect.DeepEqual(res, fetched) {
+		t.Errorf("got %v, expected fetched response as is", res)
+	}
+	if c.Items() != 0 {
+		t.Errorf("%v chunks are cached, expected none", c.Items())
+	}
+}
+
+func TestChunkCacheFetchErrors(t *testing.T) {
+	c := NewChunkCache(types.FetchChunks{ChunkSize: 10 * time.Minute})
+	now := time.Unix(1500000000, 0)
+
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.bar", StartTime: 1499990000, StopTime: 1500000000, PathExpression: "foo.bar"},
+		},
+	}
+	plan := c.Plan("root", request, now)
+
+	var err errors.Errors
+	err.Addf("timeout while fetching response")
+	res, retry := plan.Complete(whisperFetch(plan.Missing, now.Unix(), 60), &err)
+	if len(retry.Metrics) > 0 || len(res.Metrics) != 1 {
+		t.Fatalf("got %v, expected fetched response", res)
+	}
+	if c.Items() != 0 {
+		t.Errorf("%v chunks are cached after failed fetch, expected none", c.Items())
+	}
+}
+
+func TestChunkCachePurge(t *testing.T) {
+	c := NewChunkCache(types.FetchChunks{ChunkSize: 10 * time.Minute})
+	now := time.Unix(1500000000, 0)
+
+	for _, name := range []string{"foo.*", "foo.bar", "bar.baz"} {
+		request := &protov3.MultiFetchRequest{
+			Metrics: []protov3.FetchRequest{
+				{Name: name, StartTime: 1499999000, StopTime: 1500000000, PathExpression: name},
+			},
+		}
+		plan := c.Plan("root", request, now)
+		plan.Complete(whisperFetch(plan.Missing, now.Unix(), 60), nil)
+	}
+
+	// chunks of foo.* and foo.bar, 3 chunks each
+	if removed := c.Purge(func(metric string) bool { return strings.HasPrefix(metric, "foo.") }); removed != 6 {
+		t.Errorf("%v chunks are purged, expected 6", removed)
+	}
+	plan := c.Plan("root", &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.*", StartTime: 1499999000, StopTime: 1500000000, PathExpression: "foo.*"},
+		},
+	}, now)
+	if len(plan.Missing.Metrics) != 1 {
+		t.Error("purged chunks are still served")
+	}
+	if removed := c.Flush(); removed != 3 {
+		t.Errorf("%v chunks are flushed, expected 3", removed)
+	}
+
+	var disabled *ChunkCache
+	if disabled.Flush() != 0 {
+		t.Error("disabled cache flushed chunks")
+	}
+}
+
+func TestChunkTTL(t *testing.T) {
+	c := NewChunkCache(types.FetchChunks{ChunkSize: 10 * time.Minute, TTL: time.Hour, NowTTL: 10 * time.Second, NowGrace: 2 * time.Minute})
+	plan := c.Plan("root", &protov3.MultiFetchRequest{}, time.Unix(1500000000, 0))
+
+	for _, tc := range []struct {
+		chunkStop int64
+		expected  int32
+	}{
+		{chunkStop: 1500000600, expected: 10},
+		{chunkStop: 1500000000, expected: 10},
+		{chunkStop: 1499999900, expected: 10},
+		{chunkStop: 1499999880, expected: 3600},
+		{chunkStop: 1499999400, expected: 3600},
+	} {
+		if ttl := plan.ttl(tc.chunkStop); ttl != tc.expected {
+			t.Errorf("chunk ending at %v: got ttl %v, expected %v", tc.chunkStop, ttl, tc.expected)
+		}
+	}
+}
+
+func TestConsolidate(t *testing.T) {
+	s := protov3.FetchResponse{
+		Name:      "foo.bar",
+		StartTime: 1200,
+		StopTime:  1800,
+		StepTime:  60,
+		Values:    []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+	}
+
+	for _, tc := range []struct {
+		f        string
+		expected []float64
+	}{
+		{f: "average", expected: []float64{3, 8}},
+		{f: "sum", expected: []float64{15, 40}},
+		{f: "min", expected: []float64{1, 6}},
+		{f: "max", expected: []float64{5, 10}},
+		{f: "last", expected: []float64{5, 10}},
+	} {
+		s.ConsolidationFunc = tc.f
+		res := consolidate(s, 300, 0)
+		if res.StartTime != 1200 || res.StepTime != 300 || !reflect.DeepEqual(res.Values, tc.expected) {
+			t.Errorf("%v: got %v, expected %v", tc.f, res, tc.expected)
+		}
+	}
+}
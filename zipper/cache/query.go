@@ -2,10 +2,11 @@ package cache
 
 import (
 	"context"
+	"expvar"
+	"math/rand"
 	"sync"
 	"sync/atomic"
-
-	"github.com/dgryski/go-expirecache"
+	"time"
 )
 
 const (
@@ -14,12 +15,27 @@ const (
 	DataIsAvailable
 )
 
+// Kinds of negative results, that are cached with their own TTLs
+const (
+	positiveResult uint64 = iota
+	emptyResult
+	failedResult
+)
+
 type QueryItem struct {
 	sync.RWMutex
 	Key           string
 	Data          atomic.Value
 	Flags         uint64 // DataIsAvailable or QueryIsPending
 	QueryFinished chan struct{}
+	// positiveResult, emptyResult or failedResult
+	result uint64
+
+	// data of the expired item with the same key, that can be served until staleUntil if the query fails, or until
+	// revalidateUntil while the item is refreshed
+	stale           interface{}
+	staleUntil      time.Time
+	revalidateUntil time.Time
 
 	parent *QueryCache
 }
@@ -29,15 +45,19 @@ func (q *QueryItem) GetStatus() uint64 {
 	return s
 }
 
+// FetchOrLock returns cached data or waits for the query that is already running. If there is no such query,
+// it returns false and caller becomes responsible for calling StoreAndUnlock or StoreAbort
 func (q *QueryItem) FetchOrLock(ctx context.Context) (interface{}, bool) {
 	d := q.Data.Load()
 	if d != nil {
+		q.parent.hit(q)
 		return d, true
 	}
 
 	ok := atomic.CompareAndSwapUint64(&q.Flags, Empty, QueryIsPending)
 	if ok {
 		// We are the leader now and will be fetching the data
+		q.parent.miss()
 		return nil, false
 	}
 
@@ -46,14 +66,49 @@ func (q *QueryItem) FetchOrLock(ctx context.Context) (interface{}, bool) {
 
 	select {
 	case <-ctx.Done():
+		q.parent.hit(q)
 		return nil, true
 	case <-q.QueryFinished:
 		break
 	}
 
+	q.parent.hit(q)
 	return q.Data.Load(), true
 }
 
+// HasStale returns true if item has stale data, that can be served if the query fails
+func (q *QueryItem) HasStale() bool {
+	return q.stale != nil && time.Now().Before(q.staleUntil)
+}
+
+// Stale returns stale data, that can be served as the query failed
+func (q *QueryItem) Stale() (interface{}, bool) {
+	if !q.HasStale() {
+		return nil, false
+	}
+	q.parent.staleHit()
+	return q.stale, true
+}
+
+// Revalidate returns stale data, if it can be served right away while the item is refreshed in background. The first
+// caller gets refresh set to true and becomes responsible for calling StoreAndUnlock or StoreAbort
+func (q *QueryItem) Revalidate() (data interface{}, refresh bool, ok bool) {
+	if q.stale == nil || !time.Now().Before(q.revalidateUntil) || q.Data.Load() != nil {
+		return nil, false, false
+	}
+	refresh = atomic.CompareAndSwapUint64(&q.Flags, Empty, QueryIsPending)
+	if refresh {
+		q.parent.miss()
+	}
+	q.parent.staleHit()
+	return q.stale, refresh, true
+}
+
+// Failed returns true if item holds result of the request, that failed
+func (q *QueryItem) Failed() bool {
+	return atomic.LoadUint64(&q.result) == failedResult
+}
+
 func (q *QueryItem) StoreAbort() {
 	d := q.Data.Load()
 	if d != nil {
@@ -71,28 +126,126 @@ func (q *QueryItem) StoreAndUnlock(data interface{}, size uint64) {
 	q.Data.Store(data)
 	atomic.StoreUint64(&q.Flags, DataIsAvailable)
 	close(q.QueryFinished)
-	atomic.AddUint64(&q.parent.totalSize, size)
+	if q.parent != nil {
+		atomic.AddUint64(&q.parent.totalSize, size)
+	}
 }
 
+// StoreNegativeAndUnlock stores result of the request, that found nothing (failed is false) or failed. It's kept for
+// cache's empty or error TTL instead of the usual one. If that TTL is zero, result is not stored and false is returned
+func (q *QueryItem) StoreNegativeAndUnlock(data interface{}, failed bool) bool {
+	if q.parent == nil {
+		return false
+	}
+	kind, ttl := emptyResult, q.parent.emptyTTL
+	if failed {
+		kind, ttl = failedResult, q.parent.errorTTL
+	}
+	if ttl <= 0 || !q.parent.expireAfter(q, ttl) {
+		return false
+	}
+	atomic.StoreUint64(&q.result, kind)
+	q.StoreAndUnlock(data, uint64(len(q.Key)))
+	return true
+}
+
+type element struct {
+	item       *QueryItem
+	validUntil time.Time
+	size       uint64
+}
+
+// QueryCache keeps results of identical queries for a short time, so they are sent to the backends only once.
+// Nil QueryCache is a disabled one, it never returns cached data.
 type QueryCache struct {
-	ec *expirecache.Cache
+	sync.Mutex
+	items map[string]element
+	keys  []string
+	size  uint64
+
+	maxSize    uint64
+	expireTime time.Duration
+	emptyTTL   time.Duration
+	errorTTL   time.Duration
+	staleTTL   time.Duration
+	revalidate time.Duration
 
+	// used to estimate size of the new items
 	objectCount uint64
 	totalSize   uint64
-	expireTime  int32
+
+	Hits      expvar.Int
+	Misses    expvar.Int
+	Evictions expvar.Int
+	// hits of the negative results
+	EmptyHits expvar.Int
+	ErrorHits expvar.Int
+	// expired items, that were served
+	StaleHits expvar.Int
 }
 
-func NewQueryCache(queryCacheSizeMB uint64, expireTime int32) *QueryCache {
+// NewQueryCache creates cache of approximately maxSize bytes, that keeps every item for expireTime
+func NewQueryCache(maxSize uint64, expireTime time.Duration) *QueryCache {
 	return &QueryCache{
-		ec:         expirecache.New(queryCacheSizeMB),
+		items:      make(map[string]element),
+		maxSize:    maxSize,
 		expireTime: expireTime,
 	}
 }
 
-// TODO: Make size and expire configurable
+// SetNegativeTTL enables caching of the requests, that found nothing or failed. Zero TTL disables it
+func (q *QueryCache) SetNegativeTTL(emptyTTL, errorTTL time.Duration) {
+	if q != nil {
+		q.emptyTTL = emptyTTL
+		q.errorTTL = errorTTL
+	}
+}
+
+// SetStaleTTL makes cache keep expired items for staleTTL, so they can be served if the query fails. Expired items are
+// also served right away for revalidate after expiration, while they are refreshed. Zero TTLs disable that
+func (q *QueryCache) SetStaleTTL(staleTTL, revalidate time.Duration) {
+	if q != nil {
+		q.staleTTL = staleTTL
+		q.revalidate = revalidate
+	}
+}
+
+// keepExpired returns how long expired items are kept
+func (q *QueryCache) keepExpired() time.Duration {
+	if q.revalidate > q.staleTTL {
+		return q.revalidate
+	}
+	return q.staleTTL
+}
+
+func (q *QueryCache) staleHit() {
+	if q != nil {
+		q.StaleHits.Add(1)
+	}
+}
+
+func (q *QueryCache) hit(item *QueryItem) {
+	if q == nil {
+		return
+	}
+	switch atomic.LoadUint64(&item.result) {
+	case emptyResult:
+		q.EmptyHits.Add(1)
+	case failedResult:
+		q.ErrorHits.Add(1)
+	default:
+		q.Hits.Add(1)
+	}
+}
+
+func (q *QueryCache) miss() {
+	if q != nil {
+		q.Misses.Add(1)
+	}
+}
+
+// GetQueryItem returns cached item for the key or creates an empty one
 func (q *QueryCache) GetQueryItem(k string) *QueryItem {
-	objectCount := atomic.AddUint64(&q.objectCount, 1)
-	size := atomic.AddUint64(&q.totalSize, 1)
 	emptyQueryItem := &QueryItem{
 		Key:           k,
 		QueryFinished: make(chan struct{}),
@@ -100,7 +253,160 @@ func (q *QueryCache) GetQueryItem(k string) *QueryItem {
 
 		parent: q,
 	}
-	item := q.ec.GetOrSet(k, emptyQueryItem, size/objectCount, q.expireTime).(*QueryItem)
+	if q == nil {
+		return emptyQueryItem
+	}
+
+	objectCount := atomic.AddUint64(&q.objectCount, 1)
+	size := atomic.AddUint64(&q.totalSize, 1)
+	now := time.Now()
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.clean(now)
+	e, ok := q.items[k]
+	if ok && now.Before(e.validUntil) {
+		return e.item
+	}
+	if ok {
+		q.size -= e.size
+		q.keepStale(e, emptyQueryItem, now)
+	} else {
+		q.keys = append(q.keys, k)
+	}
+
+	e = element{
+		item:       emptyQueryItem,
+		validUntil: now.Add(q.expireTime),
+		size:       size / objectCount,
+	}
+	q.items[k] = e
+	q.size += e.size
+	for q.maxSize > 0 && q.size > q.maxSize && len(q.keys) > 1 {
+		q.evict(k)
+	}
+
+	return emptyQueryItem
+}
+
+// keepStale passes data of the expired element to the item, that replaces it. Should be called with lock held
+func (q *QueryCache) keepStale(e element, item *QueryItem, now time.Time) {
+	old := e.item
+	if d := old.Data.Load(); d != nil && atomic.LoadUint64(&old.result) == positiveResult {
+		item.stale = d
+		item.staleUntil = e.validUntil.Add(q.staleTTL)
+		item.revalidateUntil = e.validUntil.Add(q.revalidate)
+	} else {
+		// query of the expired item failed, so it's still keeping the older data
+		item.stale = old.stale
+		item.staleUntil = old.staleUntil
+		item.revalidateUntil = old.revalidateUntil
+	}
+	if !now.Before(item.staleUntil) && !now.Before(item.revalidateUntil) {
+		item.stale = nil
+	}
+}
+
+// expireAfter sets expiration time of the item, returns false if item is not in the cache anymore
+func (q *QueryCache) expireAfter(item *QueryItem, ttl time.Duration) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	e, ok := q.items[item.Key]
+	if !ok || e.item != item {
+		return false
+	}
+	e.validUntil = time.Now().Add(ttl)
+	q.items[item.Key] = e
+	return true
+}
+
+// ForgetNegative expires negative result for the key, so the next request for it is sent to the backends
+func (q *QueryCache) ForgetNegative(k string) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
 
-	return item
+	e, ok := q.items[k]
+	if ok && atomic.LoadUint64(&e.item.result) != positiveResult {
+		e.validUntil = time.Time{}
+		q.items[k] = e
+	}
+}
+
+// Purge removes items with keys accepted by match, returns amount of removed items
+func (q *QueryCache) Purge(match func(key string) bool) int {
+	if q == nil {
+		return 0
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	removed := 0
+	// remove moves the last key to the removed one's place, so keys are checked from the end
+	for i := len(q.keys) - 1; i >= 0; i-- {
+		if match(q.keys[i]) {
+			q.remove(i)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Flush removes all items, returns amount of removed items
+func (q *QueryCache) Flush() int {
+	return q.Purge(func(string) bool { return true })
+}
+
+// remove deletes the key with the index i, should be called with lock held
+func (q *QueryCache) remove(i int) {
+	k := q.keys[i]
+	q.size -= q.items[k].size
+	delete(q.items, k)
+	q.keys[i] = q.keys[len(q.keys)-1]
+	q.keys = q.keys[:len(q.keys)-1]
+}
+
+// evict removes random item, except the one with key k. Should be called with lock held
+func (q *QueryCache) evict(k string) {
+	i := rand.Intn(len(q.keys))
+	if q.keys[i] == k {
+		i = (i + 1) % len(q.keys)
+	}
+	q.remove(i)
+	q.Evictions.Add(1)
+}
+
+// clean removes a sample of expired items, should be called with lock held
+func (q *QueryCache) clean(now time.Time) {
+	const sampleSize = 20
+	for i := 0; i < sampleSize && len(q.keys) > 0; i++ {
+		idx := rand.Intn(len(q.keys))
+		if q.items[q.keys[idx]].validUntil.Add(q.keepExpired()).Before(now) {
+			q.remove(idx)
+		}
+	}
+}
+
+// Items returns amount of items in the cache
+func (q *QueryCache) Items() int {
+	if q == nil {
+		return 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	return len(q.keys)
+}
+
+// Size returns approximate size of the cache
+func (q *QueryCache) Size() uint64 {
+	if q == nil {
+		return 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.size
 }
@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueryCache(t *testing.T) {
+	q := NewQueryCache(3, time.Minute)
+	ctx := context.Background()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		item := q.GetQueryItem(k)
+		if _, ok := item.FetchOrLock(ctx); ok {
+			t.Fatalf("unexpected hit for %v", k)
+		}
+		item.StoreAndUnlock(k, 0)
+	}
+
+	if v, ok := q.GetQueryItem("d").FetchOrLock(ctx); !ok || v.(string) != "d" {
+		t.Fatalf("got %v, %v, expected cached value", v, ok)
+	}
+
+	stats := q.Stats()
+	if stats.Hits != 1 || stats.Misses != 4 {
+		t.Errorf("got %v hits and %v misses, expected 1 and 4", stats.Hits, stats.Misses)
+	}
+	if stats.Evictions != 1 || stats.Items != 3 {
+		t.Errorf("got %v evictions and %v items, expected 1 and 3", stats.Evictions, stats.Items)
+	}
+}
+
+func TestQueryCacheExpiration(t *testing.T) {
+	q := NewQueryCache(0, 10*time.Millisecond)
+	ctx := context.Background()
+
+	item := q.GetQueryItem("a")
+	item.FetchOrLock(ctx)
+	item.StoreAndUnlock("a", 1)
+
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := q.GetQueryItem("a").FetchOrLock(ctx); ok {
+		t.Fatal("got expired value")
+	}
+	if items := q.Items(); items != 1 {
+		t.Errorf("got %v items, expected 1", items)
+	}
+}
+
+func TestDisabledQueryCache(t *testing.T) {
+	var q *QueryCache
+	ctx := context.Background()
+
+	item := q.GetQueryItem("a")
+	item.FetchOrLock(ctx)
+	item.StoreAndUnlock("a", 1)
+
+	if _, ok := q.GetQueryItem("a").FetchOrLock(ctx); ok {
+		t.Fatal("disabled cache returned a value")
+	}
+	if stats := q.Stats(); stats != (Stats{}) {
+		t.Errorf("disabled cache has stats %+v", stats)
+	}
+}
+
+func TestQueryCacheNegative(t *testing.T) {
+	q := NewQueryCache(0, 10*time.Millisecond)
+	q.SetNegativeTTL(time.Minute, time.Minute)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		key    string
+		failed bool
+	}{
+		{key: "empty"},
+		{key: "failed", failed: true},
+	} {
+		item := q.GetQueryItem(tc.key)
+		item.FetchOrLock(ctx)
+		if !item.StoreNegativeAndUnlock(tc.key, tc.failed) {
+			t.Fatalf("%v: negative result was not stored", tc.key)
+		}
+
+		// Negative TTL is longer than the usual one
+		time.Sleep(20 * time.Millisecond)
+		item = q.GetQueryItem(tc.key)
+		if v, ok := item.FetchOrLock(ctx); !ok || v.(string) != tc.key || item.Failed() != tc.failed {
+			t.Fatalf("%v: got %v, %v, failed %v, expected cached value", tc.key, v, ok, item.Failed())
+		}
+
+		q.ForgetNegative(tc.key)
+		if _, ok := q.GetQueryItem(tc.key).FetchOrLock(ctx); ok {
+			t.Fatalf("%v: got forgotten value", tc.key)
+		}
+	}
+
+	stats := q.Stats()
+	if stats.Hits != 0 || stats.EmptyHits != 1 || stats.ErrorHits != 1 {
+		t.Errorf("got %v hits, %v empty hits and %v error hits, expected 0, 1 and 1", stats.Hits, stats.EmptyHits, stats.ErrorHits)
+	}
+
+	q.SetNegativeTTL(0, 0)
+	item := q.GetQueryItem("not stored")
+	item.FetchOrLock(ctx)
+	if item.StoreNegativeAndUnlock("not stored", true) {
+		t.Error("negative result was stored with zero TTL")
+	}
+}
+
+func TestQueryCacheStale(t *testing.T) {
+	q := NewQueryCache(0, 10*time.Millisecond)
+	q.SetStaleTTL(time.Minute, 0)
+	ctx := context.Background()
+
+	item := q.GetQueryItem("a")
+	item.FetchOrLock(ctx)
+	item.StoreAndUnlock("a", 1)
+	time.Sleep(20 * time.Millisecond)
+
+	item = q.GetQueryItem("a")
+	if _, ok := item.FetchOrLock(ctx); ok {
+		t.Fatal("got expired value")
+	}
+	if _, _, ok := item.Revalidate(); ok {
+		t.Fatal("stale value is served without revalidate window")
+	}
+	// query fails, stale value should be kept for the next item
+	item.StoreAbort()
+	time.Sleep(20 * time.Millisecond)
+
+	item = q.GetQueryItem("a")
+	item.FetchOrLock(ctx)
+	if v, ok := item.Stale(); !ok || v.(string) != "a" {
+		t.Fatalf("got %v, %v, expected stale value", v, ok)
+	}
+	if hits := q.StaleHits.Value(); hits != 1 {
+		t.Errorf("got %v stale hits, expected 1", hits)
+	}
+}
+
+func TestQueryCacheRevalidate(t *testing.T) {
+	q := NewQueryCache(0, 10*time.Millisecond)
+	q.SetStaleTTL(0, time.Minute)
+	ctx := context.Background()
+
+	item := q.GetQueryItem("a")
+	item.FetchOrLock(ctx)
+	item.StoreAndUnlock("a", 1)
+	time.Sleep(20 * time.Millisecond)
+
+	item = q.GetQueryItem("a")
+	v, refresh, ok := item.Revalidate()
+	if !ok || !refresh || v.(string) != "a" {
+		t.Fatalf("got %v, %v, %v, expected stale value and refresh", v, refresh, ok)
+	}
+	if _, refresh, ok := q.GetQueryItem("a").Revalidate(); !ok || refresh {
+		t.Fatalf("got %v, %v, expected stale value without refresh", ok, refresh)
+	}
+	item.StoreAndUnlock("b", 1)
+
+	if v, ok := q.GetQueryItem("a").FetchOrLock(ctx); !ok || v.(string) != "b" {
+		t.Fatalf("got %v, %v, expected refreshed value", v, ok)
+	}
+	if _, _, ok := q.GetQueryItem("a").Revalidate(); ok {
+		t.Fatal("stale value is served instead of the refreshed one")
+	}
+}
+
+func TestQueryCachePurge(t *testing.T) {
+	q := NewQueryCache(0, time.Minute)
+	Register("purge", map[string]*QueryCache{"fetch": q})
+	ctx := context.Background()
+
+	keys := []string{
+		"prefix=purge&a.b.c&start=1&stop=2\n",
+		"prefix=purge&a.b.d&start=1&stop=2\n&b.c&start=1&stop=2\n",
+		"prefix=purge&b.d&start=1&stop=2\n",
+	}
+	for _, k := range keys {
+		item := q.GetQueryItem(k)
+		item.FetchOrLock(ctx)
+		item.StoreAndUnlock(k, 1)
+	}
+
+	res := Purge("purge", "", func(metric string) bool { return metric == "b.c" })
+	if res["purge"]["fetch"] != 1 || q.Items() != 2 {
+		t.Errorf("got %v removed and %v left, expected 1 and 2", res, q.Items())
+	}
+	if _, ok := q.GetQueryItem(keys[0]).FetchOrLock(ctx); !ok {
+		t.Error("item that was not purged is not cached")
+	}
+
+	res = Flush("purge", "find")
+	if len(res["purge"]) != 0 || q.Items() != 2 {
+		t.Errorf("got %v removed and %v left, expected none and 2", res, q.Items())
+	}
+	res = Flush("purge", "")
+	if res["purge"]["fetch"] != 2 || q.Items() != 0 {
+		t.Errorf("got %v removed and %v left, expected 2 and none", res, q.Items())
+	}
+}
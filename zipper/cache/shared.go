@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	bytescache "github.com/go-graphite/carbonzipper/cache"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+const (
+	defaultSharedTimeout = 50 * time.Millisecond
+	defaultSharedTTL     = 60 * time.Second
+)
+
+// first byte of the cached value
+const (
+	formatRaw byte = iota
+	formatGzip
+)
+
+// Counters of the shared cache, they should be published by the caller
+var (
+	SharedHits     expvar.Int
+	SharedMisses   expvar.Int
+	SharedTimeouts expvar.Int
+)
+
+type message interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+// SharedCache is a second-level cache for serialized responses, that is consulted when QueryCache doesn't have them.
+// Nil SharedCache is a disabled one
+type SharedCache struct {
+	c        bytescache.BytesCache
+	compress bool
+	findTTL  int32
+	fetchTTL int32
+	// keys of the stored responses, as memcache can't list them
+	index *keyIndex
+}
+
+func ttlSeconds(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		ttl = defaultSharedTTL
+	}
+	if ttl < time.Second {
+		return 1
+	}
+	return int32(ttl.Seconds())
+}
+
+// NewSharedCache creates shared cache from config, returns nil if it's disabled
+func NewSharedCache(config types.SharedCache) (*SharedCache, error) {
+	var c bytescache.BytesCache
+	switch config.Type {
+	case "":
+		return nil, nil
+	case "memcache":
+		if len(config.Servers) == 0 {
+			return nil, fmt.Errorf("no servers specified for memcache shared cache")
+		}
+		timeout := config.Timeout
+		if timeout <= 0 {
+			timeout = defaultSharedTimeout
+		}
+		c = bytescache.NewMemcachedWithTimeout(config.Prefix, timeout, config.Servers...)
+	case "mem":
+		c = bytescache.NewExpireCache(config.Size)
+	default:
+		return nil, fmt.Errorf("unknown shared cache type '%v', supported: memcache, mem", config.Type)
+	}
+
+	return &SharedCache{
+		c:        c,
+		compress: config.Compress,
+		findTTL:  ttlSeconds(config.FindTTL),
+		fetchTTL: ttlSeconds(config.FetchTTL),
+		index:    newKeyIndex(),
+	}, nil
+}
+
+func (s *SharedCache) get(key string, m message) bool {
+	if s == nil {
+		return false
+	}
+	data, err := s.c.Get(key)
+	if err == bytescache.ErrTimeout {
+		SharedTimeouts.Add(1)
+		return false
+	}
+	if err != nil || len(data) == 0 {
+		SharedMisses.Add(1)
+		return false
+	}
+
+	payload := data[1:]
+	if data[0] == formatGzip {
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err == nil {
+			payload, err = ioutil.ReadAll(r)
+		}
+		if err != nil {
+			SharedMisses.Add(1)
+			return false
+		}
+	}
+	if err := m.Unmarshal(payload); err != nil {
+		SharedMisses.Add(1)
+		return false
+	}
+	SharedHits.Add(1)
+	return true
+}
+
+func (s *SharedCache) set(key string, m message, ttl int32) {
+	payload, err := m.Marshal()
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	if s.compress {
+		buf.WriteByte(formatGzip)
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return
+		}
+		if err := w.Close(); err != nil {
+			return
+		}
+	} else {
+		buf.Grow(len(payload) + 1)
+		buf.WriteByte(formatRaw)
+		buf.Write(payload)
+	}
+	s.c.Set(key, buf.Bytes(), ttl)
+	s.index.add(key, ttl)
+}
+
+// Purge removes responses, that were requested for metrics accepted by match. Only responses stored by this zipper are
+// removed, as memcache can't list the keys. Returns amount of removed responses
+func (s *SharedCache) Purge(match func(metric string) bool) int {
+	if s == nil {
+		return 0
+	}
+	keys := s.index.remove(func(key string) bool {
+		// keys are "find&" or "fetch&" followed by the key of the query cache
+		for _, metric := range keyMetrics(key[strings.Index(key, "&")+1:]) {
+			if match(metric) {
+				return true
+			}
+		}
+		return false
+	})
+	for _, k := range keys {
+		s.c.Delete(k)
+	}
+	return len(keys)
+}
+
+// Flush removes all responses stored by this zipper, returns amount of removed responses
+func (s *SharedCache) Flush() int {
+	return s.Purge(func(string) bool { return true })
+}
+
+// GetFind returns cached find response
+func (s *SharedCache) GetFind(key string) (*protov3.MultiGlobResponse, bool) {
+	var r protov3.MultiGlobResponse
+	if !s.get("find&"+key, &r) {
+		return nil, false
+	}
+	return &r, true
+}
+
+// SetFind stores find response
+func (s *SharedCache) SetFind(key string, r *protov3.MultiGlobResponse) {
+	if s != nil {
+		s.set("find&"+key, r, s.findTTL)
+	}
+}
+
+// GetFetch returns cached fetch response
+func (s *SharedCache) GetFetch(key string) (*protov3.MultiFetchResponse, bool) {
+	var r protov3.MultiFetchResponse
+	if !s.get("fetch&"+key, &r) {
+		return nil, false
+	}
+	return &r, true
+}
+
+// SetFetch stores fetch response
+func (s *SharedCache) SetFetch(key string, r *protov3.MultiFetchResponse) {
+	if s != nil {
+		s.set("fetch&"+key, r, s.fetchTTL)
+	}
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/cache/memcachetest"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+func TestSharedCache(t *testing.T) {
+	server, err := memcachetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	response := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo.bar", StopTime: 180, StepTime: 60, Values: []float64{0, 1, 2}},
+		},
+	}
+
+	for _, compress := range []bool{false, true} {
+		c, err := NewSharedCache(types.SharedCache{
+			Type:     "memcache",
+			Servers:  []string{server.Addr()},
+			Prefix:   "test",
+			Timeout:  time.Second,
+			Compress: compress,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := "prefix=root&foo.*"
+		if compress {
+			key += "&compressed"
+		}
+		hits, misses := SharedHits.Value(), SharedMisses.Value()
+		if _, ok := c.GetFetch(key); ok {
+			t.Fatal("got response for unknown key")
+		}
+		c.SetFetch(key, response)
+
+		var res *protov3.MultiFetchResponse
+		var ok bool
+		// memcached client stores values asynchronously
+		for i := 0; i < 100 && !ok; i++ {
+			time.Sleep(10 * time.Millisecond)
+			res, ok = c.GetFetch(key)
+		}
+		if !ok {
+			t.Fatalf("compress %v: response was not cached", compress)
+		}
+		if len(res.Metrics) != 1 || res.Metrics[0].Name != "foo.bar" || len(res.Metrics[0].Values) != 3 {
+			t.Errorf("compress %v: got %v, expected %v", compress, res, response)
+		}
+		if SharedHits.Value()-hits != 1 || SharedMisses.Value()-misses < 1 {
+			t.Errorf("compress %v: unexpected counters: hits %v, misses %v", compress, SharedHits.Value()-hits, SharedMisses.Value()-misses)
+		}
+		if _, ok := c.GetFind(key); ok {
+			t.Errorf("compress %v: find and fetch responses share the key", compress)
+		}
+	}
+
+	var disabled *SharedCache
+	disabled.SetFind("key", &protov3.MultiGlobResponse{})
+	if _, ok := disabled.GetFind("key"); ok {
+		t.Error("disabled cache returned a response")
+	}
+}
+
+func TestSharedCachePurge(t *testing.T) {
+	c, err := NewSharedCache(types.SharedCache{Type: "mem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &protov3.MultiFetchResponse{}
+	c.SetFetch("prefix=root&foo.*&start=0&stop=60", response)
+	c.SetFetch("prefix=root&bar.baz&start=0&stop=60", response)
+	c.SetFind("prefix=root&foo.*", &protov3.MultiGlobResponse{})
+
+	if removed := c.Purge(func(metric string) bool { return metric == "foo.*" }); removed != 2 {
+		t.Errorf("%v responses are purged, expected 2", removed)
+	}
+	if _, ok := c.GetFetch("prefix=root&foo.*&start=0&stop=60"); ok {
+		t.Error("purged response is still served")
+	}
+	if _, ok := c.GetFetch("prefix=root&bar.baz&start=0&stop=60"); !ok {
+		t.Error("response that doesn't match was purged")
+	}
+	if removed := c.Flush(); removed != 1 {
+		t.Errorf("%v responses are flushed, expected 1", removed)
+	}
+}
+
+func TestSharedCacheConfig(t *testing.T) {
+	tests := []struct {
+		config types.SharedCache
+		valid  bool
+	}{
+		{config: types.SharedCache{}, valid: true},
+		{config: types.SharedCache{Type: "mem"}, valid: true},
+		{config: types.SharedCache{Type: "memcache", Servers: []string{"127.0.0.1:11211"}}, valid: true},
+		{config: types.SharedCache{Type: "memcache"}},
+		{config: types.SharedCache{Type: "redis"}},
+	}
+	for _, tt := range tests {
+		_, err := NewSharedCache(tt.config)
+		if (err == nil) != tt.valid {
+			t.Errorf("config %+v: got error %v, expected valid: %v", tt.config, err, tt.valid)
+		}
+	}
+}
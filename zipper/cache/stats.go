@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats contains counters of one query cache
+type Stats struct {
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	Evictions int64  `json:"evictions"`
+	EmptyHits int64  `json:"emptyHits"`
+	ErrorHits int64  `json:"errorHits"`
+	StaleHits int64  `json:"staleHits"`
+	Items     int    `json:"items"`
+	Size      uint64 `json:"size"`
+}
+
+// Stats returns current counters of the cache
+func (q *QueryCache) Stats() Stats {
+	if q == nil {
+		return Stats{}
+	}
+	return Stats{
+		Hits:      q.Hits.Value(),
+		Misses:    q.Misses.Value(),
+		Evictions: q.Evictions.Value(),
+		EmptyHits: q.EmptyHits.Value(),
+		ErrorHits: q.ErrorHits.Value(),
+		StaleHits: q.StaleHits.Value(),
+		Items:     q.Items(),
+		Size:      q.Size(),
+	}
+}
+
+// caches contains query caches of all groups by group name and cache kind (info, find, fetch, probe)
+var caches = struct {
+	sync.RWMutex
+	m map[string]map[string]*QueryCache
+}{
+	m: make(map[string]map[string]*QueryCache),
+}
+
+// Register adds caches of the group to the registry, replacing the old ones. Disabled (nil) caches are skipped
+func Register(group string, groupCaches map[string]*QueryCache) {
+	m := make(map[string]*QueryCache, len(groupCaches))
+	for kind, q := range groupCaches {
+		if q != nil {
+			m[kind] = q
+		}
+	}
+
+	caches.Lock()
+	caches.m[group] = m
+	caches.Unlock()
+}
+
+// Lookup returns registered cache of the group and kind, nil if there is none
+func Lookup(group, kind string) *QueryCache {
+	caches.RLock()
+	defer caches.RUnlock()
+	return caches.m[group][kind]
+}
+
+// Unregister removes caches of the group from the registry. Should be called when group is removed
+func Unregister(group string) {
+	caches.Lock()
+	delete(caches.m, group)
+	caches.Unlock()
+}
+
+// Caches returns all registered caches by group name and cache kind
+func Caches() map[string]map[string]*QueryCache {
+	caches.RLock()
+	defer caches.RUnlock()
+
+	res := make(map[string]map[string]*QueryCache, len(caches.m))
+	for group, m := range caches.m {
+		res[group] = m
+	}
+	return res
+}
+
+// AllStats returns counters of all registered caches, suitable for expvar.Func
+func AllStats() interface{} {
+	res := make(map[string]map[string]Stats)
+	for group, m := range Caches() {
+		res[group] = make(map[string]Stats, len(m))
+		for kind, q := range m {
+			res[group][kind] = q.Stats()
+		}
+	}
+	return res
+}
+
+// keyMetrics returns metric names the key was built from. Keys of the broadcast groups are "prefix=<group>" followed by
+// "&<name>" for every metric, fetch keys also have "&start=<from>&stop=<until>" after every name
+func keyMetrics(key string) []string {
+	if !strings.HasPrefix(key, "prefix=") {
+		return []string{key}
+	}
+	parts := strings.Split(key, "&")
+	res := make([]string, 0, len(parts)-1)
+	for _, p := range parts[1:] {
+		if strings.HasPrefix(p, "start=") || strings.HasPrefix(p, "stop=") {
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// selected returns registered caches of the group and kind, empty group or kind selects all of them
+func selected(group, kind string) map[string]map[string]*QueryCache {
+	res := make(map[string]map[string]*QueryCache)
+	for g, m := range Caches() {
+		if group != "" && g != group {
+			continue
+		}
+		for k, q := range m {
+			if kind != "" && k != kind {
+				continue
+			}
+			if res[g] == nil {
+				res[g] = make(map[string]*QueryCache)
+			}
+			res[g][k] = q
+		}
+	}
+	return res
+}
+
+// Purge removes items, that were requested for metrics accepted by match, from the caches of the group and kind. Empty
+// group or kind selects all of them. Returns amount of removed items by group name and cache kind
+func Purge(group, kind string, match func(metric string) bool) map[string]map[string]int {
+	res := make(map[string]map[string]int)
+	for g, m := range selected(group, kind) {
+		res[g] = make(map[string]int, len(m))
+		for k, q := range m {
+			res[g][k] = q.Purge(func(key string) bool {
+				for _, metric := range keyMetrics(key) {
+					if match(metric) {
+						return true
+					}
+				}
+				return false
+			})
+		}
+	}
+	return res
+}
+
+// Flush removes all items from the caches of the group and kind. Empty group or kind selects all of them. Returns
+// amount of removed items by group name and cache kind
+func Flush(group, kind string) map[string]map[string]int {
+	res := make(map[string]map[string]int)
+	for g, m := range selected(group, kind) {
+		res[g] = make(map[string]int, len(m))
+		for k, q := range m {
+			res[g][k] = q.Flush()
+		}
+	}
+	return res
+}
+
+// index is cleaned from expired keys when it grows to that size at least
+const minKeyIndexClean = 1024
+
+// keyIndex remembers keys of the items, that are stored in caches that can't list their keys, so they can be purged
+type keyIndex struct {
+	sync.Mutex
+	keys    map[string]time.Time
+	cleanAt int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		keys:    make(map[string]time.Time),
+		cleanAt: minKeyIndexClean,
+	}
+}
+
+// add remembers the key of the item, that is kept for ttl seconds
+func (x *keyIndex) add(key string, ttl int32) {
+	now := time.Now()
+	x.Lock()
+	defer x.Unlock()
+
+	x.keys[key] = now.Add(time.Duration(ttl) * time.Second)
+	if len(x.keys) < x.cleanAt {
+		return
+	}
+	for k, validUntil := range x.keys {
+		if validUntil.Before(now) {
+			delete(x.keys, k)
+		}
+	}
+	x.cleanAt = 2 * len(x.keys)
+	if x.cleanAt < minKeyIndexClean {
+		x.cleanAt = minKeyIndexClean
+	}
+}
+
+// remove forgets keys accepted by match and returns the ones, that are not expired yet
+func (x *keyIndex) remove(match func(key string) bool) []string {
+	now := time.Now()
+	x.Lock()
+	defer x.Unlock()
+
+	var res []string
+	for k, validUntil := range x.keys {
+		if validUntil.Before(now) {
+			delete(x.keys, k)
+			continue
+		}
+		if match(k) {
+			delete(x.keys, k)
+			res = append(res, k)
+		}
+	}
+	return res
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"time"
 
+	"github.com/go-graphite/carbonzipper/pathcache"
 	"github.com/go-graphite/carbonzipper/zipper/types"
 )
 
@@ -22,4 +23,10 @@ type Config struct {
 	InternalRoutingCache time.Duration
 	Timeouts             types.Timeouts
 	KeepAliveInterval    time.Duration `yaml:"keepAliveInterval"`
+
+	Guardrails types.Guardrails `mapstructure:"guardrails"`
+	Routing    pathcache.Config `mapstructure:"routing"`
+
+	SharedCache types.SharedCache `mapstructure:"sharedCache"`
+	FetchChunks types.FetchChunks `mapstructure:"fetchChunks"`
 }
@@ -54,7 +54,8 @@ type DummyClient struct {
 	fetchResponses map[string]FetchResponse
 	findResponses  map[string]FindResponse
 	infoResponses  map[string]InfoResponse
-	statsResponses map[string]StatsResponse
+	listResponses  ListResponse
+	statsResponses StatsResponse
 	probeResponses ProbeResponse
 	alwaysTimeout  time.Duration
 }
@@ -68,7 +69,6 @@ func NewDummyClient(name string, backends []string, maxMetricsPerRequest int) *D
 		fetchResponses: make(map[string]FetchResponse),
 		findResponses:  make(map[string]FindResponse),
 		infoResponses:  make(map[string]InfoResponse),
-		statsResponses: make(map[string]StatsResponse),
 		alwaysTimeout:  0,
 	}
 }
@@ -82,7 +82,6 @@ func NewDummyClientWithTimeout(name string, backends []string, maxMetricsPerRequ
 		fetchResponses: make(map[string]FetchResponse),
 		findResponses:  make(map[string]FindResponse),
 		infoResponses:  make(map[string]InfoResponse),
-		statsResponses: make(map[string]StatsResponse),
 		alwaysTimeout:  alwaysTimeout,
 	}
 }
@@ -186,12 +185,30 @@ func (c *DummyClient) Info(ctx context.Context, request *protov3.MultiMetricsInf
 	return nil, nil, errors.Fatalf("not implemented")
 }
 
+func (c *DummyClient) SetListResponse(response ListResponse) {
+	c.listResponses = response
+}
+
 func (c *DummyClient) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.Fatalf("not implemented")
+	if c.alwaysTimeout > 0 {
+		time.Sleep(c.alwaysTimeout)
+		return nil, nil, errors.Fatalf("timeout fetching response")
+	}
+
+	return c.listResponses.Response, c.listResponses.Stats, c.listResponses.Errors
+}
+
+func (c *DummyClient) SetStatsResponse(response StatsResponse) {
+	c.statsResponses = response
 }
 
 func (c *DummyClient) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.Fatalf("not implemented")
+	if c.alwaysTimeout > 0 {
+		time.Sleep(c.alwaysTimeout)
+		return nil, nil, errors.Fatalf("timeout fetching response")
+	}
+
+	return c.statsResponses.Response, c.statsResponses.Stats, c.statsResponses.Errors
 }
 
 func (c *DummyClient) SetTLDResponse(response ProbeResponse) {
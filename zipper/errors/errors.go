@@ -6,6 +6,9 @@ import (
 	"errors"
 )
 
+// ErrCircuitOpen is returned instead of sending request to the server, which circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
 type Errors struct {
 	HaveFatalErrors bool
 	Errors          []error
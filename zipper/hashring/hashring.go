@@ -0,0 +1,176 @@
+package hashring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// HashType defines how positions on the ring are calculated
+type HashType int
+
+const (
+	// CarbonCH is compatible with carbon-relay's and carbon-c-relay's carbon_ch
+	CarbonCH HashType = iota
+	// FNV1aCH is compatible with carbon-relay's and carbon-c-relay's fnv1a_ch
+	FNV1aCH
+)
+
+// amount of positions each node takes on the ring, same as in carbon-relay
+const replicas = 100
+
+// Node describes one server on the ring
+type Node struct {
+	// Server is the name of the client that serves data for this node
+	Server   string
+	Host     string
+	Port     string
+	Instance string
+}
+
+// ParseNode parses node definition in carbon-c-relay format: host[:port][=instance]
+func ParseNode(server, definition string) (Node, error) {
+	n := Node{
+		Server: server,
+	}
+
+	if idx := strings.LastIndex(definition, "="); idx >= 0 {
+		n.Instance = definition[idx+1:]
+		definition = definition[:idx]
+	}
+
+	if idx := strings.LastIndex(definition, ":"); idx >= 0 && !strings.HasSuffix(definition, "]") {
+		n.Host = definition[:idx]
+		n.Port = definition[idx+1:]
+	} else {
+		n.Host = definition
+	}
+	n.Host = strings.TrimSuffix(strings.TrimPrefix(n.Host, "["), "]")
+
+	if n.Host == "" {
+		return n, fmt.Errorf("empty host in hash ring node definition '%v'", definition)
+	}
+
+	return n, nil
+}
+
+// NodeFromURL creates node for the server using host and port of the server's URL
+func NodeFromURL(server string) (Node, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return Node{}, err
+	}
+	if u.Hostname() == "" {
+		return Node{}, fmt.Errorf("can't get host from server '%v'", server)
+	}
+
+	return Node{
+		Server: server,
+		Host:   u.Hostname(),
+		Port:   u.Port(),
+	}, nil
+}
+
+type entry struct {
+	position int
+	node     int
+}
+
+// Ring is a consistent hashing ring, that is compatible with carbon-relay and carbon-c-relay
+type Ring struct {
+	hashType HashType
+	nodes    []Node
+	entries  []entry
+}
+
+// New creates new ring that contains all the nodes
+func New(hashType HashType, nodes []Node) *Ring {
+	r := &Ring{
+		hashType: hashType,
+		nodes:    nodes,
+		entries:  make([]entry, 0, len(nodes)*replicas),
+	}
+
+	taken := make(map[int]struct{}, len(nodes)*replicas)
+	for i, n := range nodes {
+		for j := 0; j < replicas; j++ {
+			pos := r.position(r.nodeKey(n, j))
+			// carbon-relay moves replica to the next free position in case of collision
+			for {
+				if _, ok := taken[pos]; !ok {
+					break
+				}
+				pos++
+			}
+			taken[pos] = struct{}{}
+			r.entries = append(r.entries, entry{position: pos, node: i})
+		}
+	}
+
+	sort.Slice(r.entries, func(i, j int) bool {
+		return r.entries[i].position < r.entries[j].position
+	})
+
+	return r
+}
+
+func (r *Ring) nodeKey(n Node, replica int) string {
+	switch r.hashType {
+	case FNV1aCH:
+		if n.Instance != "" {
+			return fmt.Sprintf("%d-%s", replica, n.Instance)
+		}
+		return fmt.Sprintf("%d-%s@%s", replica, n.Port, n.Host)
+	default:
+		if n.Instance != "" {
+			return fmt.Sprintf("('%s', '%s'):%d", n.Host, n.Instance, replica)
+		}
+		return fmt.Sprintf("('%s', None):%d", n.Host, replica)
+	}
+}
+
+func (r *Ring) position(key string) int {
+	switch r.hashType {
+	case FNV1aCH:
+		h := fnv.New32a()
+		/* #nosec */
+		_, _ = h.Write([]byte(key))
+		sum := h.Sum32()
+		return int((sum >> 16) ^ (sum & 0xffff))
+	default:
+		sum := md5.Sum([]byte(key))
+		return int(binary.BigEndian.Uint16(sum[:2]))
+	}
+}
+
+// GetNodes returns names of up to count servers that own the metric, in order of preference
+func (r *Ring) GetNodes(metric string, count int) []string {
+	if len(r.entries) == 0 {
+		return nil
+	}
+	if count > len(r.nodes) {
+		count = len(r.nodes)
+	}
+
+	pos := r.position(metric)
+	idx := sort.Search(len(r.entries), func(i int) bool {
+		return r.entries[i].position >= pos
+	})
+
+	res := make([]string, 0, count)
+	seen := make(map[int]struct{}, count)
+	for i := 0; i < len(r.entries) && len(res) < count; i++ {
+		e := r.entries[(idx+i)%len(r.entries)]
+		if _, ok := seen[e.node]; ok {
+			continue
+		}
+		seen[e.node] = struct{}{}
+		res = append(res, r.nodes[e.node].Server)
+	}
+
+	return res
+}
@@ -0,0 +1,102 @@
+package hashring
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testCaseRing struct {
+	name     string
+	hashType HashType
+	nodes    []string
+	metrics  map[string][]string
+}
+
+// Expected results were generated by carbon-relay's ConsistentHashRing
+func TestGetNodes(t *testing.T) {
+	tests := []testCaseRing{
+		{
+			name:     "carbon_ch",
+			hashType: CarbonCH,
+			nodes:    []string{"10.0.0.1:2003", "10.0.0.2", "10.0.0.3:2003=c"},
+			metrics: map[string][]string{
+				"foo.bar":                      {"server3", "server1", "server2"},
+				"foo.baz":                      {"server3", "server2", "server1"},
+				"a.b.c.d":                      {"server2", "server3", "server1"},
+				"carbon.agents.host1.cpuUsage": {"server2", "server3", "server1"},
+				"test":                         {"server2", "server1", "server3"},
+			},
+		},
+		{
+			name:     "fnv1a_ch",
+			hashType: FNV1aCH,
+			nodes:    []string{"10.0.0.1:2003", "10.0.0.2:2003", "10.0.0.3:2003=c"},
+			metrics: map[string][]string{
+				"foo.bar":                      {"server3", "server1", "server2"},
+				"foo.baz":                      {"server1", "server2", "server3"},
+				"a.b.c.d":                      {"server3", "server1", "server2"},
+				"carbon.agents.host1.cpuUsage": {"server1", "server2", "server3"},
+				"test":                         {"server2", "server1", "server3"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := make([]Node, 0, len(tt.nodes))
+			for i, d := range tt.nodes {
+				n, err := ParseNode("server"+string('1'+rune(i)), d)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				nodes = append(nodes, n)
+			}
+			r := New(tt.hashType, nodes)
+
+			for metric, expected := range tt.metrics {
+				for count := 1; count <= len(expected)+1; count++ {
+					res := r.GetNodes(metric, count)
+					exp := expected
+					if count < len(expected) {
+						exp = expected[:count]
+					}
+					if !reflect.DeepEqual(res, exp) {
+						t.Errorf("metric %v, count %v: got %v, expected %v", metric, count, res, exp)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	tests := []struct {
+		definition string
+		expected   Node
+		isErr      bool
+	}{
+		{definition: "host", expected: Node{Server: "s", Host: "host"}},
+		{definition: "host:2003", expected: Node{Server: "s", Host: "host", Port: "2003"}},
+		{definition: "host:2003=a", expected: Node{Server: "s", Host: "host", Port: "2003", Instance: "a"}},
+		{definition: "[::1]:2003", expected: Node{Server: "s", Host: "::1", Port: "2003"}},
+		{definition: "=a", isErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.definition, func(t *testing.T) {
+			n, err := ParseNode("s", tt.definition)
+			if tt.isErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n != tt.expected {
+				t.Errorf("got %+v, expected %+v", n, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package helper
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultEjectionTime        = 10 * time.Second
+	defaultMaxEjectionTime     = 5 * time.Minute
+	defaultHealthCheckInterval = 10 * time.Second
+)
+
+var healthTrackers = struct {
+	sync.RWMutex
+	m map[string]*healthTracker
+}{
+	m: make(map[string]*healthTracker),
+}
+
+// HealthState returns health of all servers in round-robin groups that have health checks enabled, suitable for expvar.Func
+func HealthState() interface{} {
+	healthTrackers.RLock()
+	defer healthTrackers.RUnlock()
+
+	res := make(map[string]map[string]ServerHealth, len(healthTrackers.m))
+	for name, t := range healthTrackers.m {
+		res[name] = t.state()
+	}
+	return res
+}
+
+// UnregisterHealth removes health tracker of the group from the registry, that stops it's health checks. Should be
+// called when group is removed
+func UnregisterHealth(groupName string) {
+	healthTrackers.Lock()
+	delete(healthTrackers.m, groupName)
+	healthTrackers.Unlock()
+}
+
+// registered returns false if tracker was unregistered or replaced by tracker of the new group with the same name
+func (t *healthTracker) registered() bool {
+	healthTrackers.RLock()
+	defer healthTrackers.RUnlock()
+	return healthTrackers.m[t.groupName] == t
+}
+
+// ServerHealth describes current health state of a server
+type ServerHealth struct {
+	Ejected             bool      `json:"ejected"`
+	EjectedUntil        time.Time `json:"ejected_until,omitempty"`
+	Ejections           int       `json:"ejections"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+type serverHealth struct {
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+	// server was ejected by failed probes, so successful probe readmits it
+	ejectedByProbe bool
+}
+
+// healthTracker ejects servers that fail too often or are much slower than the rest of the group
+type healthTracker struct {
+	sync.RWMutex
+	groupName string
+	servers   []string
+	config    types.HealthCheck
+	logger    *zap.Logger
+	latency   *latencyTracker
+
+	health map[string]*serverHealth
+}
+
+func newHealthTracker(logger *zap.Logger, groupName string, servers []string, config *types.HealthCheck, latency *latencyTracker) *healthTracker {
+	if config == nil {
+		return nil
+	}
+
+	t := &healthTracker{
+		groupName: groupName,
+		servers:   servers,
+		config:    *config,
+		logger:    logger.With(zap.String("function", "healthTracker")),
+		latency:   latency,
+		health:    make(map[string]*serverHealth, len(servers)),
+	}
+	if t.config.ConsecutiveFailures <= 0 {
+		t.config.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if t.config.EjectionTime <= 0 {
+		t.config.EjectionTime = defaultEjectionTime
+	}
+	if t.config.MaxEjectionTime < t.config.EjectionTime {
+		t.config.MaxEjectionTime = defaultMaxEjectionTime
+		if t.config.MaxEjectionTime < t.config.EjectionTime {
+			t.config.MaxEjectionTime = t.config.EjectionTime
+		}
+	}
+	if t.config.Interval <= 0 {
+		t.config.Interval = defaultHealthCheckInterval
+	}
+	for _, s := range servers {
+		t.health[s] = &serverHealth{}
+	}
+
+	return t
+}
+
+// register adds tracker to the registry, replacing tracker of the old group with the same name. Returns false if it's
+// already registered
+func (t *healthTracker) register() bool {
+	healthTrackers.Lock()
+	defer healthTrackers.Unlock()
+
+	if healthTrackers.m[t.groupName] == t {
+		return false
+	}
+	healthTrackers.m[t.groupName] = t
+	return true
+}
+
+// eject must be called with lock held
+func (t *healthTracker) eject(server, reason string, now time.Time) {
+	h := t.health[server]
+	d := t.config.EjectionTime
+	for i := 0; i < h.ejections && d < t.config.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > t.config.MaxEjectionTime {
+		d = t.config.MaxEjectionTime
+	}
+	h.ejections++
+	h.consecutiveFailures = 0
+	h.ejectedUntil = now.Add(d)
+	h.ejectedByProbe = false
+	// latency samples taken before ejection would eject the server again right after it's readmitted
+	t.latency.reset(server)
+
+	t.logger.Warn("server ejected",
+		zap.String("server", server),
+		zap.String("reason", reason),
+		zap.Duration("ejection_time", d),
+		zap.Int("ejections", h.ejections),
+	)
+}
+
+func (t *healthTracker) success(server string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	h, ok := t.health[server]
+	if !ok {
+		return
+	}
+	h.consecutiveFailures = 0
+	// Server was healthy long enough after the last ejection, forget about it
+	if h.ejections > 0 && time.Since(h.ejectedUntil) > t.config.MaxEjectionTime {
+		h.ejections = 0
+	}
+}
+
+func (t *healthTracker) failure(server string) {
+	t.fail(server, false)
+}
+
+// fail counts failed request or probe of the server
+func (t *healthTracker) fail(server string, probe bool) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	h, ok := t.health[server]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if now.Before(h.ejectedUntil) {
+		return
+	}
+	h.consecutiveFailures++
+	if h.consecutiveFailures >= t.config.ConsecutiveFailures {
+		if probe {
+			t.eject(server, "failed probes", now)
+			h.ejectedByProbe = true
+			return
+		}
+		t.eject(server, "consecutive failures", now)
+	}
+}
+
+// readmit allows server, that was ejected by failed probes, to receive requests again. Servers ejected for failed
+// requests or latency could still answer probes, so they wait till the end of ejection time
+func (t *healthTracker) readmit(server string) {
+	t.Lock()
+	defer t.Unlock()
+
+	h, ok := t.health[server]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if h.ejectedByProbe && now.Before(h.ejectedUntil) {
+		h.ejectedUntil = now
+		t.logger.Info("server readmitted after successful probe",
+			zap.String("server", server),
+		)
+	}
+}
+
+// healthy returns servers that are not ejected. If all servers are ejected, all of them are returned.
+func (t *healthTracker) healthy() []string {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+
+	t.RLock()
+	defer t.RUnlock()
+
+	var res []string
+	for i, s := range t.servers {
+		if now.Before(t.health[s].ejectedUntil) {
+			if res == nil {
+				res = make([]string, 0, len(t.servers))
+				res = append(res, t.servers[:i]...)
+			}
+			continue
+		}
+		if res != nil {
+			res = append(res, s)
+		}
+	}
+	if len(res) == 0 {
+		return t.servers
+	}
+	return res
+}
+
+func (t *healthTracker) state() map[string]ServerHealth {
+	now := time.Now()
+
+	t.RLock()
+	defer t.RUnlock()
+
+	res := make(map[string]ServerHealth, len(t.health))
+	for s, h := range t.health {
+		sh := ServerHealth{
+			Ejected:             now.Before(h.ejectedUntil),
+			Ejections:           h.ejections,
+			ConsecutiveFailures: h.consecutiveFailures,
+		}
+		if sh.Ejected {
+			sh.EjectedUntil = h.ejectedUntil
+		}
+		res[s] = sh
+	}
+	return res
+}
+
+// checkLatency ejects servers, which median latency is LatencyFactor times bigger than median of the others
+func (t *healthTracker) checkLatency() {
+	if t.config.LatencyFactor <= 0 {
+		return
+	}
+
+	medians := make(map[string]time.Duration, len(t.servers))
+	for _, s := range t.servers {
+		if d, ok := t.latency.percentile(s, 50); ok {
+			medians[s] = d
+		}
+	}
+	if len(medians) < 2 {
+		return
+	}
+
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	for s, d := range medians {
+		others := make([]time.Duration, 0, len(medians)-1)
+		for o, od := range medians {
+			if o != s {
+				others = append(others, od)
+			}
+		}
+		sort.Slice(others, func(i, j int) bool {
+			return others[i] < others[j]
+		})
+		groupMedian := others[len(others)/2]
+		if float64(d) > t.config.LatencyFactor*float64(groupMedian) && !now.Before(t.health[s].ejectedUntil) {
+			t.eject(s, "latency outlier", now)
+		}
+	}
+}
+
+func (t *healthTracker) probe(client *http.Client, server string) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.Interval)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", server+t.config.ProbeURI, nil)
+	if err != nil {
+		t.logger.Error("failed to create probe request",
+			zap.String("server", server),
+			zap.Error(err),
+		)
+		return
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < http.StatusInternalServerError {
+			t.success(server)
+			t.readmit(server)
+			return
+		}
+	}
+	t.logger.Debug("probe failed",
+		zap.String("server", server),
+		zap.Error(err),
+	)
+	t.fail(server, true)
+}
+
+// run does active probes and latency checks
+func (t *healthTracker) run(client *http.Client) {
+	if t == nil || (t.config.ProbeURI == "" && t.config.LatencyFactor <= 0) {
+		return
+	}
+
+	ticker := time.NewTicker(t.config.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !t.registered() {
+			return
+		}
+		if t.config.ProbeURI != "" {
+			var wg sync.WaitGroup
+			for _, s := range t.servers {
+				wg.Add(1)
+				go func(s string) {
+					defer wg.Done()
+					t.probe(client, s)
+				}(s)
+			}
+			wg.Wait()
+		}
+		t.checkLatency()
+	}
+}
@@ -0,0 +1,91 @@
+package helper
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencySamples    = 128
+	minLatencySamples = 16
+)
+
+// latencyTracker keeps last latencySamples successful request durations for each server
+type latencyTracker struct {
+	sync.Mutex
+	samples map[string]*latencyWindow
+}
+
+type latencyWindow struct {
+	values []time.Duration
+	next   int
+}
+
+func newLatencyTracker(servers []string) *latencyTracker {
+	t := &latencyTracker{
+		samples: make(map[string]*latencyWindow, len(servers)),
+	}
+	for _, s := range servers {
+		t.samples[s] = &latencyWindow{
+			values: make([]time.Duration, 0, latencySamples),
+		}
+	}
+	return t
+}
+
+func (t *latencyTracker) add(server string, d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	w, ok := t.samples[server]
+	if !ok {
+		return
+	}
+	if len(w.values) < latencySamples {
+		w.values = append(w.values, d)
+		return
+	}
+	w.values[w.next] = d
+	w.next = (w.next + 1) % latencySamples
+}
+
+// reset drops samples of the server, so it's latency is judged only by requests made after that
+func (t *latencyTracker) reset(server string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	if w, ok := t.samples[server]; ok {
+		w.values = w.values[:0]
+		w.next = 0
+	}
+}
+
+// percentile returns p-th percentile of server's latency, false if there is not enough samples yet
+func (t *latencyTracker) percentile(server string, p float64) (time.Duration, bool) {
+	t.Lock()
+	w, ok := t.samples[server]
+	if !ok || len(w.values) < minLatencySamples {
+		t.Unlock()
+		return 0, false
+	}
+	values := make([]time.Duration, len(w.values))
+	copy(values, w.values)
+	t.Unlock()
+
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+
+	idx := int(float64(len(values))*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(values) {
+		idx = len(values) - 1
+	}
+	return values[idx], true
+}
@@ -0,0 +1,159 @@
+package helper
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// weight of the latest response time in the moving average
+const ewmaAlpha = 0.3
+
+// loadTracker keeps amount of in-flight requests and exponentially weighted response time for each server
+type loadTracker struct {
+	inflight map[string]*int64
+
+	sync.RWMutex
+	ewma map[string]float64
+}
+
+func newLoadTracker(servers []string) *loadTracker {
+	t := &loadTracker{
+		inflight: make(map[string]*int64, len(servers)),
+		ewma:     make(map[string]float64, len(servers)),
+	}
+	for _, s := range servers {
+		t.inflight[s] = new(int64)
+	}
+	return t
+}
+
+func (t *loadTracker) start(server string) {
+	if c, ok := t.inflight[server]; ok {
+		atomic.AddInt64(c, 1)
+	}
+}
+
+func (t *loadTracker) done(server string) {
+	if c, ok := t.inflight[server]; ok {
+		atomic.AddInt64(c, -1)
+	}
+}
+
+func (t *loadTracker) observe(server string, d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	v, ok := t.ewma[server]
+	if !ok {
+		t.ewma[server] = float64(d)
+		return
+	}
+	t.ewma[server] = ewmaAlpha*float64(d) + (1-ewmaAlpha)*v
+}
+
+// failed makes server look twice slower, so ewma will prefer other servers for a while
+func (t *loadTracker) failed(server string) {
+	t.Lock()
+	defer t.Unlock()
+
+	v := 2 * t.ewma[server]
+	if v < float64(time.Millisecond) {
+		v = float64(time.Millisecond)
+	}
+	t.ewma[server] = v
+}
+
+func (t *loadTracker) requests(server string) int64 {
+	if c, ok := t.inflight[server]; ok {
+		return atomic.LoadInt64(c)
+	}
+	return 0
+}
+
+// cost for ewma is expected time to serve one more request. Servers without any data are preferred, so they'll get some
+func (t *loadTracker) cost(server string) float64 {
+	t.RLock()
+	v := t.ewma[server]
+	t.RUnlock()
+
+	return v * float64(t.requests(server)+1)
+}
+
+// leastRequests chooses server with less in-flight requests per unit of weight out of two random ones
+func (t *loadTracker) leastRequests(servers []string, weight func(string) int) string {
+	a, b := twoRandom(servers)
+	if float64(t.requests(b)+1)/weightOf(weight, b) < float64(t.requests(a)+1)/weightOf(weight, a) {
+		return b
+	}
+	return a
+}
+
+// leastCost chooses server with smaller ewma cost per unit of weight out of two random ones
+func (t *loadTracker) leastCost(servers []string, weight func(string) int) string {
+	a, b := twoRandom(servers)
+	if t.cost(b)/weightOf(weight, b) < t.cost(a)/weightOf(weight, a) {
+		return b
+	}
+	return a
+}
+
+func weightOf(weight func(string) int, server string) float64 {
+	w := weight(server)
+	if w <= 0 {
+		// Only happens when all servers are drained
+		return 1
+	}
+	return float64(w)
+}
+
+// weightedRoundRobin is a smooth weighted round-robin, same as in nginx. Servers with weight 3 and 1 are picked as a, a, b, a
+type weightedRoundRobin struct {
+	sync.Mutex
+	current map[string]int
+}
+
+func newWeightedRoundRobin() *weightedRoundRobin {
+	return &weightedRoundRobin{
+		current: make(map[string]int),
+	}
+}
+
+func (r *weightedRoundRobin) pick(servers []string, weight func(string) int) string {
+	r.Lock()
+	defer r.Unlock()
+
+	total := 0
+	best := ""
+	for _, s := range servers {
+		w := weight(s)
+		if w <= 0 {
+			continue
+		}
+		r.current[s] += w
+		total += w
+		if best == "" || r.current[s] > r.current[best] {
+			best = s
+		}
+	}
+	if best == "" {
+		return servers[0]
+	}
+	r.current[best] -= total
+	return best
+}
+
+func twoRandom(servers []string) (string, string) {
+	if len(servers) == 1 {
+		return servers[0], servers[0]
+	}
+	/* #nosec */
+	i := rand.Intn(len(servers))
+	/* #nosec */
+	j := rand.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	return servers[i], servers[j]
+}
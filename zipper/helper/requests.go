@@ -9,10 +9,12 @@ import (
 	"net/http"
 	"net/url"
 	"sync/atomic"
+	"time"
 
 	"github.com/go-graphite/carbonzipper/limiter"
 	cu "github.com/go-graphite/carbonzipper/util/apictx"
 	util "github.com/go-graphite/carbonzipper/util/zipperctx"
+	"github.com/go-graphite/carbonzipper/zipper/breaker"
 	"github.com/go-graphite/carbonzipper/zipper/errors"
 	"github.com/go-graphite/carbonzipper/zipper/types"
 	"go.uber.org/zap"
@@ -28,23 +30,87 @@ type HttpQuery struct {
 	servers   []string
 	maxTries  int
 	logger    *zap.Logger
-	limiter   *limiter.ServerLimiter
+	limiter   limiter.ServerLimiter
 	client    *http.Client
 	encoding  string
 
+	lbMethod types.LBMethod
+	hedging  *types.Hedging
+	latency  *latencyTracker
+	health   *healthTracker
+	load     *loadTracker
+	wrr      *weightedRoundRobin
+	breakers map[string]*breaker.Breaker
+
 	counter uint64
 }
 
-func NewHttpQuery(logger *zap.Logger, groupName string, servers []string, maxTries int, limiter *limiter.ServerLimiter, client *http.Client, encoding string) *HttpQuery {
-	return &HttpQuery{
+// NewHttpQuery creates new query helper. LBMethod defines how servers are picked, anything except least_requests and ewma is treated as round-robin.
+// Hedging can be nil, in that case requests are only retried sequentially after a failure.
+// HealthCheck can be nil, in that case all servers always receive requests.
+// CircuitBreaker can be nil, in that case requests are never short-circuited.
+func NewHttpQuery(logger *zap.Logger, groupName string, servers []string, maxTries int, limiter limiter.ServerLimiter, client *http.Client, encoding string, lbMethod types.LBMethod, hedging *types.Hedging, healthCheck *types.HealthCheck, circuitBreaker *types.CircuitBreaker) *HttpQuery {
+	logger = logger.With(zap.String("action", "query"))
+	latency := newLatencyTracker(servers)
+	q := &HttpQuery{
 		groupName: groupName,
 		servers:   servers,
 		maxTries:  maxTries,
-		logger:    logger.With(zap.String("action", "query")),
+		logger:    logger,
 		limiter:   limiter,
 		client:    client,
 		encoding:  encoding,
+		lbMethod:  lbMethod,
+		hedging:   hedging,
+		latency:   latency,
+		load:      newLoadTracker(servers),
+		wrr:       newWeightedRoundRobin(),
+	}
+	if circuitBreaker != nil {
+		q.breakers = make(map[string]*breaker.Breaker, len(servers))
+		for _, s := range servers {
+			q.breakers[s] = breaker.ForServer(logger, s, *circuitBreaker)
+		}
+	}
+	if len(servers) > 1 {
+		q.health = newHealthTracker(logger, groupName, servers, healthCheck, latency)
+	}
+
+	return q
+}
+
+// Register publishes health state, circuit breakers and limiter state of the servers, and starts health checks
+func (c *HttpQuery) Register() {
+	for _, b := range c.breakers {
+		breaker.Register(b)
+	}
+	if r, ok := c.limiter.(types.Registrar); ok {
+		r.Register()
+	}
+	if c.health != nil && c.health.register() {
+		go c.health.run(c.client)
+	}
+}
+
+func (c *HttpQuery) weight(server string) int {
+	return types.ServerWeights.Get(c.groupName, server)
+}
+
+// withoutDrained removes servers with weight 0. If all servers have weight 0, all of them are returned
+func (c *HttpQuery) withoutDrained(servers []string) []string {
+	if types.ServerWeights.Uniform(c.groupName) {
+		return servers
+	}
+	res := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if c.weight(s) > 0 {
+			res = append(res, s)
+		}
+	}
+	if len(res) == 0 {
+		return servers
 	}
+	return res
 }
 
 func (c *HttpQuery) pickServer() string {
@@ -53,24 +119,32 @@ func (c *HttpQuery) pickServer() string {
 		return c.servers[0]
 	}
 	logger := c.logger.With(zap.String("function", "picker"))
-	counter := atomic.AddUint64(&(c.counter), 1)
-	idx := counter % uint64(len(c.servers))
-	srv := c.servers[int(idx)]
+	servers := c.withoutDrained(c.available())
+
+	var srv string
+	switch c.lbMethod {
+	case types.LeastRequestsLB:
+		srv = c.load.leastRequests(servers, c.weight)
+	case types.EWMALB:
+		srv = c.load.leastCost(servers, c.weight)
+	default:
+		if !types.ServerWeights.Uniform(c.groupName) {
+			srv = c.wrr.pick(servers, c.weight)
+			break
+		}
+		counter := atomic.AddUint64(&(c.counter), 1)
+		idx := counter % uint64(len(servers))
+		srv = servers[int(idx)]
+	}
 	logger.Debug("picked",
-		zap.Uint64("counter", counter),
-		zap.Uint64("idx", idx),
+		zap.Any("lb_method", c.lbMethod),
 		zap.String("Server", srv),
 	)
 
 	return srv
 }
 
-func (c *HttpQuery) doRequest(ctx context.Context, uri string, body []byte) (*ServerResponse, error) {
-	server := c.pickServer()
-	c.logger.Debug("picked server",
-		zap.String("server", server),
-	)
-
+func (c *HttpQuery) doRequest(ctx context.Context, server string, uri string, body []byte) (*ServerResponse, error) {
 	u, err := url.Parse(server + uri)
 	if err != nil {
 		return nil, err
@@ -93,21 +167,41 @@ func (c *HttpQuery) doRequest(ctx context.Context, uri string, body []byte) (*Se
 	}
 	req = cu.MarshalCtx(ctx, util.MarshalCtx(ctx, req))
 
+	b := c.breakers[server]
+	if b != nil && !b.Allow() {
+		logger.Debug("circuit breaker is open")
+		return nil, errors.ErrCircuitOpen
+	}
+	// Cancelled requests (e.x. lost hedged ones) are not server's fault
+	outcome := breaker.Ignored
+	var start time.Time
+	defer func() {
+		c.report(server, outcome, time.Since(start))
+	}()
+
 	logger.Debug("trying to get slot")
 
-	err = c.limiter.Enter(ctx, c.groupName)
+	err = c.limiter.Enter(ctx, server)
 	if err != nil {
-		logger.Debug("timeout waiting for a slot")
+		logger.Debug("timeout waiting for a slot",
+			zap.Error(err),
+		)
 		return nil, err
 	}
 	logger.Debug("got slot")
 
+	start = time.Now()
+	c.load.start(server)
+	defer c.load.done(server)
 	resp, err := c.client.Do(req.WithContext(ctx))
 	c.limiter.Leave(ctx, server)
 	if err != nil {
 		logger.Error("error fetching result",
 			zap.Error(err),
 		)
+		if ctx.Err() == nil {
+			outcome = breaker.Failure
+		}
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -117,6 +211,9 @@ func (c *HttpQuery) doRequest(ctx context.Context, uri string, body []byte) (*Se
 		logger.Error("error reading body",
 			zap.Error(err),
 		)
+		if ctx.Err() == nil {
+			outcome = breaker.Failure
+		}
 		return nil, err
 	}
 
@@ -124,13 +221,133 @@ func (c *HttpQuery) doRequest(ctx context.Context, uri string, body []byte) (*Se
 		logger.Error("status not ok",
 			zap.Int("status_code", resp.StatusCode),
 		)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			outcome = breaker.Failure
+		} else {
+			outcome = breaker.Success
+		}
 		return nil, fmt.Errorf(types.ErrFailedToFetchFmt, c.groupName, resp.StatusCode, string(body))
 	}
+	outcome = breaker.Success
+	c.latency.add(server, time.Since(start))
+	c.load.observe(server, time.Since(start))
 
 	return &ServerResponse{Server: server, Response: body}, nil
 }
 
-func (c *HttpQuery) DoQuery(ctx context.Context, uri string, body []byte) (*ServerResponse, *errors.Errors) {
+// report updates health, load and circuit breaker state of the server with the outcome of the request
+func (c *HttpQuery) report(server string, outcome breaker.Outcome, latency time.Duration) {
+	switch outcome {
+	case breaker.Success:
+		c.health.success(server)
+	case breaker.Failure:
+		c.health.failure(server)
+		c.load.failed(server)
+	}
+	if b := c.breakers[server]; b != nil {
+		b.Report(outcome, latency)
+	}
+}
+
+// available returns servers that are not ejected and don't have open circuit. If there are no such servers, all servers are returned
+func (c *HttpQuery) available() []string {
+	servers := c.servers
+	if c.health != nil {
+		servers = c.health.healthy()
+	}
+	if len(c.breakers) == 0 {
+		return servers
+	}
+
+	res := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if c.breakers[s].State() != breaker.Open {
+			res = append(res, s)
+		}
+	}
+	if len(res) == 0 {
+		return servers
+	}
+	return res
+}
+
+// hedgeDelay returns delay before hedging request to the server. Returns false if request shouldn't be hedged, as the
+// percentile of server's latency is not known yet and there is no fixed delay to fall back to
+func (c *HttpQuery) hedgeDelay(server string) (time.Duration, bool) {
+	if c.hedging.Percentile > 0 {
+		if d, ok := c.latency.percentile(server, c.hedging.Percentile); ok && d > c.hedging.Delay {
+			return d, true
+		}
+	}
+	return c.hedging.Delay, c.hedging.Delay > 0
+}
+
+type hedgeResult struct {
+	res    *ServerResponse
+	err    error
+	hedged bool
+}
+
+// doHedgedRequest sends request to one server and, if it haven't replied in time, the same request to another one.
+// First successful answer wins, the other request is cancelled.
+func (c *HttpQuery) doHedgedRequest(ctx context.Context, stats *types.Stats, uri string, body []byte) (*ServerResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resCh := make(chan hedgeResult, 2)
+	send := func(server string, hedged bool) {
+		res, err := c.doRequest(ctx, server, uri, body)
+		resCh <- hedgeResult{res: res, err: err, hedged: hedged}
+	}
+
+	server := c.pickServer()
+	go send(server, false)
+
+	// nil channel never fires, so the request is not hedged
+	var hedge <-chan time.Time
+	if delay, ok := c.hedgeDelay(server); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+
+	inflight := 1
+	for {
+		select {
+		case <-hedge:
+			hedgeServer := c.pickServer()
+			for i := 0; hedgeServer == server && i < len(c.servers); i++ {
+				hedgeServer = c.pickServer()
+			}
+			c.logger.Debug("sending hedged request",
+				zap.String("server", server),
+				zap.String("hedge_server", hedgeServer),
+			)
+			if stats != nil {
+				stats.HedgedRequests++
+			}
+			inflight++
+			go send(hedgeServer, true)
+		case r := <-resCh:
+			inflight--
+			if r.err == nil {
+				if r.hedged && stats != nil {
+					stats.HedgeWins++
+				}
+				return r.res, nil
+			}
+			if inflight == 0 {
+				return nil, r.err
+			}
+			c.logger.Debug("one of hedged requests failed, waiting for the other one",
+				zap.Error(r.err),
+			)
+		}
+	}
+}
+
+// DoQuery sends request to one of the servers, retrying on other servers in case of errors. Hedging stats are added to stats if it's not nil.
+func (c *HttpQuery) DoQuery(ctx context.Context, stats *types.Stats, uri string, body []byte) (*ServerResponse, *errors.Errors) {
 	maxTries := c.maxTries
 	if len(c.servers) > maxTries {
 		maxTries = len(c.servers)
@@ -138,7 +355,17 @@ func (c *HttpQuery) DoQuery(ctx context.Context, uri string, body []byte) (*Serv
 
 	var e errors.Errors
 	for try := 0; try < maxTries; try++ {
-		res, err := c.doRequest(ctx, uri, body)
+		var res *ServerResponse
+		var err error
+		if c.hedging.Enabled() && len(c.servers) > 1 {
+			res, err = c.doHedgedRequest(ctx, stats, uri, body)
+		} else {
+			server := c.pickServer()
+			c.logger.Debug("picked server",
+				zap.String("server", server),
+			)
+			res, err = c.doRequest(ctx, server, uri, body)
+		}
 		if err != nil {
 			c.logger.Error("have errors",
 				zap.Error(err),
@@ -0,0 +1,313 @@
+package helper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/limiter"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+
+	"go.uber.org/zap"
+)
+
+func newTestServer(delay time.Duration, status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestDoQueryHedging(t *testing.T) {
+	slow := newTestServer(2*time.Second, http.StatusOK, "slow")
+	defer slow.Close()
+	fast := newTestServer(0, http.StatusOK, "fast")
+	defer fast.Close()
+	broken := newTestServer(0, http.StatusInternalServerError, "broken")
+	defer broken.Close()
+
+	tests := []struct {
+		name           string
+		servers        []string
+		hedging        *types.Hedging
+		response       string
+		hedgedRequests int64
+		hedgeWins      int64
+	}{
+		{
+			name:           "slow server is hedged",
+			servers:        []string{slow.URL, fast.URL},
+			hedging:        &types.Hedging{Delay: 50 * time.Millisecond},
+			response:       "fast",
+			hedgedRequests: 1,
+			hedgeWins:      1,
+		},
+		{
+			name:     "fast server is not hedged",
+			servers:  []string{fast.URL, slow.URL},
+			hedging:  &types.Hedging{Delay: time.Second},
+			response: "fast",
+		},
+		{
+			name:           "failed hedged request waits for the first one",
+			servers:        []string{slow.URL, broken.URL},
+			hedging:        &types.Hedging{Delay: 50 * time.Millisecond},
+			response:       "slow",
+			hedgedRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := limiter.NewServerLimiter(tt.servers, 10)
+			q := NewHttpQuery(zap.NewNop(), tt.name, tt.servers, 1, l, &http.Client{}, "", types.RoundRobinLB, tt.hedging, nil, nil)
+			// counter is incremented before picking, start with the first server
+			q.counter = uint64(len(tt.servers) - 1)
+
+			stats := &types.Stats{}
+			res, err := q.DoQuery(context.Background(), stats, "/render/", nil)
+			if err != nil && err.HaveFatalErrors {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(res.Response) != tt.response {
+				t.Errorf("got response %v, expected %v", string(res.Response), tt.response)
+			}
+			if stats.HedgedRequests != tt.hedgedRequests || stats.HedgeWins != tt.hedgeWins {
+				t.Errorf("got %v hedged requests and %v wins, expected %v and %v", stats.HedgedRequests, stats.HedgeWins, tt.hedgedRequests, tt.hedgeWins)
+			}
+		})
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		hedging  *types.Hedging
+		samples  bool
+		delay    time.Duration
+		expected bool
+	}{
+		{name: "fixed delay", hedging: &types.Hedging{Delay: time.Second}, delay: time.Second, expected: true},
+		{name: "percentile without samples", hedging: &types.Hedging{Percentile: 95}},
+		{name: "percentile without samples falls back to delay", hedging: &types.Hedging{Delay: time.Second, Percentile: 95}, delay: time.Second, expected: true},
+		{name: "percentile", hedging: &types.Hedging{Percentile: 95}, samples: true, delay: 95 * time.Millisecond, expected: true},
+		{name: "delay is a lower bound", hedging: &types.Hedging{Delay: time.Second, Percentile: 95}, samples: true, delay: time.Second, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewHttpQuery(zap.NewNop(), "TestHedgeDelay", []string{"server1", "server2"}, 1, limiter.NewServerLimiter(nil, 0), &http.Client{}, "", types.RoundRobinLB, tt.hedging, nil, nil)
+			if tt.samples {
+				for i := 1; i <= 100; i++ {
+					q.latency.add("server1", time.Duration(i)*time.Millisecond)
+				}
+			}
+			delay, ok := q.hedgeDelay("server1")
+			if ok != tt.expected || delay != tt.delay {
+				t.Errorf("got delay %v (hedged: %v), expected %v (hedged: %v)", delay, ok, tt.delay, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoQueryLimitsServers(t *testing.T) {
+	first := newTestServer(0, http.StatusOK, "first")
+	defer first.Close()
+	second := newTestServer(0, http.StatusOK, "second")
+	defer second.Close()
+
+	servers := []string{first.URL, second.URL}
+	l := limiter.NewAdaptiveLimiter(servers, 1, types.ConcurrencyLimiter{Type: "aimd", MaxLimit: 1})
+	q := NewHttpQuery(zap.NewNop(), "TestDoQueryLimitsServers", servers, 1, l, &http.Client{}, "", types.RoundRobinLB, nil, nil, nil)
+	q.counter = uint64(len(servers) - 1)
+
+	// the only slot of the first server is taken, the second one still has it's own
+	if err := l.Enter(context.Background(), first.URL); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Leave(context.Background(), first.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if res, err := q.DoQuery(ctx, &types.Stats{}, "/render/", nil); err == nil || !err.HaveFatalErrors {
+		t.Errorf("got response %v, expected the request to wait for the first server's slot", res)
+	}
+
+	res, err := q.DoQuery(context.Background(), &types.Stats{}, "/render/", nil)
+	if err != nil && err.HaveFatalErrors {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(res.Response) != "second" {
+		t.Errorf("got response %v, expected second", string(res.Response))
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	l := newLatencyTracker([]string{"server"})
+	if _, ok := l.percentile("server", 95); ok {
+		t.Fatal("expected no percentile without samples")
+	}
+
+	for i := 1; i <= 100; i++ {
+		l.add("server", time.Duration(i)*time.Millisecond)
+	}
+	d, ok := l.percentile("server", 95)
+	if !ok || d != 95*time.Millisecond {
+		t.Errorf("got %v, expected %v", d, 95*time.Millisecond)
+	}
+}
+
+func TestHealthTracker(t *testing.T) {
+	servers := []string{"server1", "server2", "server3"}
+	latency := newLatencyTracker(servers)
+	h := newHealthTracker(zap.NewNop(), "TestHealthTracker", servers, &types.HealthCheck{
+		ConsecutiveFailures: 2,
+		LatencyFactor:       3,
+		EjectionTime:        time.Minute,
+		MaxEjectionTime:     3 * time.Minute,
+	}, latency)
+	h.register()
+
+	h.failure("server1")
+	if healthy := h.healthy(); len(healthy) != 3 {
+		t.Fatalf("server shouldn't be ejected after one failure, healthy: %v", healthy)
+	}
+	h.failure("server1")
+	if healthy := h.healthy(); !reflect.DeepEqual(healthy, []string{"server2", "server3"}) {
+		t.Fatalf("server1 should be ejected, healthy: %v", healthy)
+	}
+
+	// Every next ejection is twice longer, up to MaxEjectionTime
+	for _, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		h.health["server1"].ejectedUntil = time.Time{}
+		h.failure("server1")
+		h.failure("server1")
+		d := time.Until(h.health["server1"].ejectedUntil)
+		if d <= expected-time.Second || d > expected {
+			t.Errorf("got ejection time %v, expected %v", d, expected)
+		}
+	}
+
+	// successful probe doesn't shorten ejection for failed requests
+	h.readmit("server1")
+	if healthy := h.healthy(); !reflect.DeepEqual(healthy, []string{"server2", "server3"}) {
+		t.Fatalf("server1 shouldn't be readmitted by probe, healthy: %v", healthy)
+	}
+
+	// server was ejected by failed probes, so the successful one readmits it
+	h.health["server1"].ejectedUntil = time.Time{}
+	h.fail("server1", true)
+	h.fail("server1", true)
+	if healthy := h.healthy(); !reflect.DeepEqual(healthy, []string{"server2", "server3"}) {
+		t.Fatalf("server1 should be ejected by failed probes, healthy: %v", healthy)
+	}
+	h.readmit("server1")
+	for i := 0; i < minLatencySamples; i++ {
+		latency.add("server1", 10*time.Millisecond)
+		latency.add("server2", 10*time.Millisecond)
+		latency.add("server3", 50*time.Millisecond)
+	}
+	h.checkLatency()
+	if healthy := h.healthy(); !reflect.DeepEqual(healthy, []string{"server1", "server2"}) {
+		t.Fatalf("server3 should be ejected as latency outlier, healthy: %v", healthy)
+	}
+
+	h.failure("server1")
+	h.failure("server1")
+	h.failure("server2")
+	h.failure("server2")
+	if healthy := h.healthy(); !reflect.DeepEqual(healthy, servers) {
+		t.Fatalf("all servers should be used when all of them are ejected, healthy: %v", healthy)
+	}
+
+	state := HealthState().(map[string]map[string]ServerHealth)
+	if !state["TestHealthTracker"]["server2"].Ejected {
+		t.Errorf("server2 should be reported as ejected: %+v", state["TestHealthTracker"])
+	}
+
+	h.readmit("server3")
+	if time.Until(h.health["server3"].ejectedUntil) <= 0 {
+		t.Fatal("server3 shouldn't be readmitted by probe after latency ejection")
+	}
+
+	// samples taken before ejection don't eject server again after it's ejection time passed
+	h.health["server3"].ejectedUntil = time.Time{}
+	h.checkLatency()
+	if healthy := h.healthy(); !reflect.DeepEqual(healthy, []string{"server3"}) {
+		t.Fatalf("server3 shouldn't be ejected again without new samples, healthy: %v", healthy)
+	}
+}
+
+func TestLoadAwarePicking(t *testing.T) {
+	servers := []string{"server1", "server2"}
+
+	q := NewHttpQuery(zap.NewNop(), "TestLoadAwarePicking", servers, 1, limiter.NewServerLimiter(nil, 0), &http.Client{}, "", types.LeastRequestsLB, nil, nil, nil)
+	q.load.start("server1")
+	for i := 0; i < 10; i++ {
+		if s := q.pickServer(); s != "server2" {
+			t.Fatalf("least_requests picked %v with more in-flight requests", s)
+		}
+	}
+	q.load.done("server1")
+	q.load.start("server2")
+	if s := q.pickServer(); s != "server1" {
+		t.Fatalf("least_requests picked %v with more in-flight requests", s)
+	}
+
+	q = NewHttpQuery(zap.NewNop(), "TestLoadAwarePicking", servers, 1, limiter.NewServerLimiter(nil, 0), &http.Client{}, "", types.EWMALB, nil, nil, nil)
+	q.load.observe("server1", 100*time.Millisecond)
+	q.load.observe("server2", 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if s := q.pickServer(); s != "server2" {
+			t.Fatalf("ewma picked slower server %v", s)
+		}
+	}
+	// 10ms * (10 + 1) in-flight requests is more expensive than 100ms
+	for i := 0; i < 10; i++ {
+		q.load.start("server2")
+	}
+	if s := q.pickServer(); s != "server1" {
+		t.Fatalf("ewma picked overloaded server %v", s)
+	}
+	for i := 0; i < 10; i++ {
+		q.load.done("server2")
+	}
+	q.load.failed("server2")
+	q.load.failed("server2")
+	q.load.failed("server2")
+	q.load.failed("server2")
+	if s := q.pickServer(); s != "server1" {
+		t.Fatalf("ewma picked failing server %v", s)
+	}
+}
+
+func TestWeightedPicking(t *testing.T) {
+	servers := []string{"server1", "server2", "server3"}
+	types.ServerWeights.Set("TestWeightedPicking", map[string]int{"server1": 3, "server3": 0})
+	q := NewHttpQuery(zap.NewNop(), "TestWeightedPicking", servers, 1, limiter.NewServerLimiter(nil, 0), &http.Client{}, "", types.RoundRobinLB, nil, nil, nil)
+
+	var picked []string
+	for i := 0; i < 8; i++ {
+		picked = append(picked, q.pickServer())
+	}
+	expected := []string{"server1", "server1", "server2", "server1", "server1", "server1", "server2", "server1"}
+	if !reflect.DeepEqual(picked, expected) {
+		t.Errorf("got %v, expected %v", picked, expected)
+	}
+
+	// Weights can be changed at runtime
+	types.ServerWeights.Set("TestWeightedPicking", map[string]int{"server1": 0, "server2": 0})
+	for i := 0; i < 3; i++ {
+		if s := q.pickServer(); s != "server3" {
+			t.Fatalf("picked drained server %v", s)
+		}
+	}
+}
@@ -35,11 +35,11 @@ type capabilityResponse struct {
 }
 
 //_internal/capabilities/
-func doQuery(ctx context.Context, logger *zap.Logger, groupName string, httpClient *http.Client, limiter *limiter.ServerLimiter, server string, payload []byte, resChan chan<- capabilityResponse) {
-	httpQuery := helper.NewHttpQuery(logger, groupName, []string{server}, 1, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv3PB)
+func doQuery(ctx context.Context, logger *zap.Logger, groupName string, httpClient *http.Client, limiter limiter.ServerLimiter, server string, payload []byte, resChan chan<- capabilityResponse) {
+	httpQuery := helper.NewHttpQuery(logger, groupName, []string{server}, 1, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv3PB, types.RoundRobinLB, nil, nil, nil)
 	rewrite, _ := url.Parse("http://127.0.0.1/_internal/capabilities/")
 
-	res, e := httpQuery.DoQuery(ctx, rewrite.RequestURI(), payload)
+	res, e := httpQuery.DoQuery(ctx, nil, rewrite.RequestURI(), payload)
 	if e != nil || res == nil || res.Response == nil || len(res.Response) == 0 {
 		logger.Info("will assume old protocol")
 		resChan <- capabilityResponse{
@@ -79,7 +79,7 @@ func getBestSupportedProtocol(logger *zap.Logger, servers []string, concurencyLi
 		ProtoToServers: make(map[string][]string),
 	}
 	groupName := "capability query"
-	limiter := limiter.NewServerLimiter([]string{groupName}, concurencyLimit)
+	limiter := limiter.NewServerLimiter(servers, concurencyLimit)
 
 	httpClient := &http.Client{
 		Transport: &http.Transport{
@@ -147,7 +147,7 @@ type AutoGroup struct {
 	httpQuery *helper.HttpQuery
 }
 
-func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
+func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
 	return nil, errors.Fatal("auto group doesn't support anything useful except for New")
 }
 
@@ -2,6 +2,7 @@ package v2
 
 import (
 	"context"
+	"encoding/json"
 	"math"
 	"net"
 	"net/http"
@@ -43,7 +44,7 @@ type GraphiteGroup struct {
 	counter             uint64
 	maxIdleConnsPerHost int
 
-	limiter              *limiter.ServerLimiter
+	limiter              limiter.ServerLimiter
 	logger               *zap.Logger
 	timeout              types.Timeouts
 	maxTries             int
@@ -52,7 +53,7 @@ type GraphiteGroup struct {
 	httpQuery *helper.HttpQuery
 }
 
-func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
+func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
 	logger = logger.With(zap.String("type", "graphite"), zap.String("protocol", config.Protocol), zap.String("name", config.GroupName))
 
 	httpClient := &http.Client{
@@ -66,7 +67,13 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter
 		},
 	}
 
-	httpQuery := helper.NewHttpQuery(logger, config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB)
+	var lbMethod types.LBMethod
+	err := lbMethod.FromString(config.LBMethod)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	httpQuery := helper.NewHttpQuery(logger, config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB, lbMethod, config.Hedging, config.HealthCheck, config.CircuitBreaker)
 
 	c := &GraphiteGroup{
 		groupName:            config.GroupName,
@@ -92,11 +99,19 @@ func New(logger *zap.Logger, config types.BackendV2) (types.ServerClient, *error
 	if len(config.Servers) == 0 {
 		return nil, errors.Fatal("no servers specified")
 	}
-	limiter := limiter.NewServerLimiter([]string{config.GroupName}, *config.ConcurrencyLimit)
+	limiter, err := limiter.New(config.Servers, *config.ConcurrencyLimit, config.ConcurrencyLimiter)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
 
 	return NewWithLimiter(logger, config, limiter)
 }
 
+// Register publishes health state, circuit breakers and limiter state of the group's servers
+func (c *GraphiteGroup) Register() {
+	c.httpQuery.Register()
+}
+
 func (c GraphiteGroup) MaxMetricsPerRequest() int {
 	return c.maxMetricsPerRequest
 }
@@ -128,7 +143,7 @@ func (c *GraphiteGroup) Fetch(ctx context.Context, request *protov3.MultiFetchRe
 			"until":  []string{strconv.Itoa(int(request.Metrics[0].StopTime))},
 		}
 		rewrite.RawQuery = v.Encode()
-		res, err := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), nil)
+		res, err := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
 		if err == nil {
 			err = &errors.Errors{}
 		}
@@ -183,7 +198,7 @@ func (c *GraphiteGroup) Find(ctx context.Context, request *protov3.MultiGlobRequ
 			"format": []string{c.protocol},
 		}
 		rewrite.RawQuery = v.Encode()
-		res, err := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), nil)
+		res, err := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
 		if err != nil {
 			e.Merge(err)
 			continue
@@ -241,7 +256,7 @@ func (c *GraphiteGroup) Info(ctx context.Context, request *protov3.MultiMetricsI
 			"format": []string{c.protocol},
 		}
 		rewrite.RawQuery = v.Encode()
-		res, e2 := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), nil)
+		res, e2 := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
 		if e2 != nil {
 			e.Merge(e2)
 			continue
@@ -294,11 +309,59 @@ func (c *GraphiteGroup) Info(ctx context.Context, request *protov3.MultiMetricsI
 	return &r, stats, nil
 }
 
+// List and Stats are not part of graphite-web API, msgpack is not supported there, so json is used instead
 func (c *GraphiteGroup) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.FromErr(types.ErrNotImplementedYet)
+	stats := &types.Stats{}
+	rewrite, _ := url.Parse("http://127.0.0.1/metrics/list/")
+
+	v := url.Values{
+		"format": []string{"json"},
+	}
+	rewrite.RawQuery = v.Encode()
+
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
+	if e != nil {
+		e.HaveFatalErrors = false
+		return nil, stats, e
+	}
+	stats.Servers = append(stats.Servers, res.Server)
+
+	var list protov3.ListMetricsResponse
+	err := json.Unmarshal(res.Response, &list)
+	if err != nil {
+		return nil, stats, errors.FromErrNonFatal(err)
+	}
+
+	stats.MemoryUsage = int64(list.Size())
+
+	return &list, stats, nil
 }
+
 func (c *GraphiteGroup) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.FromErr(types.ErrNotImplementedYet)
+	stats := &types.Stats{}
+	rewrite, _ := url.Parse("http://127.0.0.1/metrics/details/")
+
+	v := url.Values{
+		"format": []string{"json"},
+	}
+	rewrite.RawQuery = v.Encode()
+
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
+	if e != nil {
+		e.HaveFatalErrors = false
+		return nil, stats, e
+	}
+	stats.Servers = append(stats.Servers, res.Server)
+
+	var details protov3.MetricDetailsResponse
+	err := json.Unmarshal(res.Response, &details)
+	if err != nil {
+		return nil, stats, errors.FromErrNonFatal(err)
+	}
+
+	stats.MemoryUsage = int64(details.Size())
+
+	return &details, stats, nil
 }
 
 func (c *GraphiteGroup) ProbeTLDs(ctx context.Context) ([]string, *errors.Errors) {
@@ -45,7 +45,7 @@ type ClientGRPCGroup struct {
 	logger *zap.Logger
 }
 
-func NewClientGRPCGroupWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
+func NewClientGRPCGroupWithLimiter(logger *zap.Logger, config types.BackendV2, limiter limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
 	return NewClientGRPCGroup(logger, config)
 }
 
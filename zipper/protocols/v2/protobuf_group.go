@@ -45,7 +45,7 @@ type ClientProtoV2Group struct {
 	counter             uint64
 	maxIdleConnsPerHost int
 
-	limiter              *limiter.ServerLimiter
+	limiter              limiter.ServerLimiter
 	logger               *zap.Logger
 	timeout              types.Timeouts
 	maxTries             int
@@ -54,7 +54,7 @@ type ClientProtoV2Group struct {
 	httpQuery *helper.HttpQuery
 }
 
-func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
+func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
 	logger = logger.With(zap.String("type", "protoV2Group"), zap.String("name", config.GroupName))
 
 	httpClient := &http.Client{
@@ -68,7 +68,13 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter
 		},
 	}
 
-	httpQuery := helper.NewHttpQuery(logger, config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB)
+	var lbMethod types.LBMethod
+	err := lbMethod.FromString(config.LBMethod)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	httpQuery := helper.NewHttpQuery(logger, config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB, lbMethod, config.Hedging, config.HealthCheck, config.CircuitBreaker)
 
 	c := &ClientProtoV2Group{
 		groupName:            config.GroupName,
@@ -93,11 +99,19 @@ func New(logger *zap.Logger, config types.BackendV2) (types.ServerClient, *error
 	if len(config.Servers) == 0 {
 		return nil, errors.Fatal("no servers specified")
 	}
-	limiter := limiter.NewServerLimiter([]string{config.GroupName}, *config.ConcurrencyLimit)
+	limiter, err := limiter.New(config.Servers, *config.ConcurrencyLimit, config.ConcurrencyLimiter)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
 
 	return NewWithLimiter(logger, config, limiter)
 }
 
+// Register publishes health state, circuit breakers and limiter state of the group's servers
+func (c *ClientProtoV2Group) Register() {
+	c.httpQuery.Register()
+}
+
 func (c ClientProtoV2Group) MaxMetricsPerRequest() int {
 	return c.maxMetricsPerRequest
 }
@@ -140,7 +154,7 @@ func (c *ClientProtoV2Group) Fetch(ctx context.Context, request *protov3.MultiFe
 			"until":  []string{strconv.Itoa(int(batch.until))},
 		}
 		rewrite.RawQuery = v.Encode()
-		res, err := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), nil)
+		res, err := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
 		if err == nil {
 			err = &errors.Errors{}
 		}
@@ -193,7 +207,7 @@ func (c *ClientProtoV2Group) Find(ctx context.Context, request *protov3.MultiGlo
 			"format": []string{format},
 		}
 		rewrite.RawQuery = v.Encode()
-		res, err := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), nil)
+		res, err := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
 		if err != nil {
 			e.Merge(err)
 			continue
@@ -250,7 +264,7 @@ func (c *ClientProtoV2Group) Info(ctx context.Context, request *protov3.MultiMet
 			"format": []string{format},
 		}
 		rewrite.RawQuery = v.Encode()
-		res, e2 := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), nil)
+		res, e2 := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
 		if e2 != nil {
 			e.Merge(e2)
 			continue
@@ -304,10 +318,75 @@ func (c *ClientProtoV2Group) Info(ctx context.Context, request *protov3.MultiMet
 }
 
 func (c *ClientProtoV2Group) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.FromErr(types.ErrNotImplementedYet)
+	stats := &types.Stats{}
+	rewrite, _ := url.Parse("http://127.0.0.1/metrics/list/")
+
+	v := url.Values{
+		"format": []string{format},
+	}
+	rewrite.RawQuery = v.Encode()
+
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
+	if e != nil {
+		e.HaveFatalErrors = false
+		return nil, stats, e
+	}
+	stats.Servers = append(stats.Servers, res.Server)
+
+	var list protov2.ListMetricsResponse
+	err := list.Unmarshal(res.Response)
+	if err != nil {
+		return nil, stats, errors.FromErrNonFatal(err)
+	}
+
+	stats.MemoryUsage = int64(list.Size())
+
+	r := &protov3.ListMetricsResponse{
+		Metrics: list.Metrics,
+	}
+
+	return r, stats, nil
 }
+
 func (c *ClientProtoV2Group) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.FromErr(types.ErrNotImplementedYet)
+	stats := &types.Stats{}
+	rewrite, _ := url.Parse("http://127.0.0.1/metrics/details/")
+
+	v := url.Values{
+		"format": []string{format},
+	}
+	rewrite.RawQuery = v.Encode()
+
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
+	if e != nil {
+		e.HaveFatalErrors = false
+		return nil, stats, e
+	}
+	stats.Servers = append(stats.Servers, res.Server)
+
+	var details protov2.MetricDetailsResponse
+	err := details.Unmarshal(res.Response)
+	if err != nil {
+		return nil, stats, errors.FromErrNonFatal(err)
+	}
+
+	stats.MemoryUsage = int64(details.Size())
+
+	r := &protov3.MetricDetailsResponse{
+		Metrics:    make(map[string]*protov3.MetricDetails, len(details.Metrics)),
+		FreeSpace:  details.FreeSpace,
+		TotalSpace: details.TotalSpace,
+	}
+	for k, m := range details.Metrics {
+		r.Metrics[k] = &protov3.MetricDetails{
+			Size_:   m.Size_,
+			ModTime: m.ModTime,
+			ATime:   m.ATime,
+			RdTime:  m.RdTime,
+		}
+	}
+
+	return r, stats, nil
 }
 
 func (c *ClientProtoV2Group) ProbeTLDs(ctx context.Context) ([]string, *errors.Errors) {
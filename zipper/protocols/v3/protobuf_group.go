@@ -42,7 +42,7 @@ type ClientProtoV3Group struct {
 	counter             uint64
 	maxIdleConnsPerHost int
 
-	limiter              *limiter.ServerLimiter
+	limiter              limiter.ServerLimiter
 	logger               *zap.Logger
 	timeout              types.Timeouts
 	maxTries             int
@@ -58,12 +58,15 @@ func New(logger *zap.Logger, config types.BackendV2) (types.ServerClient, *error
 	if len(config.Servers) == 0 {
 		return nil, errors.Fatal("no servers specified")
 	}
-	limiter := limiter.NewServerLimiter([]string{config.GroupName}, *config.ConcurrencyLimit)
+	limiter, err := limiter.New(config.Servers, *config.ConcurrencyLimit, config.ConcurrencyLimiter)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
 
 	return NewWithLimiter(logger, config, limiter)
 }
 
-func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
+func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter limiter.ServerLimiter) (types.ServerClient, *errors.Errors) {
 	httpClient := &http.Client{
 		Transport: &http.Transport{
 			MaxIdleConnsPerHost: *config.MaxIdleConnsPerHost,
@@ -77,7 +80,13 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter
 
 	logger = logger.With(zap.String("type", "protoV3Group"), zap.String("name", config.GroupName))
 
-	httpQuery := helper.NewHttpQuery(logger, config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv3PB)
+	var lbMethod types.LBMethod
+	err := lbMethod.FromString(config.LBMethod)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	httpQuery := helper.NewHttpQuery(logger, config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv3PB, lbMethod, config.Hedging, config.HealthCheck, config.CircuitBreaker)
 
 	c := &ClientProtoV3Group{
 		groupName:            config.GroupName,
@@ -95,6 +104,11 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, limiter *limiter
 	return c, nil
 }
 
+// Register publishes health state, circuit breakers and limiter state of the group's servers
+func (c *ClientProtoV3Group) Register() {
+	c.httpQuery.Register()
+}
+
 func (c ClientProtoV3Group) MaxMetricsPerRequest() int {
 	return c.maxMetricsPerRequest
 }
@@ -121,7 +135,7 @@ func (c *ClientProtoV3Group) Fetch(ctx context.Context, request *protov3.MultiFe
 		return nil, nil, errors.FromErrNonFatal(err)
 	}
 
-	res, e := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), data)
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), data)
 	if e == nil {
 		e = &errors.Errors{}
 	}
@@ -157,7 +171,7 @@ func (c *ClientProtoV3Group) Find(ctx context.Context, request *protov3.MultiGlo
 		return nil, nil, errors.FromErrNonFatal(err)
 	}
 
-	res, e := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), data)
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), data)
 	if e == nil {
 		e = &errors.Errors{}
 	}
@@ -189,7 +203,7 @@ func (c *ClientProtoV3Group) Info(ctx context.Context, request *protov3.MultiMet
 		return nil, nil, errors.FromErrNonFatal(err)
 	}
 
-	res, e := c.httpQuery.DoQuery(ctx, rewrite.RequestURI(), data)
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), data)
 	if e == nil {
 		e = &errors.Errors{}
 	}
@@ -216,10 +230,57 @@ func (c *ClientProtoV3Group) Info(ctx context.Context, request *protov3.MultiMet
 }
 
 func (c *ClientProtoV3Group) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.FromErr(types.ErrNotImplementedYet)
+	stats := &types.Stats{}
+	rewrite, _ := url.Parse("http://127.0.0.1/metrics/list/")
+
+	v := url.Values{
+		"format": []string{format},
+	}
+	rewrite.RawQuery = v.Encode()
+
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
+	if e != nil {
+		e.HaveFatalErrors = false
+		return nil, stats, e
+	}
+	stats.Servers = append(stats.Servers, res.Server)
+
+	var list protov3.ListMetricsResponse
+	err := list.Unmarshal(res.Response)
+	if err != nil {
+		return nil, stats, errors.FromErrNonFatal(err)
+	}
+
+	stats.MemoryUsage = int64(list.Size())
+
+	return &list, stats, nil
 }
+
 func (c *ClientProtoV3Group) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, *errors.Errors) {
-	return nil, nil, errors.FromErr(types.ErrNotImplementedYet)
+	stats := &types.Stats{}
+	rewrite, _ := url.Parse("http://127.0.0.1/metrics/details/")
+
+	v := url.Values{
+		"format": []string{format},
+	}
+	rewrite.RawQuery = v.Encode()
+
+	res, e := c.httpQuery.DoQuery(ctx, stats, rewrite.RequestURI(), nil)
+	if e != nil {
+		e.HaveFatalErrors = false
+		return nil, stats, e
+	}
+	stats.Servers = append(stats.Servers, res.Server)
+
+	var details protov3.MetricDetailsResponse
+	err := details.Unmarshal(res.Response)
+	if err != nil {
+		return nil, stats, errors.FromErrNonFatal(err)
+	}
+
+	stats.MemoryUsage = int64(details.Size())
+
+	return &details, stats, nil
 }
 
 func (c *ClientProtoV3Group) ProbeTLDs(ctx context.Context) ([]string, *errors.Errors) {
@@ -0,0 +1,319 @@
+package zipper
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-graphite/carbonzipper/limiter"
+	"github.com/go-graphite/carbonzipper/pathcache"
+	"github.com/go-graphite/carbonzipper/zipper/breaker"
+	"github.com/go-graphite/carbonzipper/zipper/broadcast"
+	"github.com/go-graphite/carbonzipper/zipper/cache"
+	"github.com/go-graphite/carbonzipper/zipper/config"
+	"github.com/go-graphite/carbonzipper/zipper/errors"
+	"github.com/go-graphite/carbonzipper/zipper/helper"
+	"github.com/go-graphite/carbonzipper/zipper/metadata"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	"go.uber.org/zap"
+)
+
+// how often old backends are checked for requests that still use them
+const drainInterval = 100 * time.Millisecond
+
+// backendGroup is a client of the configured group together with it's definition, so it can be reused on reload
+type backendGroup struct {
+	definition types.BackendV2
+	weights    map[string]int
+	client     types.ServerClient
+}
+
+// groupSet is a broadcast group over the configured groups
+type groupSet struct {
+	group       *broadcast.BroadcastGroup
+	clients     []types.ServerClient
+	settings    types.BackendsV2 // without Backends
+	queryCaches types.QueryCaches
+	groups      map[string]backendGroup
+}
+
+// backends contains groups the requests are sent to. They are replaced as a whole when config is reloaded
+type backends struct {
+	// requests that are using the backends
+	inflight int64
+
+	store            types.ServerClient
+	search           types.ServerClient
+	searchPrefix     string
+	searchConfigured bool
+
+	storeGroups  *groupSet
+	searchGroups *groupSet
+}
+
+// acquire returns current backends, they are not dropped by reload until release is called
+func (z Zipper) acquire() *backends {
+	for {
+		b := z.backends.Load().(*backends)
+		atomic.AddInt64(&b.inflight, 1)
+		// reload, that replaced the backends before they were counted as used, could already see them unused
+		if z.backends.Load() == b {
+			return b
+		}
+		b.release()
+	}
+}
+
+func (b *backends) release() {
+	atomic.AddInt64(&b.inflight, -1)
+}
+
+// names returns names of all the groups, including broadcast groups over them
+func (b *backends) names() map[string]struct{} {
+	res := make(map[string]struct{})
+	for _, s := range []*groupSet{b.storeGroups, b.searchGroups} {
+		if s == nil {
+			continue
+		}
+		res[s.group.Name()] = struct{}{}
+		for name := range s.groups {
+			res[name] = struct{}{}
+		}
+	}
+	return res
+}
+
+// servers returns addresses of all the servers of the groups
+func (b *backends) servers() map[string]struct{} {
+	res := make(map[string]struct{})
+	for _, s := range []*groupSet{b.storeGroups, b.searchGroups} {
+		if s == nil {
+			continue
+		}
+		for _, g := range s.groups {
+			for _, server := range g.definition.Servers {
+				res[server] = struct{}{}
+			}
+		}
+	}
+	return res
+}
+
+// register publishes weights, caches, routing, health checks, circuit breakers and limiters of the groups. Groups are
+// created without touching the registries, so it's done only once the backends are put to use
+func (b *backends) register() {
+	for _, s := range []*groupSet{b.storeGroups, b.searchGroups} {
+		if s == nil {
+			continue
+		}
+		for name, g := range s.groups {
+			types.ServerWeights.Set(name, g.weights)
+		}
+		types.Register(s.group)
+	}
+}
+
+func sameClients(a, b []types.ServerClient) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// newGroupSet creates broadcast group with the name over the configured groups. Unchanged groups of the previous set
+// are reused, as well as it's broadcast group if none of the groups changed. New broadcast group is passed to setup
+func (z *Zipper) newGroupSet(name string, backends types.BackendsV2, queryCaches types.QueryCaches, previous *groupSet, setup func(*broadcast.BroadcastGroup)) (*groupSet, *errors.Errors) {
+	settings := backends
+	settings.Backends = nil
+
+	var reuse map[string]backendGroup
+	if previous != nil && reflect.DeepEqual(previous.settings, settings) && reflect.DeepEqual(previous.queryCaches, queryCaches) {
+		reuse = previous.groups
+	}
+	clients, groups, err := createBackendsV2(z.logger, backends, queryCaches, z.expireDelaySec, reuse)
+	if err != nil && err.HaveFatalErrors {
+		return nil, err
+	}
+
+	s := &groupSet{
+		clients:     clients,
+		settings:    settings,
+		queryCaches: queryCaches,
+		groups:      groups,
+	}
+	if reuse != nil && sameClients(previous.clients, clients) {
+		s.group = previous.group
+		return s, nil
+	}
+
+	s.group, err = broadcast.NewBroadcastGroup(z.logger, name, clients, z.expireDelaySec, z.concurrencyLimitPerServer, z.timeouts)
+	if err != nil && err.HaveFatalErrors {
+		return nil, err
+	}
+	s.group.SetQueryCaches(queryCaches)
+	if setup != nil {
+		setup(s.group)
+	}
+	return s, nil
+}
+
+// newBackends creates store and search groups from the config, reusing unchanged groups of the previous backends
+func (z *Zipper) newBackends(config *config.Config, previous *backends) (*backends, *errors.Errors) {
+	var prevStore, prevSearch *groupSet
+	if previous != nil {
+		prevStore, prevSearch = previous.storeGroups, previous.searchGroups
+	}
+
+	// groups without their own query caches config use the one of backendsv2
+	queryCaches := config.BackendsV2.QueryCaches.Merge(types.DefaultQueryCaches)
+
+	b := &backends{}
+	var err *errors.Errors
+	if len(config.CarbonSearchV2.BackendsV2.Backends) > 0 {
+		b.searchGroups, err = z.newGroupSet("search", config.CarbonSearchV2.BackendsV2, queryCaches, prevSearch, nil)
+		if err != nil && err.HaveFatalErrors {
+			return nil, err
+		}
+		b.search = b.searchGroups.group
+		b.searchPrefix = config.CarbonSearchV2.Prefix
+		b.searchConfigured = len(b.searchPrefix) > 0 && len(b.search.Backends()) > 0
+	}
+
+	b.storeGroups, err = z.newGroupSet("root", config.BackendsV2, queryCaches, prevStore, func(root *broadcast.BroadcastGroup) {
+		root.SetSharedCache(z.sharedCache)
+		root.SetChunkCache(z.chunkCache)
+	})
+	if err != nil && err.HaveFatalErrors {
+		return nil, err
+	}
+	b.store = b.storeGroups.group
+	return b, nil
+}
+
+// validateBackendsV2 checks the groups without creating them, so invalid config doesn't replace any of the groups
+func validateBackendsV2(backends types.BackendsV2) error {
+	if err := backends.QueryCaches.Validate(); err != nil {
+		return fmt.Errorf("invalid query caches config: %v", err)
+	}
+	seen := make(map[string]struct{}, len(backends.Backends))
+	for _, backend := range backends.Backends {
+		if _, ok := seen[backend.GroupName]; ok {
+			return fmt.Errorf("duplicate group '%v'", backend.GroupName)
+		}
+		seen[backend.GroupName] = struct{}{}
+
+		metadata.Metadata.RLock()
+		_, ok := metadata.Metadata.ProtocolInits[backend.Protocol]
+		metadata.Metadata.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown backend protocol '%v' in group '%v'", backend.Protocol, backend.GroupName)
+		}
+
+		var lbMethod types.LBMethod
+		if err := lbMethod.FromString(backend.LBMethod); err != nil {
+			return fmt.Errorf("invalid lbMethod of group '%v': %v", backend.GroupName, err)
+		}
+		if err := backend.ValidateWeights(); err != nil {
+			return fmt.Errorf("invalid weights of group '%v': %v", backend.GroupName, err)
+		}
+		if err := backend.QueryCaches.Validate(); err != nil {
+			return fmt.Errorf("invalid query caches config of group '%v': %v", backend.GroupName, err)
+		}
+		if lbMethod == types.CarbonCHLB || lbMethod == types.FNV1aCHLB {
+			if _, err := createHashRing(lbMethod, backend); err != nil {
+				return fmt.Errorf("invalid hash ring of group '%v': %v", backend.GroupName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Reload replaces the groups with the ones from backends, backendsv2 and carbonsearch sections of the config, other
+// settings are not changed. Groups which definitions did not change are kept with their caches, routing and health
+// state. Removed groups are dropped after requests that use them are finished
+func (z *Zipper) Reload(config *config.Config) error {
+	z.reloadLock.Lock()
+	defer z.reloadLock.Unlock()
+
+	config.Timeouts = sanitizeTimouts(config.Timeouts, defaultTimeouts)
+	if err := config.BackendsV2.QueryCaches.Validate(); err != nil {
+		return fmt.Errorf("invalid query caches config: %v", err)
+	}
+
+	convertBackends(config)
+	if err := validateBackendsV2(config.BackendsV2); err != nil {
+		return err
+	}
+	if err := validateBackendsV2(config.CarbonSearchV2.BackendsV2); err != nil {
+		return fmt.Errorf("invalid carbonsearch config: %v", err)
+	}
+	old := z.backends.Load().(*backends)
+	b, err := z.newBackends(config, old)
+	if err != nil && err.HaveFatalErrors {
+		return fmt.Errorf("failed to create backends: %v", err.Errors)
+	}
+
+	if b.store != old.store {
+		// new root doesn't know the routes yet
+		ctx := limiter.WithPriority(context.Background(), limiter.ProbePriority)
+		if _, err := b.store.ProbeTLDs(ctx); err != nil && err.HaveFatalErrors {
+			z.logger.Warn("failed to probe tlds of the new backends",
+				zap.Any("errors", err.Errors),
+			)
+		}
+	}
+	z.backends.Store(b)
+	b.register()
+
+	z.logger.Info("backends reloaded",
+		zap.Bool("root_changed", b.store != old.store),
+		zap.Bool("search_changed", b.search != old.search),
+	)
+
+	go z.drain(old)
+	return nil
+}
+
+// drain waits for requests that use old backends to finish, but not longer than render timeout, and then unregisters
+// groups and servers that were removed
+func (z *Zipper) drain(old *backends) {
+	deadline := time.Now().Add(z.timeout)
+	for atomic.LoadInt64(&old.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainInterval)
+	}
+
+	z.reloadLock.Lock()
+	defer z.reloadLock.Unlock()
+
+	b := z.backends.Load().(*backends)
+	current := b.names()
+	for name := range old.names() {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		cache.Unregister(name)
+		pathcache.Unregister(name)
+		helper.UnregisterHealth(name)
+		types.ServerWeights.Delete(name)
+		limiter.Unregister(name)
+		z.logger.Info("removed group is drained",
+			zap.String("group", name),
+		)
+	}
+
+	currentServers := b.servers()
+	for server := range old.servers() {
+		if _, ok := currentServers[server]; ok {
+			continue
+		}
+		breaker.Unregister(server)
+		limiter.Unregister(server)
+	}
+}
@@ -0,0 +1,115 @@
+package zipper
+
+import (
+	"testing"
+
+	"github.com/go-graphite/carbonzipper/zipper/cache"
+	"github.com/go-graphite/carbonzipper/zipper/types"
+	"go.uber.org/zap"
+)
+
+func reloadTestBackends(serversB []string, weightsA map[string]int, maxTries int) types.BackendsV2 {
+	return types.BackendsV2{
+		Backends: []types.BackendV2{
+			{
+				GroupName: "reload_a",
+				Protocol:  "carbonapi_v3_pb",
+				LBMethod:  "roundrobin",
+				Servers:   []string{"http://127.0.0.1:8001", "http://127.0.0.1:8002"},
+				Weights:   weightsA,
+			},
+			{
+				GroupName: "reload_b",
+				Protocol:  "carbonapi_v3_pb",
+				LBMethod:  "broadcast",
+				Servers:   serversB,
+			},
+		},
+		Timeouts: defaultTimeouts,
+		MaxTries: maxTries,
+	}
+}
+
+func TestReloadKeepsUnchangedGroups(t *testing.T) {
+	z := &Zipper{
+		logger:         zap.NewNop(),
+		expireDelaySec: 60,
+		timeouts:       defaultTimeouts,
+	}
+	serversB := []string{"http://127.0.0.1:8003"}
+
+	first, err := z.newGroupSet("reload_root", reloadTestBackends(serversB, nil, 1), types.DefaultQueryCaches, nil, nil)
+	if err != nil && err.HaveFatalErrors {
+		t.Fatalf("failed to create groups: %v", err.Errors)
+	}
+
+	(&backends{storeGroups: first}).register()
+	registered := cache.Lookup("reload_b", "find")
+
+	same, err := z.newGroupSet("reload_root", reloadTestBackends(serversB, nil, 1), types.DefaultQueryCaches, first, nil)
+	if err != nil && err.HaveFatalErrors {
+		t.Fatalf("failed to create groups: %v", err.Errors)
+	}
+	if same.group != first.group {
+		t.Error("broadcast group is recreated, while none of it's groups changed")
+	}
+
+	weights := map[string]int{"http://127.0.0.1:8001": 2, "http://127.0.0.1:8002": 1}
+	changed, err := z.newGroupSet("reload_root", reloadTestBackends(append(serversB, "http://127.0.0.1:8004"), weights, 1), types.DefaultQueryCaches, same, nil)
+	if err != nil && err.HaveFatalErrors {
+		t.Fatalf("failed to create groups: %v", err.Errors)
+	}
+	if changed.groups["reload_a"].client != first.groups["reload_a"].client {
+		t.Error("group which only weights changed is recreated")
+	}
+	// registries are changed only when the groups are put to use
+	if w := types.ServerWeights.Get("reload_a", "http://127.0.0.1:8001"); w != 1 {
+		t.Errorf("got weight %v before new groups are registered, expected 1", w)
+	}
+	if cache.Lookup("reload_b", "find") != registered {
+		t.Error("caches of the group are replaced before new groups are registered")
+	}
+	(&backends{storeGroups: changed}).register()
+	if w := types.ServerWeights.Get("reload_a", "http://127.0.0.1:8001"); w != 2 {
+		t.Errorf("got weight %v, expected 2", w)
+	}
+	if cache.Lookup("reload_b", "find") == registered {
+		t.Error("caches of the changed group are not registered")
+	}
+	if changed.groups["reload_b"].client == first.groups["reload_b"].client {
+		t.Error("group with new server is not recreated")
+	}
+	if changed.group == first.group {
+		t.Error("broadcast group is not recreated, while it's groups changed")
+	}
+
+	settings, err := z.newGroupSet("reload_root", reloadTestBackends(serversB, weights, 2), types.DefaultQueryCaches, changed, nil)
+	if err != nil && err.HaveFatalErrors {
+		t.Fatalf("failed to create groups: %v", err.Errors)
+	}
+	if settings.groups["reload_a"].client == changed.groups["reload_a"].client {
+		t.Error("group is not recreated after common settings changed")
+	}
+}
+
+func TestValidateBackendsV2(t *testing.T) {
+	valid := reloadTestBackends([]string{"http://127.0.0.1:8003"}, nil, 1)
+	if err := validateBackendsV2(valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, f := range map[string]func(b *types.BackendsV2){
+		"unknown protocol": func(b *types.BackendsV2) { b.Backends[0].Protocol = "unknown" },
+		"invalid lbMethod": func(b *types.BackendsV2) { b.Backends[0].LBMethod = "unknown" },
+		"duplicate group":  func(b *types.BackendsV2) { b.Backends[1].GroupName = b.Backends[0].GroupName },
+		"unknown server weight": func(b *types.BackendsV2) {
+			b.Backends[0].Weights = map[string]int{"http://127.0.0.1:9000": 1}
+		},
+	} {
+		b := reloadTestBackends([]string{"http://127.0.0.1:8003"}, nil, 1)
+		f(&b)
+		if err := validateBackendsV2(b); err == nil {
+			t.Errorf("%v: expected error", name)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package types
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"time"
 )
 
@@ -12,19 +15,34 @@ type BackendsV2 struct {
 	KeepAliveInterval         time.Duration `mapstructure:"keepAliveInterval"`
 	MaxTries                  int           `mapstructure:"maxTries"`
 	MaxGlobs                  int           `mapstructure:"maxGlobs"`
+	QueryCaches               QueryCaches   `mapstructure:"queryCaches"`
 }
 
 type BackendV2 struct {
-	GroupName           string         `mapstructure:"groupName"`
-	Protocol            string         `mapstructure:"protocol"`
-	LBMethod            string         `mapstructure:"lbMethod"` // Valid: rr/roundrobin, broadcast/all
-	Servers             []string       `mapstructure:"servers"`
-	Timeouts            *Timeouts      `mapstructure:"timeouts"`
-	ConcurrencyLimit    *int           `mapstructure:"concurrencyLimit"`
-	KeepAliveInterval   *time.Duration `mapstructure:"keepAliveInterval"`
-	MaxIdleConnsPerHost *int           `mapstructure:"maxIdleConnsPerHost"`
-	MaxTries            *int           `mapstructure:"maxTries"`
-	MaxGlobs            int            `mapstructure:"maxGlobs"`
+	GroupName           string              `mapstructure:"groupName"`
+	Protocol            string              `mapstructure:"protocol"`
+	LBMethod            string              `mapstructure:"lbMethod"` // Valid: rr/roundrobin, least_requests, ewma, broadcast/all, carbon_ch, fnv1a_ch, quorum
+	Servers             []string            `mapstructure:"servers"`
+	Weights             map[string]int      `mapstructure:"weights"` // filled from {server, weight} form of Servers, see ServersDecodeHook
+	Timeouts            *Timeouts           `mapstructure:"timeouts"`
+	ConcurrencyLimit    *int                `mapstructure:"concurrencyLimit"`
+	KeepAliveInterval   *time.Duration      `mapstructure:"keepAliveInterval"`
+	MaxIdleConnsPerHost *int                `mapstructure:"maxIdleConnsPerHost"`
+	MaxTries            *int                `mapstructure:"maxTries"`
+	MaxGlobs            int                 `mapstructure:"maxGlobs"`
+	Hedging             *Hedging            `mapstructure:"hedging"`
+	HealthCheck         *HealthCheck        `mapstructure:"healthCheck"`
+	CircuitBreaker      *CircuitBreaker     `mapstructure:"circuitBreaker"`
+	ConcurrencyLimiter  *ConcurrencyLimiter `mapstructure:"concurrencyLimiter"`
+	QueryCaches         QueryCaches         `mapstructure:"queryCaches"`
+
+	// Only for carbon_ch and fnv1a_ch
+	ReplicationFactor int      `mapstructure:"replicationFactor"`
+	HashRingNodes     []string `mapstructure:"hashRingNodes"` // host[:port][=instance] as in relay config, same order as Servers
+
+	// Only for quorum
+	Replicas int `mapstructure:"replicas"` // amount of servers that have a full copy of the data, defaults to len(Servers)
+	Quorum   int `mapstructure:"quorum"`   // amount of successful answers that is enough to reply
 }
 
 func (b *BackendV2) FillDefaults() {
@@ -46,6 +64,146 @@ func (b *BackendV2) FillDefaults() {
 	}
 }
 
+// ValidateWeights checks that weights are specified only for group's servers and are not negative
+func (b *BackendV2) ValidateWeights() error {
+	servers := make(map[string]struct{}, len(b.Servers))
+	for _, s := range b.Servers {
+		servers[s] = struct{}{}
+	}
+	for s, w := range b.Weights {
+		if _, ok := servers[s]; !ok {
+			return fmt.Errorf("weight specified for unknown server '%v' in group '%v'", s, b.GroupName)
+		}
+		if w < 0 {
+			return fmt.Errorf("negative weight %v for server '%v' in group '%v'", w, s, b.GroupName)
+		}
+	}
+	return nil
+}
+
+func toStringMap(data interface{}) (map[string]interface{}, bool) {
+	switch m := data.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			res[strings.ToLower(k)] = v
+		}
+		return res, true
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			res[strings.ToLower(fmt.Sprint(k))] = v
+		}
+		return res, true
+	}
+	return nil, false
+}
+
+// ServersDecodeHook is a mapstructure decode hook, that allows to specify BackendV2 servers either as plain strings
+// or as {server: "http://host:port", weight: 2} objects
+func ServersDecodeHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(BackendV2{}) {
+		return data, nil
+	}
+	backend, ok := toStringMap(data)
+	if !ok {
+		return data, nil
+	}
+	servers, ok := backend["servers"].([]interface{})
+	if !ok {
+		return data, nil
+	}
+
+	plain := make([]interface{}, 0, len(servers))
+	weights := make(map[string]interface{})
+	for _, s := range servers {
+		server, ok := toStringMap(s)
+		if !ok {
+			plain = append(plain, s)
+			continue
+		}
+		name, ok := server["server"].(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("server %v should have non-empty 'server' field", s)
+		}
+		plain = append(plain, name)
+		if w, ok := server["weight"]; ok {
+			weights[name] = w
+		}
+	}
+
+	backend["servers"] = plain
+	if len(weights) > 0 {
+		backend["weights"] = weights
+	}
+	return backend, nil
+}
+
+// Hedging configures duplicate requests to another server of the group, if the first one is too slow to answer
+type Hedging struct {
+	// Delay before sending hedged request. When Percentile is set, it's used until there is enough data about server's latency and as a lower bound.
+	// Without it requests are not hedged until there is such data
+	Delay time.Duration `mapstructure:"delay"`
+	// Percentile (e.g. 95) of the server's observed latency that is used as a delay
+	Percentile float64 `mapstructure:"percentile"`
+}
+
+// Enabled returns true if hedged requests should be sent
+func (h *Hedging) Enabled() bool {
+	return h != nil && (h.Delay > 0 || h.Percentile > 0)
+}
+
+// HealthCheck configures ejection of unhealthy servers from round-robin groups
+type HealthCheck struct {
+	// Server is ejected after that amount of consecutive failures. Default: 5
+	ConsecutiveFailures int `mapstructure:"consecutiveFailures"`
+	// Server is ejected if it's median latency is that many times bigger than median of other servers in the group. 0 disables latency based ejection
+	LatencyFactor float64 `mapstructure:"latencyFactor"`
+	// Time of the first ejection, every next one is twice longer. Default: 10s
+	EjectionTime time.Duration `mapstructure:"ejectionTime"`
+	// Upper bound for the ejection time. Default: 5m
+	MaxEjectionTime time.Duration `mapstructure:"maxEjectionTime"`
+	// URI that is periodically requested from every server. Empty disables active probing
+	ProbeURI string `mapstructure:"probeURI"`
+	// Interval for active probes and latency checks. Default: 10s
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// CircuitBreaker configures per-server circuit breaker. When it's open, requests to the server fail immediately
+type CircuitBreaker struct {
+	// Circuit opens when that fraction of requests in the window failed. Default: 0.5
+	ErrorRate float64 `mapstructure:"errorRate"`
+	// Requests slower than that are counted as failed. 0 disables latency check
+	LatencyThreshold time.Duration `mapstructure:"latencyThreshold"`
+	// Minimum amount of requests in the window to make a decision. Default: 20
+	MinRequests int `mapstructure:"minRequests"`
+	// Length of the window. Default: 10s
+	Window time.Duration `mapstructure:"window"`
+	// How long circuit stays open before trial requests are allowed. Default: 30s
+	OpenTime time.Duration `mapstructure:"openTime"`
+	// Amount of successful trial requests to close the circuit. Default: 1
+	HalfOpenRequests int `mapstructure:"halfOpenRequests"`
+}
+
+// ConcurrencyLimiter selects how amount of concurrent requests to the servers of the group is limited and how long requests can wait for a slot
+type ConcurrencyLimiter struct {
+	// Valid: fixed (concurrencyLimit is used as is), aimd, gradient. Default: fixed
+	Type string `mapstructure:"type"`
+	// Limit to start with. Default: concurrencyLimit or 20, if it's not set
+	InitialLimit int `mapstructure:"initialLimit"`
+	// Bounds for the limit. Default: 1 and 1000
+	MinLimit int `mapstructure:"minLimit"`
+	MaxLimit int `mapstructure:"maxLimit"`
+	// aimd only: requests slower than that decrease the limit, as well as timeouts. 0 means only timeouts are counted
+	LatencyThreshold time.Duration `mapstructure:"latencyThreshold"`
+	// aimd only: limit is multiplied by that on every slow request. Default: 0.9
+	BackoffRatio float64 `mapstructure:"backoffRatio"`
+	// gradient only: how long the lowest observed latency is remembered. Default: 1m
+	Window time.Duration `mapstructure:"window"`
+	// Requests that wait for a free slot longer than that fail immediately. 0 means they wait until request's timeout
+	MaxQueueWait time.Duration `mapstructure:"maxQueueWait"`
+}
+
 // CarbonSearch is a structure that contains carbonsearch related configuration bits
 type CarbonSearch struct {
 	Backend string `mapstructure:"backend"`
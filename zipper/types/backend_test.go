@@ -0,0 +1,62 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+func TestServersDecodeHook(t *testing.T) {
+	// That's how yaml parser returns the config
+	settings := map[string]interface{}{
+		"backends": []interface{}{
+			map[interface{}]interface{}{
+				"groupName": "group",
+				"servers": []interface{}{
+					"http://10.0.0.1:8080",
+					map[interface{}]interface{}{
+						"server": "http://10.0.0.2:8080",
+						"weight": 3,
+					},
+					map[interface{}]interface{}{
+						"server": "http://10.0.0.3:8080",
+					},
+				},
+			},
+		},
+	}
+
+	var backends BackendsV2
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           &backends,
+		WeaklyTypedInput: true,
+		DecodeHook:       ServersDecodeHook,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = decoder.Decode(settings)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []BackendV2{
+		{
+			GroupName: "group",
+			Servers:   []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080"},
+			Weights:   map[string]int{"http://10.0.0.2:8080": 3},
+		},
+	}
+	if !reflect.DeepEqual(backends.Backends, expected) {
+		t.Errorf("got %+v, expected %+v", backends.Backends, expected)
+	}
+
+	if err := backends.Backends[0].ValidateWeights(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	backends.Backends[0].Weights["http://10.0.0.4:8080"] = 1
+	if err := backends.Backends[0].ValidateWeights(); err == nil {
+		t.Errorf("expected error for weight of unknown server")
+	}
+}
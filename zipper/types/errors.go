@@ -15,6 +15,7 @@ var ErrNotFound = errors.New("metric not found")
 var ErrNoResponseFetched = errors.New("no responses fetched from upstream")
 var ErrNoMetricsFetched = errors.New("no metrics in the Response")
 var ErrMaxTriesExceeded = errors.New("max tries exceeded")
+var ErrQuorumNotReached = errors.New("not enough replicas answered to reach quorum")
 
 var ErrFailedToFetchFmt = "failed to fetch data from server group %v, code %v, body %v"
 
@@ -0,0 +1,152 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+// Guardrails limit how big requests and responses can be. Zero disables the limit
+type Guardrails struct {
+	// Maximum amount of globs (targets) in one request
+	MaxGlobsPerRequest int `mapstructure:"maxGlobsPerRequest"`
+	// Maximum amount of metrics after globs are expanded
+	MaxMetrics int `mapstructure:"maxMetrics"`
+	// Maximum amount of datapoints in all fetched metrics
+	MaxPoints int `mapstructure:"maxPoints"`
+	// Maximum size of the response in bytes (protobuf encoded)
+	MaxResponseBytes int `mapstructure:"maxResponseBytes"`
+	// Step of the metrics, that is assumed to estimate amount of datapoints before fetching them. Default: 60s
+	EstimationStep time.Duration `mapstructure:"estimationStep"`
+}
+
+const defaultEstimationStep = 60 * time.Second
+
+// LimitExceededError is returned when request or response exceeds one of the guardrails
+type LimitExceededError struct {
+	Limit string
+	Value int
+	Max   int
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("request is too big: %v %v exceeds the limit of %v", e.Value, e.Limit, e.Max)
+}
+
+func checkLimit(limit string, value, max int) error {
+	if max > 0 && value > max {
+		return &LimitExceededError{
+			Limit: limit,
+			Value: value,
+			Max:   max,
+		}
+	}
+	return nil
+}
+
+// CheckGlobs checks amount of globs in the request
+func (g *Guardrails) CheckGlobs(globs int) error {
+	if g == nil {
+		return nil
+	}
+	return checkLimit("globs", globs, g.MaxGlobsPerRequest)
+}
+
+// CheckMetrics checks amount of metrics after globs were expanded
+func (g *Guardrails) CheckMetrics(metrics int) error {
+	if g == nil {
+		return nil
+	}
+	return checkLimit("metrics", metrics, g.MaxMetrics)
+}
+
+// CheckFetchEstimate checks amount of metrics and datapoints before fetching them. matches are amounts of metrics, that
+// each of the requested globs expands to. Datapoints are estimated from the time range and EstimationStep
+func (g *Guardrails) CheckFetchEstimate(request *protov3.MultiFetchRequest, matches []int) error {
+	if g == nil {
+		return nil
+	}
+	step := int64(g.EstimationStep.Seconds())
+	if step <= 0 {
+		step = int64(defaultEstimationStep.Seconds())
+	}
+	metrics, points := 0, 0
+	for i := range request.Metrics {
+		metrics += matches[i]
+		if r := request.Metrics[i].StopTime - request.Metrics[i].StartTime; r > 0 {
+			points += matches[i] * int(r/step)
+		}
+	}
+	if err := g.CheckMetrics(metrics); err != nil {
+		return err
+	}
+	return checkLimit("points", points, g.MaxPoints)
+}
+
+// CheckFetchResponse checks amount of metrics, datapoints and size of the response
+func (g *Guardrails) CheckFetchResponse(response *protov3.MultiFetchResponse) error {
+	if g == nil || response == nil {
+		return nil
+	}
+	if err := g.CheckMetrics(len(response.Metrics)); err != nil {
+		return err
+	}
+	if g.MaxPoints > 0 {
+		points := 0
+		for i := range response.Metrics {
+			points += len(response.Metrics[i].Values)
+		}
+		if err := checkLimit("points", points, g.MaxPoints); err != nil {
+			return err
+		}
+	}
+	if g.MaxResponseBytes > 0 {
+		return checkLimit("bytes", response.Size(), g.MaxResponseBytes)
+	}
+	return nil
+}
+
+// CheckFindResponse checks amount of found metrics and size of the response
+func (g *Guardrails) CheckFindResponse(response *protov3.MultiGlobResponse) error {
+	if g == nil || response == nil {
+		return nil
+	}
+	if g.MaxMetrics > 0 {
+		matches := 0
+		for i := range response.Metrics {
+			matches += len(response.Metrics[i].Matches)
+		}
+		if err := g.CheckMetrics(matches); err != nil {
+			return err
+		}
+	}
+	if g.MaxResponseBytes > 0 {
+		return checkLimit("bytes", response.Size(), g.MaxResponseBytes)
+	}
+	return nil
+}
+
+// LimitExceeded returns the first LimitExceededError from the list, if any
+func LimitExceeded(errs []error) error {
+	for _, err := range errs {
+		if _, ok := err.(*LimitExceededError); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+type guardrailsKey struct{}
+
+// WithGuardrails returns context, whose requests will be checked against the guardrails
+func WithGuardrails(ctx context.Context, g *Guardrails) context.Context {
+	return context.WithValue(ctx, guardrailsKey{}, g)
+}
+
+// GuardrailsFromContext returns guardrails of the request or nil if there are none
+func GuardrailsFromContext(ctx context.Context) *Guardrails {
+	g, _ := ctx.Value(guardrailsKey{}).(*Guardrails)
+	return g
+}
@@ -22,6 +22,20 @@ type ServerClient interface {
 	ProbeTLDs(ctx context.Context) ([]string, *errors.Errors)
 }
 
+// Registrar is implemented by clients, that publish their state (caches, routing, health checks, circuit breakers and
+// limiters) in global registries. Clients are registered only when they are put to use, so the ones that were created
+// but never used don't replace the state of the clients that serve requests. Registering client again does nothing
+type Registrar interface {
+	Register()
+}
+
+// Register registers the client, if it publishes any state
+func Register(client ServerClient) {
+	if r, ok := client.(Registrar); ok {
+		r.Register()
+	}
+}
+
 /*
 type Fetcher interface {
 	// PB-compatible methods
@@ -13,6 +13,11 @@ type LBMethod int
 const (
 	RoundRobinLB LBMethod = iota
 	BroadcastLB
+	CarbonCHLB
+	FNV1aCHLB
+	QuorumLB
+	LeastRequestsLB
+	EWMALB
 )
 
 func (p LBMethod) keys(m map[string]LBMethod) []string {
@@ -29,6 +34,12 @@ var supportedLBMethods = map[string]LBMethod{
 	"any":        RoundRobinLB,
 	"broadcast":  BroadcastLB,
 	"all":        BroadcastLB,
+	"carbon_ch":  CarbonCHLB,
+	"fnv1a_ch":   FNV1aCHLB,
+	"quorum":     QuorumLB,
+
+	"least_requests": LeastRequestsLB,
+	"ewma":           EWMALB,
 }
 
 func (m *LBMethod) FromString(method string) error {
@@ -60,6 +71,16 @@ func (m LBMethod) MarshalJSON() ([]byte, error) {
 		return json.Marshal("RoundRobin")
 	case BroadcastLB:
 		return json.Marshal("Broadcast")
+	case CarbonCHLB:
+		return json.Marshal("CarbonCH")
+	case FNV1aCHLB:
+		return json.Marshal("FNV1aCH")
+	case QuorumLB:
+		return json.Marshal("Quorum")
+	case LeastRequestsLB:
+		return json.Marshal("LeastRequests")
+	case EWMALB:
+		return json.Marshal("EWMA")
 	}
 
 	return nil, fmt.Errorf(ErrUnknownLBMethodFmt, m, m.keys(supportedLBMethods))
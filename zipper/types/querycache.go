@@ -0,0 +1,141 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// QueryCache configures one of the caches, that broadcast groups use to send identical requests to the backends only once
+type QueryCache struct {
+	// Approximate maximum size of the cache
+	Size uint64 `mapstructure:"size"`
+	// How long the responses are kept
+	TTL time.Duration `mapstructure:"ttl"`
+	// Disables the cache. Cache that is disabled globally can't be enabled for a group
+	Disabled bool `mapstructure:"disabled"`
+	// find and fetch only: how long requests, that found nothing or failed, are kept. Default: 0 (not kept, except for
+	// finds that found nothing, which are kept for TTL)
+	EmptyTTL time.Duration `mapstructure:"emptyTTL"`
+	ErrorTTL time.Duration `mapstructure:"errorTTL"`
+	// find and fetch only: how long expired responses are kept to be served if all backends fail, and how long after
+	// expiration they are served right away, while being refreshed in background. Default: 0 (disabled)
+	StaleTTL   time.Duration `mapstructure:"staleTTL"`
+	Revalidate time.Duration `mapstructure:"revalidate"`
+}
+
+// QueryCaches configures query caches of broadcast groups. Caches that are not set are taken from the global config,
+// zero fields of the ones that are set are taken from the global config as well
+type QueryCaches struct {
+	Info  *QueryCache `mapstructure:"info"`
+	Find  *QueryCache `mapstructure:"find"`
+	Fetch *QueryCache `mapstructure:"fetch"`
+	Probe *QueryCache `mapstructure:"probe"`
+}
+
+// DefaultQueryCaches are used when nothing is configured
+var DefaultQueryCaches = QueryCaches{
+	Info:  &QueryCache{Size: 1024, TTL: 5 * time.Second},
+	Find:  &QueryCache{Size: 1024, TTL: 5 * time.Second},
+	Fetch: &QueryCache{Size: 25600, TTL: 1 * time.Second},
+	Probe: &QueryCache{Size: 1024, TTL: 10 * time.Second},
+}
+
+func mergeQueryCache(c, defaults *QueryCache) *QueryCache {
+	if c == nil {
+		return defaults
+	}
+	if defaults == nil {
+		return c
+	}
+	res := *c
+	if res.Size == 0 {
+		res.Size = defaults.Size
+	}
+	if res.TTL == 0 {
+		res.TTL = defaults.TTL
+	}
+	if res.EmptyTTL == 0 {
+		res.EmptyTTL = defaults.EmptyTTL
+	}
+	if res.ErrorTTL == 0 {
+		res.ErrorTTL = defaults.ErrorTTL
+	}
+	if res.StaleTTL == 0 {
+		res.StaleTTL = defaults.StaleTTL
+	}
+	if res.Revalidate == 0 {
+		res.Revalidate = defaults.Revalidate
+	}
+	res.Disabled = res.Disabled || defaults.Disabled
+	return &res
+}
+
+// Merge returns config, where unset caches and fields are taken from defaults
+func (c QueryCaches) Merge(defaults QueryCaches) QueryCaches {
+	return QueryCaches{
+		Info:  mergeQueryCache(c.Info, defaults.Info),
+		Find:  mergeQueryCache(c.Find, defaults.Find),
+		Fetch: mergeQueryCache(c.Fetch, defaults.Fetch),
+		Probe: mergeQueryCache(c.Probe, defaults.Probe),
+	}
+}
+
+// Validate checks that TTLs are not negative
+func (c QueryCaches) Validate() error {
+	for kind, q := range map[string]*QueryCache{"info": c.Info, "find": c.Find, "fetch": c.Fetch, "probe": c.Probe} {
+		if q == nil {
+			continue
+		}
+		if q.TTL < 0 || q.EmptyTTL < 0 || q.ErrorTTL < 0 || q.StaleTTL < 0 || q.Revalidate < 0 {
+			return fmt.Errorf("negative ttl for %v cache", kind)
+		}
+	}
+	return nil
+}
+
+type noNegativeCacheKey struct{}
+
+// WithoutNegativeCache returns context, whose requests ignore cached results of the requests, that found nothing or failed
+func WithoutNegativeCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noNegativeCacheKey{}, true)
+}
+
+// NegativeCacheBypassed returns true if request should ignore cached results, that found nothing or failed
+func NegativeCacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(noNegativeCacheKey{}).(bool)
+	return bypass
+}
+
+// SharedCache configures second-level cache for find and fetch responses, that can be shared between zipper instances
+type SharedCache struct {
+	// Valid: memcache, mem (in-process, mostly for testing). Default: "" (disabled)
+	Type string `mapstructure:"type"`
+	// memcache only: servers, prefix for the keys and timeout for get requests. Default timeout: 50ms
+	Servers []string      `mapstructure:"servers"`
+	Prefix  string        `mapstructure:"prefix"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// mem only: maximum size in bytes. Default: 0 (unlimited)
+	Size uint64 `mapstructure:"size"`
+	// How long responses are kept. Default: 60s for both
+	FindTTL  time.Duration `mapstructure:"findTTL"`
+	FetchTTL time.Duration `mapstructure:"fetchTTL"`
+	// Compress responses with gzip
+	Compress bool `mapstructure:"compress"`
+}
+
+// FetchChunks configures cache of fetched data, that is stored in time chunks aligned to multiples of ChunkSize, so
+// requests for sliding time ranges fetch from backends only the part, that is not cached yet
+type FetchChunks struct {
+	// Length of one chunk, steps of the metrics should divide it. Default: 0 (disabled)
+	ChunkSize time.Duration `mapstructure:"chunkSize"`
+	// Maximum size of the cache in bytes. Default: 100MB
+	Size uint64 `mapstructure:"size"`
+	// How long chunks in the past are kept. Default: 10m
+	TTL time.Duration `mapstructure:"ttl"`
+	// How long chunk, that contains current time, is kept, as it's still updated. Default: 10s
+	NowTTL time.Duration `mapstructure:"nowTTL"`
+	// Chunks, that end less than that before current time, are kept for NowTTL too, as late points could still arrive
+	// to them. Negative value disables it. Default: 1m
+	NowGrace time.Duration `mapstructure:"nowGrace"`
+}
@@ -98,6 +98,77 @@ func (first *ServerFindResponse) Merge(second *ServerFindResponse) *errors.Error
 	return nil
 }
 
+type ServerListResponse struct {
+	Server   string
+	Response *protov3.ListMetricsResponse
+	Stats    *Stats
+	Err      *errors.Errors
+}
+
+// Merge adds metric names from second response that are not yet in the first one
+func (first *ServerListResponse) Merge(second *ServerListResponse) {
+	if second.Stats != nil {
+		first.Stats.Merge(second.Stats)
+	}
+
+	if first.Err == nil {
+		first.Err = &errors.Errors{}
+	}
+	first.Err.Merge(second.Err)
+
+	if second.Response == nil {
+		return
+	}
+
+	seenMetrics := make(map[string]struct{}, len(first.Response.Metrics))
+	for _, m := range first.Response.Metrics {
+		seenMetrics[m] = struct{}{}
+	}
+
+	for _, m := range second.Response.Metrics {
+		if _, ok := seenMetrics[m]; !ok {
+			seenMetrics[m] = struct{}{}
+			first.Response.Metrics = append(first.Response.Metrics, m)
+		}
+	}
+}
+
+type ServerStatsResponse struct {
+	Server   string
+	Response *protov3.MetricDetailsResponse
+	Stats    *Stats
+	Err      *errors.Errors
+}
+
+// Merge sums up free and total space of both responses. If metric is present in both, the one
+// that was modified last wins.
+func (first *ServerStatsResponse) Merge(second *ServerStatsResponse) {
+	if second.Stats != nil {
+		first.Stats.Merge(second.Stats)
+	}
+
+	if first.Err == nil {
+		first.Err = &errors.Errors{}
+	}
+	first.Err.Merge(second.Err)
+
+	if second.Response == nil {
+		return
+	}
+
+	first.Response.FreeSpace += second.Response.FreeSpace
+	first.Response.TotalSpace += second.Response.TotalSpace
+
+	if first.Response.Metrics == nil {
+		first.Response.Metrics = make(map[string]*protov3.MetricDetails, len(second.Response.Metrics))
+	}
+	for k, v := range second.Response.Metrics {
+		if m, ok := first.Response.Metrics[k]; !ok || m.ModTime < v.ModTime {
+			first.Response.Metrics[k] = v
+		}
+	}
+}
+
 type ServerFetchResponse struct {
 	Server       string
 	ResponsesMap map[string][]protov3.FetchResponse
@@ -15,8 +15,15 @@ type Stats struct {
 	CacheMisses int64
 	CacheHits   int64
 
-	Servers       []string
-	FailedServers []string
+	HedgedRequests int64
+	HedgeWins      int64
+
+	// Responses, that were served from cache after they expired
+	StaleResponses int64
+
+	Servers        []string
+	FailedServers  []string
+	SkippedServers []string
 }
 
 func (s *Stats) Merge(stats *Stats) {
@@ -30,6 +37,10 @@ func (s *Stats) Merge(stats *Stats) {
 	s.MemoryUsage += stats.MemoryUsage
 	s.CacheMisses += stats.CacheMisses
 	s.CacheHits += stats.CacheHits
+	s.HedgedRequests += stats.HedgedRequests
+	s.HedgeWins += stats.HedgeWins
+	s.StaleResponses += stats.StaleResponses
 	s.Servers = append(s.Servers, stats.Servers...)
 	s.FailedServers = append(s.FailedServers, stats.FailedServers...)
+	s.SkippedServers = append(s.SkippedServers, stats.SkippedServers...)
 }
@@ -0,0 +1,62 @@
+package types
+
+import (
+	"sync"
+)
+
+// DefaultWeight is used for servers that don't have weight specified
+const DefaultWeight = 1
+
+// Weights holds weights of servers for each backend group. They can be changed at runtime, e.x. on config reload
+type Weights struct {
+	sync.RWMutex
+	groups map[string]map[string]int
+}
+
+// ServerWeights is a registry of weights for all configured groups
+var ServerWeights = &Weights{
+	groups: make(map[string]map[string]int),
+}
+
+// Set replaces weights of the group's servers
+func (w *Weights) Set(group string, weights map[string]int) {
+	m := make(map[string]int, len(weights))
+	for s, v := range weights {
+		m[s] = v
+	}
+
+	w.Lock()
+	w.groups[group] = m
+	w.Unlock()
+}
+
+// Delete removes weights of the group. Should be called when group is removed
+func (w *Weights) Delete(group string) {
+	w.Lock()
+	delete(w.groups, group)
+	w.Unlock()
+}
+
+// Get returns weight of the server in the group
+func (w *Weights) Get(group, server string) int {
+	w.RLock()
+	defer w.RUnlock()
+
+	if v, ok := w.groups[group][server]; ok {
+		return v
+	}
+	return DefaultWeight
+}
+
+// Uniform returns true if all servers of the group have default weight
+func (w *Weights) Uniform(group string) bool {
+	w.RLock()
+	defer w.RUnlock()
+
+	for _, v := range w.groups[group] {
+		if v != DefaultWeight {
+			return false
+		}
+	}
+	return true
+}
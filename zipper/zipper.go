@@ -2,16 +2,22 @@ package zipper
 
 import (
 	"context"
+	"fmt"
 	"math"
 	_ "net/http/pprof"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-graphite/carbonzipper/limiter"
 	"github.com/go-graphite/carbonzipper/pathcache"
 	"github.com/go-graphite/carbonzipper/zipper/broadcast"
+	"github.com/go-graphite/carbonzipper/zipper/cache"
 	"github.com/go-graphite/carbonzipper/zipper/config"
 	"github.com/go-graphite/carbonzipper/zipper/errors"
+	"github.com/go-graphite/carbonzipper/zipper/hashring"
 	"github.com/go-graphite/carbonzipper/zipper/metadata"
 	"github.com/go-graphite/carbonzipper/zipper/types"
 	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
@@ -38,14 +44,20 @@ type Zipper struct {
 	timeoutKeepAlive  time.Duration
 	keepAliveInterval time.Duration
 
-	searchConfigured bool
-	searchBackends   types.ServerClient
-	searchPrefix     string
-
 	searchCache pathcache.PathCache
+	snapshotter *pathcache.Snapshotter
+
+	guardrails *types.Guardrails
 
-	// Will broadcast to all servers there
-	storeBackends             types.ServerClient
+	// Current *backends, replaced when config is reloaded
+	backends   *atomic.Value
+	reloadLock *sync.Mutex
+
+	// Settings of the root and search groups
+	sharedCache               *cache.SharedCache
+	chunkCache                *cache.ChunkCache
+	expireDelaySec            int32
+	timeouts                  types.Timeouts
 	concurrencyLimitPerServer int
 
 	sendStats func(*types.Stats)
@@ -79,8 +91,75 @@ func sanitizeTimouts(timeouts, defaultTimeouts types.Timeouts) types.Timeouts {
 	return timeouts
 }
 
-func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, expireDelaySec int32) ([]types.ServerClient, *errors.Errors) {
+// convertBackends converts old config format of the backends to the new one and fills default timeouts of the groups
+func convertBackends(config *config.Config) {
+	// Convert old config format to new one
+	if config.CarbonSearch.Backend != "" {
+		config.CarbonSearchV2.BackendsV2 = types.BackendsV2{
+			Backends: []types.BackendV2{{
+				GroupName:           config.CarbonSearch.Backend,
+				Protocol:            "carbonapi_v2_pb",
+				LBMethod:            "roundrobin",
+				Servers:             []string{config.CarbonSearch.Backend},
+				Timeouts:            &config.Timeouts,
+				ConcurrencyLimit:    &config.ConcurrencyLimitPerServer,
+				KeepAliveInterval:   &config.KeepAliveInterval,
+				MaxIdleConnsPerHost: &config.MaxIdleConnsPerHost,
+				MaxTries:            &config.MaxTries,
+				MaxGlobs:            0,
+			}},
+			MaxIdleConnsPerHost:       config.MaxIdleConnsPerHost,
+			ConcurrencyLimitPerServer: config.ConcurrencyLimitPerServer,
+			Timeouts:                  config.Timeouts,
+			KeepAliveInterval:         config.KeepAliveInterval,
+			MaxTries:                  config.MaxTries,
+			MaxGlobs:                  config.MaxGlobs,
+		}
+		config.CarbonSearchV2.Prefix = config.CarbonSearch.Prefix
+	}
+
+	// Convert old config format to new one
+	if config.Backends != nil && len(config.Backends) != 0 {
+		config.BackendsV2 = types.BackendsV2{
+			Backends: []types.BackendV2{
+				{
+					GroupName:           "backends",
+					Protocol:            "carbonapi_v2_pb",
+					LBMethod:            "broadcast",
+					Servers:             config.Backends,
+					Timeouts:            &config.Timeouts,
+					ConcurrencyLimit:    &config.ConcurrencyLimitPerServer,
+					KeepAliveInterval:   &config.KeepAliveInterval,
+					MaxIdleConnsPerHost: &config.MaxIdleConnsPerHost,
+					MaxTries:            &config.MaxTries,
+					MaxGlobs:            config.MaxGlobs,
+				},
+			},
+			MaxIdleConnsPerHost:       config.MaxIdleConnsPerHost,
+			ConcurrencyLimitPerServer: config.ConcurrencyLimitPerServer,
+			Timeouts:                  config.Timeouts,
+			KeepAliveInterval:         config.KeepAliveInterval,
+			MaxTries:                  config.MaxTries,
+			MaxGlobs:                  config.MaxGlobs,
+		}
+	}
+
+	config.BackendsV2.Timeouts = sanitizeTimouts(config.BackendsV2.Timeouts, config.Timeouts)
+	for i := range config.BackendsV2.Backends {
+		if config.BackendsV2.Backends[i].Timeouts == nil {
+			timeouts := config.BackendsV2.Timeouts
+			config.BackendsV2.Backends[i].Timeouts = &timeouts
+		}
+		timeouts := sanitizeTimouts(*(config.BackendsV2.Backends[i].Timeouts), config.BackendsV2.Timeouts)
+		config.BackendsV2.Backends[i].Timeouts = &timeouts
+	}
+}
+
+// createBackendsV2 creates clients for the groups. Groups from previous, which definitions did not change, are reused
+// instead of creating new ones. Returns definitions of all the groups, so they can be reused later
+func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, queryCaches types.QueryCaches, expireDelaySec int32, previous map[string]backendGroup) ([]types.ServerClient, map[string]backendGroup, *errors.Errors) {
 	storeClients := make([]types.ServerClient, 0)
+	groups := make(map[string]backendGroup, len(backends.Backends))
 	var e errors.Errors
 	var ePtr *errors.Errors
 	timeouts := backends.Timeouts
@@ -128,7 +207,7 @@ func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, expireDelay
 				zap.String("requested_protocol", backend.Protocol),
 				zap.Strings("supported_backends", protocols),
 			)
-			return nil, errors.Fatalf("unknown backend protocol '%v'", backend.Protocol)
+			return nil, nil, errors.Fatalf("unknown backend protocol '%v'", backend.Protocol)
 		}
 
 		var lbMethod types.LBMethod
@@ -139,13 +218,45 @@ func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, expireDelay
 				zap.Error(err),
 			)
 		}
-		if lbMethod == types.RoundRobinLB {
+
+		err = backend.ValidateWeights()
+		if err != nil {
+			logger.Error("invalid weights",
+				zap.String("name", backend.GroupName),
+				zap.Error(err),
+			)
+			return nil, nil, errors.FromErr(err)
+		}
+
+		// weights are applied to the existing group, they don't require a new one
+		definition := backend
+		definition.Weights = nil
+		if g, ok := previous[backend.GroupName]; ok && reflect.DeepEqual(g.definition, definition) {
+			logger.Debug("keeping unchanged lb group",
+				zap.String("name", backend.GroupName),
+			)
+			g.weights = backend.Weights
+			storeClients = append(storeClients, g.client)
+			groups[backend.GroupName] = g
+			continue
+		}
+
+		err = backend.QueryCaches.Validate()
+		if err != nil {
+			logger.Error("invalid query caches config",
+				zap.String("name", backend.GroupName),
+				zap.Error(err),
+			)
+			return nil, nil, errors.FromErr(err)
+		}
+		switch lbMethod {
+		case types.RoundRobinLB, types.LeastRequestsLB, types.EWMALB:
 			client, ePtr = backendInit(logger, backend)
 			e.Merge(ePtr)
 			if e.HaveFatalErrors {
-				return nil, &e
+				return nil, nil, &e
 			}
-		} else {
+		default:
 			config := backend
 
 			backends := make([]types.ServerClient, 0, len(backend.Servers))
@@ -155,29 +266,78 @@ func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, expireDelay
 				client, ePtr = backendInit(logger, config)
 				e.Merge(ePtr)
 				if e.HaveFatalErrors {
-					return nil, &e
+					return nil, nil, &e
 				}
 				backends = append(backends, client)
 			}
 
-			client, ePtr = broadcast.NewBroadcastGroup(logger, backend.GroupName, backends, expireDelaySec, concurencyLimit, timeouts)
+			switch lbMethod {
+			case types.CarbonCHLB, types.FNV1aCHLB:
+				var ring *hashring.Ring
+				ring, err = createHashRing(lbMethod, backend)
+				if err != nil {
+					logger.Error("failed to create hash ring",
+						zap.String("name", backend.GroupName),
+						zap.Error(err),
+					)
+					return nil, nil, errors.FromErr(err)
+				}
+				client, ePtr = broadcast.NewBroadcastGroupWithHashRing(logger, backend.GroupName, backends, ring, backend.ReplicationFactor, expireDelaySec, concurencyLimit, timeouts)
+			case types.QuorumLB:
+				client, ePtr = broadcast.NewBroadcastGroupWithQuorum(logger, backend.GroupName, backends, backend.Replicas, backend.Quorum, expireDelaySec, concurencyLimit, timeouts)
+			default:
+				client, ePtr = broadcast.NewBroadcastGroup(logger, backend.GroupName, backends, expireDelaySec, concurencyLimit, timeouts)
+			}
 			e.Merge(ePtr)
 			if e.HaveFatalErrors {
-				return nil, &e
+				return nil, nil, &e
 			}
 		}
+		if bg, ok := client.(*broadcast.BroadcastGroup); ok {
+			bg.SetQueryCaches(backend.QueryCaches.Merge(queryCaches))
+		}
 		storeClients = append(storeClients, client)
+		groups[backend.GroupName] = backendGroup{
+			definition: definition,
+			weights:    backend.Weights,
+			client:     client,
+		}
 	}
-	return storeClients, nil
+	return storeClients, groups, nil
+}
+
+func createHashRing(lbMethod types.LBMethod, backend types.BackendV2) (*hashring.Ring, error) {
+	if len(backend.HashRingNodes) != 0 && len(backend.HashRingNodes) != len(backend.Servers) {
+		return nil, fmt.Errorf("hashRingNodes must contain exactly one entry per server, got %v for %v servers", len(backend.HashRingNodes), len(backend.Servers))
+	}
+
+	nodes := make([]hashring.Node, 0, len(backend.Servers))
+	for i, server := range backend.Servers {
+		var node hashring.Node
+		var err error
+		if len(backend.HashRingNodes) != 0 {
+			node, err = hashring.ParseNode(server, backend.HashRingNodes[i])
+		} else {
+			node, err = hashring.NodeFromURL(server)
+		}
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	hashType := hashring.CarbonCH
+	if lbMethod == types.FNV1aCHLB {
+		hashType = hashring.FNV1aCH
+	}
+
+	return hashring.New(hashType, nodes), nil
 }
 
 // NewZipper allows to create new Zipper
 func NewZipper(sender func(*types.Stats), config *config.Config, logger *zap.Logger) (*Zipper, error) {
 	config.Timeouts = sanitizeTimouts(config.Timeouts, defaultTimeouts)
 
-	var searchBackends types.ServerClient
-	var prefix string
-
 	if config.InternalRoutingCache.Seconds() < 30 {
 		logger.Warn("internalRoutingCache is too low",
 			zap.String("reason", "this variable is used for internal routing cache, minimum allowed is 30s"),
@@ -185,99 +345,18 @@ func NewZipper(sender func(*types.Stats), config *config.Config, logger *zap.Log
 		)
 		config.InternalRoutingCache = 60 * time.Second
 	}
+	pathcache.Configure(config.Routing)
 
-	// Convert old config format to new one
-	if config.CarbonSearch.Backend != "" {
-		config.CarbonSearchV2.BackendsV2 = types.BackendsV2{
-			Backends: []types.BackendV2{{
-				GroupName:           config.CarbonSearch.Backend,
-				Protocol:            "carbonapi_v2_pb",
-				LBMethod:            "roundrobin",
-				Servers:             []string{config.CarbonSearch.Backend},
-				Timeouts:            &config.Timeouts,
-				ConcurrencyLimit:    &config.ConcurrencyLimitPerServer,
-				KeepAliveInterval:   &config.KeepAliveInterval,
-				MaxIdleConnsPerHost: &config.MaxIdleConnsPerHost,
-				MaxTries:            &config.MaxTries,
-				MaxGlobs:            0,
-			}},
-			MaxIdleConnsPerHost:       config.MaxIdleConnsPerHost,
-			ConcurrencyLimitPerServer: config.ConcurrencyLimitPerServer,
-			Timeouts:                  config.Timeouts,
-			KeepAliveInterval:         config.KeepAliveInterval,
-			MaxTries:                  config.MaxTries,
-			MaxGlobs:                  config.MaxGlobs,
-		}
-		config.CarbonSearchV2.Prefix = config.CarbonSearch.Prefix
+	if e := config.BackendsV2.QueryCaches.Validate(); e != nil {
+		return nil, fmt.Errorf("invalid query caches config: %v", e)
 	}
 
-	if len(config.CarbonSearchV2.BackendsV2.Backends) > 0 {
-		prefix = config.CarbonSearchV2.Prefix
-		searchClients, err := createBackendsV2(logger, config.CarbonSearchV2.BackendsV2, int32(config.InternalRoutingCache.Seconds()))
-		if err != nil && err.HaveFatalErrors {
-			logger.Fatal("errors while initialing zipper search backends",
-				zap.Any("errors", err.Errors),
-			)
-		}
-
-		searchBackends, err = broadcast.NewBroadcastGroup(logger, "search", searchClients, int32(config.InternalRoutingCache.Seconds()), config.ConcurrencyLimitPerServer, config.Timeouts)
-		if err != nil && err.HaveFatalErrors {
-			logger.Fatal("errors while initialing zipper search backends",
-				zap.Any("errors", err.Errors),
-			)
-		}
+	sharedCache, e := cache.NewSharedCache(config.SharedCache)
+	if e != nil {
+		return nil, fmt.Errorf("invalid shared cache config: %v", e)
 	}
 
-	// Convert old config format to new one
-	if config.Backends != nil && len(config.Backends) != 0 {
-		config.BackendsV2 = types.BackendsV2{
-			Backends: []types.BackendV2{
-				{
-					GroupName:           "backends",
-					Protocol:            "carbonapi_v2_pb",
-					LBMethod:            "broadcast",
-					Servers:             config.Backends,
-					Timeouts:            &config.Timeouts,
-					ConcurrencyLimit:    &config.ConcurrencyLimitPerServer,
-					KeepAliveInterval:   &config.KeepAliveInterval,
-					MaxIdleConnsPerHost: &config.MaxIdleConnsPerHost,
-					MaxTries:            &config.MaxTries,
-					MaxGlobs:            config.MaxGlobs,
-				},
-			},
-			MaxIdleConnsPerHost:       config.MaxIdleConnsPerHost,
-			ConcurrencyLimitPerServer: config.ConcurrencyLimitPerServer,
-			Timeouts:                  config.Timeouts,
-			KeepAliveInterval:         config.KeepAliveInterval,
-			MaxTries:                  config.MaxTries,
-			MaxGlobs:                  config.MaxGlobs,
-		}
-	}
-
-	config.BackendsV2.Timeouts = sanitizeTimouts(config.BackendsV2.Timeouts, config.Timeouts)
-	for i := range config.BackendsV2.Backends {
-		if config.BackendsV2.Backends[i].Timeouts == nil {
-			timeouts := config.BackendsV2.Timeouts
-			config.BackendsV2.Backends[i].Timeouts = &timeouts
-		}
-		timeouts := sanitizeTimouts(*(config.BackendsV2.Backends[i].Timeouts), config.BackendsV2.Timeouts)
-		config.BackendsV2.Backends[i].Timeouts = &timeouts
-	}
-
-	storeClients, err := createBackendsV2(logger, config.BackendsV2, int32(config.InternalRoutingCache.Seconds()))
-	if err != nil && err.HaveFatalErrors {
-		logger.Fatal("errors while initialing zipper store backends",
-			zap.Any("errors", err.Errors),
-		)
-	}
-
-	var storeBackends types.ServerClient
-	storeBackends, err = broadcast.NewBroadcastGroup(logger, "root", storeClients, int32(config.InternalRoutingCache.Seconds()), config.ConcurrencyLimitPerServer, config.Timeouts)
-	if err != nil && err.HaveFatalErrors {
-		logger.Fatal("errors while initialing zipper store backends",
-			zap.Any("errors", err.Errors),
-		)
-	}
+	convertBackends(config)
 
 	z := &Zipper{
 		probeTicker: time.NewTicker(config.InternalRoutingCache),
@@ -286,17 +365,40 @@ func NewZipper(sender func(*types.Stats), config *config.Config, logger *zap.Log
 
 		sendStats: sender,
 
-		storeBackends:             storeBackends,
-		searchBackends:            searchBackends,
-		searchPrefix:              prefix,
-		searchConfigured:          len(prefix) > 0 && len(searchBackends.Backends()) > 0,
+		backends:                  &atomic.Value{},
+		reloadLock:                &sync.Mutex{},
+		sharedCache:               sharedCache,
+		chunkCache:                cache.NewChunkCache(config.FetchChunks),
+		expireDelaySec:            int32(config.InternalRoutingCache.Seconds()),
+		timeouts:                  config.Timeouts,
 		concurrencyLimitPerServer: config.ConcurrencyLimitPerServer,
 		keepAliveInterval:         config.KeepAliveInterval,
 		timeout:                   config.Timeouts.Render,
 		timeoutConnect:            config.Timeouts.Connect,
+		guardrails:                &config.Guardrails,
+		snapshotter:               pathcache.NewSnapshotter(logger, config.Routing),
 		logger:                    logger,
 	}
 
+	b, err := z.newBackends(config, nil)
+	if err != nil && err.HaveFatalErrors {
+		logger.Fatal("errors while initialing zipper backends",
+			zap.Any("errors", err.Errors),
+		)
+	}
+	z.backends.Store(b)
+	b.register()
+
+	if z.snapshotter != nil {
+		err := z.snapshotter.Load()
+		if err != nil {
+			logger.Error("failed to load routing snapshot",
+				zap.Error(err),
+			)
+		}
+		go z.snapshotter.Run()
+	}
+
 	logger.Debug("zipper config",
 		zap.Any("config", config),
 	)
@@ -308,9 +410,12 @@ func NewZipper(sender func(*types.Stats), config *config.Config, logger *zap.Log
 }
 
 func (z *Zipper) doProbe(logger *zap.Logger) {
-	ctx := context.Background()
+	ctx := limiter.WithPriority(context.Background(), limiter.ProbePriority)
+
+	b := z.acquire()
+	defer b.release()
 
-	_, err := z.storeBackends.ProbeTLDs(ctx)
+	_, err := b.store.ProbeTLDs(ctx)
 	if err != nil && err.HaveFatalErrors {
 		logger.Error("failed to probe tlds",
 			zap.Any("errors", err.Errors),
@@ -318,6 +423,54 @@ func (z *Zipper) doProbe(logger *zap.Logger) {
 	}
 }
 
+// SaveRoutingSnapshot saves routing index to the snapshot file, if it's configured. Should be called on shutdown
+func (z *Zipper) SaveRoutingSnapshot() error {
+	if z.snapshotter == nil {
+		return nil
+	}
+	return z.snapshotter.Save()
+}
+
+// PurgeRootCaches removes items, that were requested for metrics accepted by match, from the shared and chunk caches
+// of the root group. Nil match removes all of them. Empty kind selects both caches, "shared" or "chunks" select one of
+// them. Returns amount of removed items by group name and cache kind, disabled caches are skipped
+func (z *Zipper) PurgeRootCaches(kind string, match func(metric string) bool) map[string]map[string]int {
+	removed := make(map[string]int)
+	if z.sharedCache != nil && (kind == "" || kind == "shared") {
+		if match == nil {
+			removed["shared"] = z.sharedCache.Flush()
+		} else {
+			removed["shared"] = z.sharedCache.Purge(match)
+		}
+	}
+	if z.chunkCache != nil && (kind == "" || kind == "chunks") {
+		if match == nil {
+			removed["chunks"] = z.chunkCache.Flush()
+		} else {
+			removed["chunks"] = z.chunkCache.Purge(match)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	b := z.acquire()
+	defer b.release()
+	return map[string]map[string]int{b.store.Name(): removed}
+}
+
+// ForceProbe drops cached probe results and makes zipper probe the backends for top-level names right away. Returns
+// false if the probe is already running
+func (z *Zipper) ForceProbe() bool {
+	cache.Flush("", "probe")
+	select {
+	case z.ProbeForce <- 1:
+		return true
+	default:
+		return false
+	}
+}
+
 func (z *Zipper) probeTlds() {
 	logger := z.logger.With(zap.String("type", "probe"))
 	for {
@@ -335,18 +488,26 @@ func (z *Zipper) probeTlds() {
 
 // GRPC-compatible methods
 func (z Zipper) FetchProtoV3(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, error) {
+	ctx = limiter.WithDefaultPriority(ctx, limiter.RenderPriority)
+	b := z.acquire()
+	defer b.release()
+
+	if err := z.guardrails.CheckGlobs(len(request.Metrics)); err != nil {
+		return nil, nil, err
+	}
+	ctx = types.WithGuardrails(ctx, z.guardrails)
 	var statsSearch *types.Stats
 	var e errors.Errors
-	if z.searchConfigured {
+	if b.searchConfigured {
 		realRequest := &protov3.MultiFetchRequest{
 			Metrics: make([]protov3.FetchRequest, 0, len(request.Metrics)),
 		}
 		for _, metric := range request.Metrics {
-			if strings.HasPrefix(metric.Name, z.searchPrefix) {
+			if strings.HasPrefix(metric.Name, b.searchPrefix) {
 				r := &protov3.MultiGlobRequest{
 					Metrics: []string{metric.Name},
 				}
-				res, stat, err := z.searchBackends.Find(ctx, r)
+				res, stat, err := b.search.Find(ctx, r)
 				if statsSearch == nil {
 					statsSearch = stat
 				} else {
@@ -366,6 +527,7 @@ func (z Zipper) FetchProtoV3(ctx context.Context, request *protov3.MultiFetchReq
 							Name:            m.Path,
 							StartTime:       metric.StartTime,
 							StopTime:        metric.StopTime,
+							PathExpression:  metric.PathExpression,
 							FilterFunctions: metric.FilterFunctions,
 						})
 					}
@@ -382,7 +544,14 @@ func (z Zipper) FetchProtoV3(ctx context.Context, request *protov3.MultiFetchReq
 		}
 	}
 
-	res, stats, err := z.storeBackends.Fetch(ctx, request)
+	if err := z.checkFetchEstimate(ctx, b, request); err != nil {
+		z.logger.Warn("request is rejected before fetching",
+			zap.Error(err),
+		)
+		return nil, nil, err
+	}
+
+	res, stats, err := b.store.Fetch(ctx, request)
 	if statsSearch != nil {
 		if stats == nil {
 			stats = statsSearch
@@ -397,18 +566,61 @@ func (z Zipper) FetchProtoV3(ctx context.Context, request *protov3.MultiFetchReq
 		z.logger.Error("had fatal errors while fetching result",
 			zap.Any("errors", e.Errors),
 		)
+		if err := types.LimitExceeded(e.Errors); err != nil {
+			return nil, nil, err
+		}
 		return nil, nil, types.ErrNoMetricsFetched
 	}
 
 	return res, stats, nil
 }
 
+// checkFetchEstimate expands globs of the request and checks amount of metrics and datapoints, that are expected in the
+// response, against the guardrails. Globs that can't be expanded are not counted, response is checked after fetch anyway
+func (z Zipper) checkFetchEstimate(ctx context.Context, b *backends, request *protov3.MultiFetchRequest) error {
+	if z.guardrails.MaxMetrics == 0 && z.guardrails.MaxPoints == 0 {
+		return nil
+	}
+	matches := make([]int, len(request.Metrics))
+	for i := range request.Metrics {
+		if !strings.ContainsAny(request.Metrics[i].Name, "*?[{") {
+			matches[i] = 1
+			continue
+		}
+		res, _, err := b.store.Find(ctx, &protov3.MultiGlobRequest{Metrics: []string{request.Metrics[i].Name}})
+		if err != nil {
+			if e := types.LimitExceeded(err.Errors); e != nil {
+				return e
+			}
+		}
+		if res == nil {
+			continue
+		}
+		for _, m := range res.Metrics {
+			for _, match := range m.Matches {
+				if match.IsLeaf {
+					matches[i]++
+				}
+			}
+		}
+	}
+	return z.guardrails.CheckFetchEstimate(request, matches)
+}
+
 func (z Zipper) FindProtoV3(ctx context.Context, request *protov3.MultiGlobRequest) (*protov3.MultiGlobResponse, *types.Stats, error) {
+	ctx = limiter.WithDefaultPriority(ctx, limiter.FindPriority)
+	b := z.acquire()
+	defer b.release()
+
+	if err := z.guardrails.CheckGlobs(len(request.Metrics)); err != nil {
+		return nil, nil, err
+	}
+	ctx = types.WithGuardrails(ctx, z.guardrails)
 	searchRequests := &protov3.MultiGlobRequest{}
-	if z.searchConfigured {
+	if b.searchConfigured {
 		realRequest := &protov3.MultiGlobRequest{Metrics: make([]string, 0, len(request.Metrics))}
 		for _, m := range request.Metrics {
-			if strings.HasPrefix(m, z.searchPrefix) {
+			if strings.HasPrefix(m, b.searchPrefix) {
 				searchRequests.Metrics = append(searchRequests.Metrics, m)
 			} else {
 				realRequest.Metrics = append(realRequest.Metrics, m)
@@ -419,7 +631,7 @@ func (z Zipper) FindProtoV3(ctx context.Context, request *protov3.MultiGlobReque
 		}
 	}
 
-	res, stats, err := z.storeBackends.Find(ctx, request)
+	res, stats, err := b.store.Find(ctx, request)
 	if err == nil {
 		err = &errors.Errors{}
 	}
@@ -429,7 +641,7 @@ func (z Zipper) FindProtoV3(ctx context.Context, request *protov3.MultiGlobReque
 		Err:      err,
 	}
 	if len(searchRequests.Metrics) > 0 {
-		resSearch, statsSearch, err := z.searchBackends.Find(ctx, request)
+		resSearch, statsSearch, err := b.search.Find(ctx, request)
 		searchResponse := &types.ServerFindResponse{
 			Response: resSearch,
 			Stats:    statsSearch,
@@ -442,6 +654,9 @@ func (z Zipper) FindProtoV3(ctx context.Context, request *protov3.MultiGlobReque
 		z.logger.Error("had fatal errors during request",
 			zap.Any("errors", findResponse.Err.Errors),
 		)
+		if err := types.LimitExceeded(findResponse.Err.Errors); err != nil {
+			return nil, nil, err
+		}
 		return nil, nil, types.ErrNoMetricsFetched
 	} else if len(findResponse.Err.Errors) > 0 {
 		z.logger.Warn("got non-fatal errors during request",
@@ -453,6 +668,10 @@ func (z Zipper) FindProtoV3(ctx context.Context, request *protov3.MultiGlobReque
 }
 
 func (z Zipper) InfoProtoV3(ctx context.Context, request *protov3.MultiGlobRequest) (*protov3.ZipperInfoResponse, *types.Stats, error) {
+	ctx = limiter.WithDefaultPriority(ctx, limiter.InfoPriority)
+	b := z.acquire()
+	defer b.release()
+
 	realRequest := &protov3.MultiMetricsInfoRequest{Names: make([]string, 0, len(request.Metrics))}
 	res, _, err := z.FindProtoV3(ctx, request)
 	if err == nil || err == types.ErrNonFatalErrors {
@@ -469,7 +688,7 @@ func (z Zipper) InfoProtoV3(ctx context.Context, request *protov3.MultiGlobReque
 		}
 	}
 
-	r, stats, e := z.storeBackends.Info(ctx, realRequest)
+	r, stats, e := b.store.Info(ctx, realRequest)
 	if e.HaveFatalErrors {
 		z.logger.Error("had fatal errors during request",
 			zap.Any("errors", e.Errors),
@@ -485,7 +704,11 @@ func (z Zipper) InfoProtoV3(ctx context.Context, request *protov3.MultiGlobReque
 }
 
 func (z Zipper) ListProtoV3(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, error) {
-	r, stats, e := z.storeBackends.List(ctx)
+	ctx = limiter.WithDefaultPriority(ctx, limiter.InfoPriority)
+	b := z.acquire()
+	defer b.release()
+
+	r, stats, e := b.store.List(ctx)
 	if e.HaveFatalErrors {
 		z.logger.Error("had fatal errors during request",
 			zap.Any("errors", e.Errors),
@@ -500,7 +723,11 @@ func (z Zipper) ListProtoV3(ctx context.Context) (*protov3.ListMetricsResponse,
 	return r, stats, nil
 }
 func (z Zipper) StatsProtoV3(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, error) {
-	r, stats, e := z.storeBackends.Stats(ctx)
+	ctx = limiter.WithDefaultPriority(ctx, limiter.InfoPriority)
+	b := z.acquire()
+	defer b.release()
+
+	r, stats, e := b.store.Stats(ctx)
 	if e.HaveFatalErrors {
 		z.logger.Error("had fatal errors while fetching result",
 			zap.Any("errors", e.Errors),
@@ -1,10 +1,13 @@
 package zipper
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"testing"
+	"time"
 
+	"github.com/go-graphite/carbonzipper/zipper/dummy"
 	"github.com/go-graphite/carbonzipper/zipper/errors"
 	"github.com/go-graphite/carbonzipper/zipper/types"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
@@ -240,3 +243,47 @@ func TestMergeValues(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckFetchEstimate(t *testing.T) {
+	client := dummy.NewDummyClient("TestCheckFetchEstimate", []string{"backend1"}, 0)
+	client.AddFindResponse(&protov3.MultiGlobRequest{Metrics: []string{"foo.*"}}, &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{{
+			Name: "foo.*",
+			Matches: []protov3.GlobMatch{
+				{Path: "foo.bar", IsLeaf: true},
+				{Path: "foo.baz", IsLeaf: true},
+				{Path: "foo.qux", IsLeaf: false},
+			},
+		}},
+	}, &types.Stats{}, nil)
+	b := &backends{store: client}
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.*", StartTime: 0, StopTime: 3600},
+			{Name: "foo.bar", StartTime: 0, StopTime: 3600},
+		},
+	}
+
+	for _, tc := range []struct {
+		guardrails types.Guardrails
+		limit      string
+	}{
+		{guardrails: types.Guardrails{}},
+		{guardrails: types.Guardrails{MaxMetrics: 3, MaxPoints: 180}},
+		{guardrails: types.Guardrails{MaxMetrics: 2}, limit: "metrics"},
+		{guardrails: types.Guardrails{MaxPoints: 179}, limit: "points"},
+		{guardrails: types.Guardrails{MaxPoints: 1000, EstimationStep: 10 * time.Second}, limit: "points"},
+	} {
+		z := Zipper{guardrails: &tc.guardrails}
+		err := z.checkFetchEstimate(context.Background(), b, request)
+		if tc.limit == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error %v", tc.guardrails, err)
+			}
+			continue
+		}
+		if e, ok := err.(*types.LimitExceededError); !ok || e.Limit != tc.limit {
+			t.Errorf("%+v: expected %v limit to be exceeded, got %v", tc.guardrails, tc.limit, err)
+		}
+	}
+}